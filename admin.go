@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Admin serves the operator-facing API, under /admin, which is
+// authenticated separately from the broker API itself.
+type Admin struct {
+	broker *Broker
+}
+
+func adminCredentials() (Credentials, error) {
+	s := os.Getenv("SB_ADMIN_CREDENTIALS")
+	if s == "" {
+		return nil, nil
+	}
+
+	creds, err := parseCredentials(s)
+	if err != nil {
+		return nil, fmt.Errorf("SB_ADMIN_CREDENTIALS: %w", err)
+	}
+	if creds.Insecure() && !devMode() {
+		return nil, fmt.Errorf("SB_ADMIN_CREDENTIALS: refusing to start with the default broker password")
+	}
+	return creds, nil
+}
+
+func AttachAdminRoutes(router *mux.Router, broker *Broker) {
+	admin := Admin{broker: broker}
+	router.HandleFunc("/admin/instances", admin.instances).Methods("GET")
+	router.HandleFunc("/admin/instances/{instance_id}", admin.instance).Methods("GET")
+	router.HandleFunc("/admin/instances/{instance_id}/retry", admin.retry).Methods("POST")
+	router.HandleFunc("/admin/instances/{instance_id}/suspend", admin.suspend).Methods("POST")
+	router.HandleFunc("/admin/instances/{instance_id}/resume", admin.resume).Methods("POST")
+	router.HandleFunc("/admin/instances/{instance_id}/extend", admin.extend).Methods("POST")
+	router.HandleFunc("/admin/instances/{instance_id}/restore", admin.restore).Methods("POST")
+	router.HandleFunc("/admin/instances/{instance_id}/extensions", admin.extensions).Methods("GET")
+	router.HandleFunc("/admin/instances/{instance_id}/backups", admin.backups).Methods("GET")
+	router.HandleFunc("/admin/instances/{instance_id}/backups", admin.backup).Methods("POST")
+	router.HandleFunc("/admin/backups/{id}", admin.getBackup).Methods("GET")
+	router.HandleFunc("/admin/backups/{id}", admin.deleteBackup).Methods("DELETE")
+	router.HandleFunc("/admin/backups/{id}/restore", admin.restoreBackup).Methods("POST")
+	router.HandleFunc("/admin/isolation-test", admin.isolationTest).Methods("POST")
+	router.HandleFunc("/admin/tombstones", admin.tombstones).Methods("GET")
+	router.HandleFunc("/admin/quotas", admin.quotas).Methods("GET")
+	router.HandleFunc("/admin/quotas/{scope}/{guid}", admin.setQuota).Methods("PUT")
+	router.HandleFunc("/admin/quotas/{scope}/{guid}", admin.deleteQuota).Methods("DELETE")
+	router.HandleFunc("/admin/events", admin.events).Methods("GET")
+	router.HandleFunc("/admin/webhooks", admin.webhooks).Methods("GET")
+	router.HandleFunc("/admin/webhooks/deliveries", admin.deliveries).Methods("GET")
+	router.HandleFunc("/admin/webhooks/deliveries/{id}/retry", admin.retryDelivery).Methods("POST")
+}
+
+func (admin Admin) respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		oops("failed to encode %d admin response: %s\n", status, err)
+	}
+}
+
+func (admin Admin) fail(w http.ResponseWriter, status int, err error) {
+	oops("admin request failed: %s\n", err)
+	admin.respond(w, status, struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
+
+func adminIdentity(req *http.Request) string {
+	username, _, _ := req.BasicAuth()
+	return "admin:" + username
+}
+
+func (admin Admin) record(req *http.Request, op string, err error) {
+	admin.broker.record(Event{
+		Operation: op,
+		Identity:  adminIdentity(req),
+		Outcome:   outcome(err, outcomeSucceeded),
+		Error:     errorString(err),
+	})
+}
+
+func (admin Admin) instances(w http.ResponseWriter, req *http.Request) {
+	l, err := admin.broker.Instances(req.FormValue("org"), req.FormValue("space"))
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, l)
+}
+
+func (admin Admin) instance(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["instance_id"]
+
+	inst, err := admin.broker.GetInstance(id)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if inst == nil {
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("instance %s not found", id))
+		return
+	}
+
+	bindings, err := admin.broker.Bindings(id)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	admin.respond(w, http.StatusOK, struct {
+		Instance
+		Bindings []Binding `json:"bindings"`
+	}{*inst, bindings})
+}
+
+func (admin Admin) extensions(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["instance_id"]
+
+	inst, err := admin.broker.GetInstance(id)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if inst == nil || inst.State == "gone" {
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("instance %s not found", id))
+		return
+	}
+
+	db := inst.Database
+	if inst.SharedDatabase != "" {
+		db = inst.SharedDatabase
+	}
+	l, err := admin.broker.InstalledExtensions(db)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, l)
+}
+
+func (admin Admin) retry(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["instance_id"]
+
+	op, err := admin.broker.Retry(id)
+	admin.broker.record(Event{
+		Operation: "retry",
+		Instance:  id,
+		Identity:  adminIdentity(req),
+		Outcome:   outcome(err, outcomeAccepted),
+		Error:     errorString(err),
+	})
+	switch {
+	case err == brokerapi.ErrInstanceDoesNotExist:
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("instance %s not found", id))
+	case err == ErrNothingToRetry:
+		admin.fail(w, http.StatusConflict, err)
+	case err == ErrTooManyJobs:
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(jobRetryAfter.Seconds())))
+		admin.fail(w, http.StatusTooManyRequests, err)
+	case err != nil:
+		admin.fail(w, http.StatusInternalServerError, err)
+	default:
+		admin.respond(w, http.StatusAccepted, struct {
+			Operation string `json:"operation"`
+		}{op})
+	}
+}
+
+func (admin Admin) isolationTest(w http.ResponseWriter, req *http.Request) {
+	sample := 0
+	if s := req.FormValue("sample"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			admin.fail(w, http.StatusBadRequest, fmt.Errorf("invalid sample '%s'", s))
+			return
+		}
+		sample = n
+	}
+
+	report, err := admin.broker.TestIsolation(sample)
+	if err == nil && !report.Passed {
+		admin.record(req, "isolation-test", fmt.Errorf("%d of %d bindings were not isolated", report.Failed, len(report.Bindings)))
+	} else {
+		admin.record(req, "isolation-test", err)
+	}
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, report)
+}
+
+func (admin Admin) suspend(w http.ResponseWriter, req *http.Request) {
+	admin.toggle(w, req, "suspend", admin.broker.Suspend)
+}
+
+func (admin Admin) resume(w http.ResponseWriter, req *http.Request) {
+	admin.toggle(w, req, "resume", admin.broker.Resume)
+}
+
+func (admin Admin) tombstones(w http.ResponseWriter, req *http.Request) {
+	l, err := admin.broker.Tombstones(req.FormValue("instance"))
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, l)
+}
+
+// restore brings back a deleted instance's database, under its own ID
+// or (with `as`) another one.
+func (admin Admin) restore(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["instance_id"]
+	as := req.FormValue("as")
+	if as == "" {
+		as = id
+	}
+
+	inst, err := admin.broker.Restore(id, as)
+	admin.broker.record(Event{
+		Operation: "restore",
+		Instance:  id,
+		Identity:  adminIdentity(req),
+		Outcome:   outcome(err, outcomeSucceeded),
+		Error:     errorString(err),
+	})
+	switch {
+	case err == ErrNoTombstone:
+		admin.fail(w, http.StatusNotFound, err)
+	case err == brokerapi.ErrInstanceAlreadyExists:
+		admin.fail(w, http.StatusConflict, fmt.Errorf("instance %s already exists", as))
+	case err != nil:
+		admin.fail(w, http.StatusInternalServerError, err)
+	default:
+		admin.respond(w, http.StatusOK, inst)
+	}
+}
+
+// extend pushes back a trial instance's expiry, either `by` a duration
+// (from when it expires now) or `until` a given time.
+func (admin Admin) extend(w http.ResponseWriter, req *http.Request) {
+	by, until := req.FormValue("by"), req.FormValue("until")
+	var d time.Duration
+	var t time.Time
+	var err error
+	switch {
+	case by != "" && until != "":
+		admin.fail(w, http.StatusBadRequest, fmt.Errorf("a trial can be extended by a duration, or until a time, but not both"))
+		return
+	case by != "":
+		if d, err = time.ParseDuration(by); err != nil || d <= 0 {
+			admin.fail(w, http.StatusBadRequest, fmt.Errorf("invalid duration '%s' (try i.e. 72h)", by))
+			return
+		}
+	case until != "":
+		if t, err = time.Parse(time.RFC3339, until); err != nil {
+			admin.fail(w, http.StatusBadRequest, fmt.Errorf("invalid time '%s' (try i.e. %s)", until, time.Now().Add(72*time.Hour).UTC().Format(time.RFC3339)))
+			return
+		}
+	default:
+		admin.fail(w, http.StatusBadRequest, fmt.Errorf("missing `by` or `until`"))
+		return
+	}
+
+	admin.toggle(w, req, "extend", func(id string) error {
+		if d > 0 {
+			inst, err := admin.broker.GetInstance(id)
+			if err != nil {
+				return err
+			}
+			if inst == nil || inst.State == "gone" {
+				return brokerapi.ErrInstanceDoesNotExist
+			}
+			if inst.Expires == nil {
+				return ErrNotATrial
+			}
+			t = inst.Expires.Add(d)
+		}
+		return admin.broker.Extend(id, t)
+	})
+}
+
+// toggle suspends, resumes or extends an instance, and shows how it
+// ended up.
+func (admin Admin) toggle(w http.ResponseWriter, req *http.Request, op string, fn func(string) error) {
+	id := mux.Vars(req)["instance_id"]
+
+	err := fn(id)
+	admin.broker.record(Event{
+		Operation: op,
+		Instance:  id,
+		Identity:  adminIdentity(req),
+		Outcome:   outcome(err, outcomeSucceeded),
+		Error:     errorString(err),
+	})
+	switch {
+	case err == brokerapi.ErrInstanceDoesNotExist:
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("instance %s not found", id))
+		return
+	case err == ErrNotSuspendable || err == ErrNotSuspended || err == ErrNotATrial:
+		admin.fail(w, http.StatusConflict, err)
+		return
+	case err == ErrExtensionPassed || err == ErrExtensionTooLong:
+		admin.fail(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	inst, err := admin.broker.GetInstance(id)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, inst)
+}
+
+func (admin Admin) backups(w http.ResponseWriter, req *http.Request) {
+	l, err := admin.broker.Backups(mux.Vars(req)["instance_id"])
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, l)
+}
+
+// backup starts an on-demand backup of an instance; how it went is
+// recorded (and announced) once it is finished.
+func (admin Admin) backup(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["instance_id"]
+
+	bk, err := admin.broker.StartBackup(id, adminIdentity(req))
+	if err != nil {
+		admin.broker.record(Event{Operation: "backup", Instance: id, Identity: adminIdentity(req), Outcome: outcome(err, outcomeAccepted), Error: errorString(err)})
+		admin.failBackup(w, err)
+		return
+	}
+	admin.respond(w, http.StatusAccepted, bk)
+}
+
+func (admin Admin) getBackup(w http.ResponseWriter, req *http.Request) {
+	bk, err := admin.broker.GetBackup(mux.Vars(req)["id"])
+	if err == nil && bk == nil {
+		err = ErrNoBackup
+	}
+	if err != nil {
+		admin.failBackup(w, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, bk)
+}
+
+func (admin Admin) deleteBackup(w http.ResponseWriter, req *http.Request) {
+	err := admin.broker.DeleteBackup(mux.Vars(req)["id"])
+	admin.record(req, "delete-backup", err)
+	if err != nil {
+		admin.failBackup(w, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, struct{}{})
+}
+
+// restoreBackup replaces the database of the instance that was backed
+// up (or, with `into`, of another instance) with a backup.
+func (admin Admin) restoreBackup(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	into, err := admin.broker.RestoreBackup(id, req.FormValue("into"), adminIdentity(req))
+	if err != nil {
+		admin.broker.record(Event{Operation: "restore", Instance: into, Identity: adminIdentity(req), Outcome: outcome(err, outcomeAccepted), Error: errorString(err)})
+		admin.failBackup(w, err)
+		return
+	}
+	admin.respond(w, http.StatusAccepted, struct {
+		Backup   string `json:"backup"`
+		Instance string `json:"instance"`
+	}{id, into})
+}
+
+func (admin Admin) failBackup(w http.ResponseWriter, err error) {
+	switch {
+	case err == ErrBackupsDisabled:
+		admin.fail(w, http.StatusNotImplemented, err)
+	case err == ErrNoBackup || err == brokerapi.ErrInstanceDoesNotExist:
+		admin.fail(w, http.StatusNotFound, err)
+	case err == ErrNotBackupable || err == ErrBackupNotReady || err == ErrConcurrentOperation:
+		admin.fail(w, http.StatusConflict, err)
+	case err == ErrTooManyJobs:
+		admin.fail(w, http.StatusTooManyRequests, err)
+	default:
+		admin.fail(w, http.StatusInternalServerError, err)
+	}
+}
+
+// quotas are addressed as /admin/quotas/:scope/:guid, where a guid of
+// `default` is the fallback quota for every org (or space).
+func quotaKey(req *http.Request) (string, string) {
+	scope, guid := mux.Vars(req)["scope"], mux.Vars(req)["guid"]
+	if guid == "default" {
+		guid = ""
+	}
+	return scope, guid
+}
+
+func (admin Admin) quotas(w http.ResponseWriter, req *http.Request) {
+	l, err := admin.broker.Quotas()
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, l)
+}
+
+func (admin Admin) setQuota(w http.ResponseWriter, req *http.Request) {
+	var q Quota
+	if err := json.NewDecoder(req.Body).Decode(&q); err != nil {
+		admin.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	q.Scope, q.GUID = quotaKey(req)
+
+	if !validQuotaScope(q.Scope) {
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("invalid quota scope '%s' (must be 'org' or 'space')", q.Scope))
+		return
+	}
+	err := admin.broker.SetQuota(q)
+	admin.record(req, "set-quota", err)
+	if err != nil {
+		admin.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, q)
+}
+
+func (admin Admin) deleteQuota(w http.ResponseWriter, req *http.Request) {
+	scope, guid := quotaKey(req)
+
+	ok, err := admin.broker.DeleteQuota(scope, guid)
+	admin.record(req, "delete-quota", err)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("no %s quota for '%s'", scope, mux.Vars(req)["guid"]))
+		return
+	}
+	admin.respond(w, http.StatusOK, struct{}{})
+}
+
+func (admin Admin) events(w http.ResponseWriter, req *http.Request) {
+	filter := EventFilter{
+		Instance:  req.FormValue("instance"),
+		Binding:   req.FormValue("binding"),
+		Operation: req.FormValue("operation"),
+		Identity:  req.FormValue("identity"),
+	}
+	for _, t := range []struct {
+		param string
+		into  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if s := req.FormValue(t.param); s != "" {
+			v, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				admin.fail(w, http.StatusBadRequest, fmt.Errorf("invalid '%s' timestamp '%s' (expected RFC 3339)", t.param, s))
+				return
+			}
+			*t.into = v
+		}
+	}
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			admin.fail(w, http.StatusBadRequest, fmt.Errorf("invalid limit '%s'", s))
+			return
+		}
+		filter.Limit = n
+	}
+
+	l, err := admin.broker.Events(filter)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.FormValue("format") != "jsonl" {
+		admin.respond(w, http.StatusOK, l)
+		return
+	}
+
+	/* JSON lines, one event per line, for export into other tools */
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for _, e := range l {
+		if err := enc.Encode(e); err != nil {
+			oops("failed to export audit events: %s\n", err)
+			return
+		}
+	}
+}
+
+func (admin Admin) webhooks(w http.ResponseWriter, req *http.Request) {
+	l := make([]Webhook, len(admin.broker.Webhooks))
+	for i, h := range admin.broker.Webhooks {
+		/* never hand out the signing secrets */
+		h.Secret = ""
+		l[i] = h
+	}
+	admin.respond(w, http.StatusOK, l)
+}
+
+func (admin Admin) deliveries(w http.ResponseWriter, req *http.Request) {
+	filter := DeliveryFilter{
+		Hook:   req.FormValue("webhook"),
+		Status: req.FormValue("status"),
+	}
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			admin.fail(w, http.StatusBadRequest, fmt.Errorf("invalid limit '%s'", s))
+			return
+		}
+		filter.Limit = n
+	}
+
+	l, err := admin.broker.Deliveries(filter)
+	if err != nil {
+		admin.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	admin.respond(w, http.StatusOK, l)
+}
+
+func (admin Admin) retryDelivery(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("invalid delivery id '%s'", mux.Vars(req)["id"]))
+		return
+	}
+
+	ok, err := admin.broker.RetryDelivery(id)
+	admin.record(req, "retry-webhook", err)
+	if err != nil {
+		admin.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		admin.fail(w, http.StatusNotFound, fmt.Errorf("no undelivered webhook delivery #%d", id))
+		return
+	}
+	admin.respond(w, http.StatusOK, struct{}{})
+}
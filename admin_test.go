@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+var instanceRowColumns = []string{"instance", "name", "state", "plan", "instance_name", "org", "space", "requested_by", "created",
+	"failed_operation", "failed_step", "failure", "parameters", "options", "extensions", "seed", "source", "shared_db", "expires", "backup"}
+
+func TestAdminListInstances(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, &Broker{db: db})
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM dbs WHERE ($1 = '' OR org = $1)`)).
+		WithArgs("org-1", "").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, "done", "plan-1", "my-db", "org-1", "space-1", "cloudfoundry:user-1", time.Now(), "", "", "", "", "{}", "null", "", "", "", nil, ""))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/instances?org=org-1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusOK, w.Code)
+	}
+
+	var l []Instance
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatalf(`unexpected error decoding response: %s`, err)
+	}
+	if len(l) != 1 || l[0].ID != "instance-1" || l[0].Space != "space-1" || l[0].RequestedBy != "cloudfoundry:user-1" {
+		t.Fatalf(`unexpected instance listing: %v`, l)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminGetInstance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, &Broker{db: db})
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, "done", "plan-1", "my-db", "org-1", "space-1", "", time.Now(), "", "", "", "", "{}", "null", "", "", "", nil, ""))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"binding", "instance", "name", "db", "state", "app", "requested_by", "created", "expires"}).
+			AddRow("binding-1", "instance-1", "u0123456789abcdef", mockDbName, "done", "app-1", "", time.Now(), nil))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/instances/instance-1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusOK, w.Code)
+	}
+
+	var inst struct {
+		Instance
+		Bindings []Binding `json:"bindings"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &inst); err != nil {
+		t.Fatalf(`unexpected error decoding response: %s`, err)
+	}
+	if inst.Organization != "org-1" || len(inst.Bindings) != 1 || inst.Bindings[0].App != "app-1" {
+		t.Fatalf(`unexpected instance details: %v`, inst)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminGetInstanceNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, &Broker{db: db})
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/instances/instance-1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAdminRetryRequiresFailedInstance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, &Broker{db: db})
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, "done", "plan-1", "my-db", "org-1", "space-1", "", time.Now(), "", "", "", "", "{}", "null", "", "", "", nil, ""))
+	expectEvent(mock, "retry", outcomeFailed)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/instances/instance-1/retry", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusConflict, w.Code)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminRetryClaimsInstance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, &Broker{db: db})
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, "failed", "plan-1", "my-db", "org-1", "space-1", "", time.Now(), "deprovision", "dropping instance database", "oops", "", "{}", "null", "", "", "", nil, ""))
+	/* somebody else's retry got there first */
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = $2::state`)).
+		WithArgs("instance-1", "teardown", sqlmock.AnyArg(), "deprovision").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectEvent(mock, "retry", outcomeFailed)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/instances/instance-1/retry", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusConflict, w.Code)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminExtendRequiresTrialInstance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, &Broker{db: db})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/instances/instance-1/extend?by=3d", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusBadRequest, w.Code)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, "done", "plan-1", "my-db", "org-1", "space-1", "", time.Now(), "", "", "", "", "{}", "null", "", "", "", nil, ""))
+	expectEvent(mock, "extend", outcomeFailed)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/instances/instance-1/extend?by=72h", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusConflict, w.Code)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
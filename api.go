@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-golang/lager"
+)
+
+const jobRetryAfter = 30 * time.Second
+
+// API serves the parts of the Open Service Broker API that need more
+// than the vendored brokerapi package can give us; anything not routed
+// here falls through to brokerapi's own handlers.
+type API struct {
+	broker *Broker
+}
+
+func AttachRoutes(router *mux.Router, broker *Broker, logger lager.Logger) {
+	api := API{broker: broker}
+	router.HandleFunc("/v2/catalog", api.catalog).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", api.fetchInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", api.provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", api.update).Methods("PATCH")
+	router.HandleFunc("/v2/service_instances/{instance_id}", api.deprovision).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", api.fetchBinding).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", api.bind).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", api.unbind).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", api.lastBindingOperation).Methods("GET")
+
+	brokerapi.AttachRoutes(router, broker, logger)
+}
+
+type provisionRequest struct {
+	brokerapi.ProvisionDetails
+	Context struct {
+		OrganizationGUID string `json:"organization_guid"`
+		SpaceGUID        string `json:"space_guid"`
+		InstanceName     string `json:"instance_name"`
+	} `json:"context"`
+}
+
+// catalogService adds the catalog fields that the vendored brokerapi
+// predates, so that platforms know they can fetch instances and
+// bindings from us.
+type catalogService struct {
+	brokerapi.Service
+	InstancesRetrievable bool `json:"instances_retrievable"`
+	BindingsRetrievable  bool `json:"bindings_retrievable"`
+}
+
+type instanceResponse struct {
+	ServiceID    string          `json:"service_id"`
+	PlanID       string          `json:"plan_id"`
+	DashboardURL string          `json:"dashboard_url,omitempty"`
+	Parameters   json.RawMessage `json:"parameters,omitempty"`
+	Description  string          `json:"description,omitempty"`
+}
+
+type asyncResponse struct {
+	Operation string `json:"operation,omitempty"`
+}
+
+type lastOperationResponse struct {
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description,omitempty"`
+}
+
+type bindingResponse struct {
+	Credentials interface{}     `json:"credentials"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// originatingIdentity decodes the X-Broker-API-Originating-Identity
+// header, `<platform> <base64-encoded JSON>`, into `platform:user`.
+func originatingIdentity(req *http.Request) string {
+	l := strings.SplitN(strings.TrimSpace(req.Header.Get("X-Broker-API-Originating-Identity")), " ", 2)
+	if len(l) != 2 {
+		return ""
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(l[1]))
+	if err != nil {
+		oops("ignoring malformed originating identity header '%s': %s\n", l[1], err)
+		return ""
+	}
+
+	var id struct {
+		UserID   string `json:"user_id"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(b, &id); err != nil {
+		oops("ignoring malformed originating identity header '%s': %s\n", string(b), err)
+		return ""
+	}
+
+	switch {
+	case id.UserID != "":
+		return l[0] + ":" + id.UserID
+	case id.Username != "":
+		return l[0] + ":" + id.Username
+	default:
+		return ""
+	}
+}
+
+func (api API) respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		oops("failed to encode %d response: %s\n", status, err)
+	}
+}
+
+func (api API) fail(w http.ResponseWriter, err error) {
+	var param *ParameterError
+	if errors.As(err, &param) {
+		api.respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+			Error:       "InvalidParameters",
+			Description: err.Error(),
+		})
+		return
+	}
+
+	var quota *QuotaError
+	if errors.As(err, &quota) {
+		api.respond(w, http.StatusForbidden, brokerapi.ErrorResponse{
+			Error:       "QuotaExceeded",
+			Description: err.Error(),
+		})
+		return
+	}
+
+	switch err {
+	case ErrTooManyJobs:
+		tooManyRequests(w, jobRetryAfter, err.Error())
+	case brokerapi.ErrRawParamsInvalid:
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+	case brokerapi.ErrInstanceAlreadyExists:
+		api.respond(w, http.StatusConflict, brokerapi.EmptyResponse{})
+	case brokerapi.ErrInstanceDoesNotExist:
+		api.respond(w, http.StatusGone, brokerapi.EmptyResponse{})
+	case brokerapi.ErrAsyncRequired:
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Error:       "AsyncRequired",
+			Description: err.Error(),
+		})
+	case ErrConcurrentOperation:
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Error:       "ConcurrencyError",
+			Description: err.Error(),
+		})
+	case ErrSuspended:
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+	case brokerapi.ErrPlanChangeNotSupported:
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Error:       "PlanChangeNotSupported",
+			Description: err.Error(),
+		})
+	default:
+		api.respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+	}
+}
+
+func (api API) catalog(w http.ResponseWriter, req *http.Request) {
+	var catalog struct {
+		Services []catalogService `json:"services"`
+	}
+	for _, service := range api.broker.Services() {
+		catalog.Services = append(catalog.Services, catalogService{
+			Service:              service,
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
+		})
+	}
+	api.respond(w, http.StatusOK, catalog)
+}
+
+func (api API) fetchInstance(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+
+	inst, err := api.broker.GetInstance(instance)
+	if err != nil {
+		api.fail(w, err)
+		return
+	}
+	/* instances that never finished provisioning don't exist yet, as
+	   far as the platform is concerned */
+	if inst == nil || inst.State == "gone" || inst.State == "setup" ||
+		(inst.State == "failed" && inst.Failure != nil && inst.Failure.Operation == "provision") {
+		api.respond(w, http.StatusNotFound, brokerapi.EmptyResponse{})
+		return
+	}
+
+	/* a ready instance needs no explaining, but a suspended (or
+	   otherwise unusable) one does */
+	description := ""
+	if inst.State != "done" {
+		var f Failure
+		if inst.Failure != nil {
+			f = *inst.Failure
+		}
+		description = describe(inst.State, f)
+	}
+	api.respond(w, http.StatusOK, instanceResponse{
+		ServiceID:   api.broker.Service.ID,
+		PlanID:      inst.Plan,
+		Parameters:  inst.Parameters,
+		Description: description,
+	})
+}
+
+func (api API) fetchBinding(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+	binding := mux.Vars(req)["binding_id"]
+
+	existing, pass, err := api.broker.existingBinding(binding)
+	if err != nil {
+		api.fail(w, err)
+		return
+	}
+	/* bindings still being made (or that never were) don't exist yet */
+	if existing == nil || existing.Instance != instance || existing.State != "done" {
+		api.respond(w, http.StatusNotFound, brokerapi.EmptyResponse{})
+		return
+	}
+
+	api.respond(w, http.StatusOK, bindingResponse{
+		Credentials: api.broker.credentials(existing.Username, pass, existing.Database, existing.Schema),
+		Parameters:  existing.Parameters,
+	})
+}
+
+func (api API) provision(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+
+	var details provisionRequest
+	if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	async, _ := strconv.ParseBool(req.URL.Query().Get("accepts_incomplete"))
+
+	/* newer platforms only send the org / space in the context object */
+	if details.OrganizationGUID == "" {
+		details.OrganizationGUID = details.Context.OrganizationGUID
+	}
+	if details.SpaceGUID == "" {
+		details.SpaceGUID = details.Context.SpaceGUID
+	}
+
+	spec, existed, err := api.broker.provision(Instance{
+		ID:          instance,
+		Name:        details.Context.InstanceName,
+		RequestedBy: originatingIdentity(req),
+	}, details.ProvisionDetails, async)
+	if err != nil {
+		api.fail(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if spec.IsAsync {
+		status = http.StatusAccepted
+	} else if existed {
+		status = http.StatusOK
+	}
+	api.respond(w, status, brokerapi.ProvisioningResponse{
+		DashboardURL: spec.DashboardURL,
+	})
+}
+
+func (api API) update(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+
+	var details brokerapi.UpdateDetails
+	if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	async, _ := strconv.ParseBool(req.URL.Query().Get("accepts_incomplete"))
+
+	isAsync, err := api.broker.update(instance, details, async, originatingIdentity(req))
+	if err != nil {
+		api.fail(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if isAsync {
+		status = http.StatusAccepted
+	}
+	api.respond(w, status, brokerapi.EmptyResponse{})
+}
+
+func (api API) deprovision(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+
+	details := brokerapi.DeprovisionDetails{
+		PlanID:    req.FormValue("plan_id"),
+		ServiceID: req.FormValue("service_id"),
+	}
+	async := req.FormValue("accepts_incomplete") == "true"
+
+	isAsync, err := api.broker.deprovision(instance, details, async, originatingIdentity(req))
+	if err != nil {
+		api.fail(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if isAsync {
+		status = http.StatusAccepted
+	}
+	api.respond(w, status, brokerapi.EmptyResponse{})
+}
+
+func (api API) bind(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+	binding := mux.Vars(req)["binding_id"]
+
+	var details brokerapi.BindDetails
+	if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
+		api.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	async, _ := strconv.ParseBool(req.URL.Query().Get("accepts_incomplete"))
+
+	spec, err := api.broker.bind(instance, Binding{
+		ID:          binding,
+		RequestedBy: originatingIdentity(req),
+	}, details, async)
+	if err != nil {
+		switch err {
+		case brokerapi.ErrInstanceDoesNotExist:
+			api.respond(w, http.StatusNotFound, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+		case brokerapi.ErrBindingAlreadyExists:
+			api.respond(w, http.StatusConflict, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+		default:
+			api.fail(w, err)
+		}
+		return
+	}
+
+	switch {
+	case spec.IsAsync:
+		api.respond(w, http.StatusAccepted, asyncResponse{Operation: "bind"})
+	case spec.Existed:
+		api.respond(w, http.StatusOK, spec.Binding)
+	default:
+		api.respond(w, http.StatusCreated, spec.Binding)
+	}
+}
+
+func (api API) unbind(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+	binding := mux.Vars(req)["binding_id"]
+
+	details := brokerapi.UnbindDetails{
+		PlanID:    req.FormValue("plan_id"),
+		ServiceID: req.FormValue("service_id"),
+	}
+
+	async := req.FormValue("accepts_incomplete") == "true"
+
+	isAsync, err := api.broker.unbind(instance, binding, details, async, originatingIdentity(req))
+	if err != nil {
+		if err == brokerapi.ErrBindingDoesNotExist {
+			api.respond(w, http.StatusGone, brokerapi.EmptyResponse{})
+			return
+		}
+		api.fail(w, err)
+		return
+	}
+
+	if isAsync {
+		api.respond(w, http.StatusAccepted, asyncResponse{Operation: "unbind"})
+		return
+	}
+	api.respond(w, http.StatusOK, brokerapi.EmptyResponse{})
+}
+
+func (api API) lastBindingOperation(w http.ResponseWriter, req *http.Request) {
+	instance := mux.Vars(req)["instance_id"]
+	binding := mux.Vars(req)["binding_id"]
+
+	op, err := api.broker.LastBindingOperation(instance, binding)
+	if err != nil {
+		if err == brokerapi.ErrBindingDoesNotExist {
+			/* a finished unbind leaves nothing behind to report on */
+			api.respond(w, http.StatusGone, brokerapi.EmptyResponse{})
+			return
+		}
+		api.fail(w, err)
+		return
+	}
+
+	api.respond(w, http.StatusOK, lastOperationResponse{
+		State:       op.State,
+		Description: op.Description,
+	})
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-golang/lager"
+)
+
+func TestAPIProvisionTooManyJobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	broker := &Broker{db: db, jobs: make(chan struct{}, 1)}
+	broker.Service.ID = "service-id"
+	broker.Plans = []Plan{{ID: "plan-id", Name: "shared"}}
+	broker.jobs <- struct{}{}
+	expectNoInstance(mock)
+	expectEvent(mock, "provision", outcomeFailed)
+
+	router := mux.NewRouter()
+	AttachRoutes(router, broker, lager.NewLogger("test"))
+
+	req := httptest.NewRequest("PUT", "/v2/service_instances/instance-"+random(8)+"?accepts_incomplete=true",
+		strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf(`expected a Retry-After header`)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOriginatingIdentity(t *testing.T) {
+	testCases := map[string]struct {
+		header   string
+		expected string
+	}{
+		"cloud foundry user": {
+			header:   "cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}`)),
+			expected: "cloudfoundry:683ea748-3092-4ff4-b656-39cacc4d5360",
+		},
+		"kubernetes user": {
+			header:   "kubernetes " + base64.StdEncoding.EncodeToString([]byte(`{"username":"duke","uid":"c2dde242-5ce4-11e7-988c-000c2946f14f"}`)),
+			expected: "kubernetes:duke",
+		},
+		"missing header": {
+			header:   "",
+			expected: "",
+		},
+		"malformed base64": {
+			header:   "cloudfoundry not-base64!",
+			expected: "",
+		},
+		"malformed json": {
+			header:   "cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`user_id`)),
+			expected: "",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/v2/service_instances/i1", nil)
+			req.Header.Set("X-Broker-API-Originating-Identity", test.header)
+			if id := originatingIdentity(req); id != test.expected {
+				t.Fatalf(`expected originatingIdentity = %q, got: %q`, test.expected, id)
+			}
+		})
+	}
+}
+
+func TestAPIBindRecordsPlatformContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachRoutes(router, &Broker{db: db}, lager.NewLogger("test"))
+
+	mockInstance, mockBindingId := "instance-"+random(8), "binding-"+random(8)
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
+		WithArgs(mockInstance).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "state", "populated", "shared_db"}).AddRow(mockDbName, "done", false, ""))
+	mock.ExpectExec(`CREATE USER`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`GRANT ` + mockDbName + ` TO`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO creds (binding, db, name, pass, app, requested_by, parameters, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")).
+		WithArgs(mockBindingId, mockDbName, UsernameArg(), PasswordArg(), "app-guid", "cloudfoundry:user-guid", `{"role":"readonly"}`, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).
+		WithArgs("bind", mockInstance, mockBindingId, "plan-id", "cloudfoundry:user-guid", outcomeSucceeded, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+mockInstance+"/service_bindings/"+mockBindingId,
+		strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id","bind_resource":{"app_guid":"app-guid"},"parameters":{"role":"readonly"}}`))
+	req.Header.Set("X-Broker-API-Originating-Identity", "cloudfoundry "+base64.StdEncoding.EncodeToString([]byte(`{"user_id":"user-guid"}`)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIProvisionIsIdempotent(t *testing.T) {
+	testCases := map[string]struct {
+		state    string
+		plan     string
+		params   string
+		sync     bool
+		expected int
+	}{
+		"already provisioned":  {state: "done", plan: "plan-id", expected: http.StatusOK},
+		"synchronously":        {state: "done", plan: "plan-id", sync: true, expected: http.StatusOK},
+		"still provisioning":   {state: "setup", plan: "plan-id", expected: http.StatusAccepted},
+		"still, synchronously": {state: "setup", plan: "plan-id", sync: true, expected: http.StatusUnprocessableEntity},
+		"different plan":       {state: "done", plan: "other-plan-id", expected: http.StatusConflict},
+		"different parameters": {state: "done", plan: "plan-id", params: `{"extensions":["pgcrypto"]}`, expected: http.StatusConflict},
+		"failed":               {state: "failed", plan: "plan-id", expected: http.StatusConflict},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			broker := &Broker{db: db, jobs: make(chan struct{}, 1)}
+			broker.Service.ID = "service-id"
+			broker.Plans = []Plan{{ID: "plan-id", Name: "shared"}}
+
+			mockInstance := "instance-" + random(8)
+			mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+				WithArgs(mockInstance).
+				WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+					AddRow(mockInstance, mockDbName, test.state, test.plan, "", "org-id", "space-id", "", time.Now(), "", "", "", test.params, "{}", "null", "", "", "", nil, ""))
+			mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+			router := mux.NewRouter()
+			AttachRoutes(router, broker, lager.NewLogger("test"))
+
+			req := httptest.NewRequest("PUT", fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=%t", mockInstance, !test.sync),
+				strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id","organization_guid":"org-id","space_guid":"space-id"}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.expected {
+				t.Fatalf(`expected status %d, got: %d (%s)`, test.expected, w.Code, w.Body.String())
+			}
+			if len(broker.jobs) != 0 {
+				t.Fatalf(`expected a repeated provision not to start a new job`)
+			}
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPIProvisionClaimsInstance(t *testing.T) {
+	testCases := map[string]struct {
+		sync     bool
+		claimed  bool
+		winner   string
+		expected int
+	}{
+		"claimed":          {claimed: true, expected: http.StatusAccepted},
+		"synchronously":    {sync: true, expected: http.StatusUnprocessableEntity},
+		"lost to the same": {winner: "plan-id", expected: http.StatusOK},
+		"lost to another":  {winner: "other-plan-id", expected: http.StatusConflict},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			broker := &Broker{db: db, jobs: make(chan struct{}, 1)}
+			broker.Service.ID = "service-id"
+			broker.Plans = []Plan{{ID: "plan-id", Name: "shared"}}
+			/* a claimed instance is set up alongside the response */
+			mock.MatchExpectationsInOrder(!test.claimed)
+
+			expectNoInstance(mock)
+			if !test.sync {
+				claimed := int64(0)
+				if test.claimed {
+					claimed = 1
+				}
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM dbs WHERE instance = $1 AND state = 'gone'`)).
+					WithArgs("instance-1").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)+`.* ON CONFLICT \(instance\) DO NOTHING`).
+					WithArgs("instance-1", sqlmock.AnyArg(), 0, "plan-id", "", "", "", "", sqlmock.AnyArg(), nil, []byte("{}"), []byte("null")).
+					WillReturnResult(sqlmock.NewResult(0, claimed))
+				if test.claimed {
+					mock.ExpectCommit()
+				} else {
+					mock.ExpectRollback()
+				}
+			}
+			if test.winner != "" {
+				mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+					WithArgs("instance-1").
+					WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+						AddRow("instance-1", mockDbName, "done", test.winner, "", "", "", "", time.Now(), "", "", "", "", "{}", "null", "", "", "", nil, ""))
+			}
+			if test.claimed {
+				expectEvent(mock, "provision", outcomeAccepted)
+				/* Setup takes it from here, and fails as soon as it starts */
+				mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`) + `.* ON CONFLICT \(instance\) DO UPDATE`).
+					WillReturnError(fmt.Errorf("connection refused"))
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'failed'::state`)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectEvent(mock, "provision", outcomeFailed)
+			} else {
+				mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			router := mux.NewRouter()
+			AttachRoutes(router, broker, lager.NewLogger("test"))
+
+			req := httptest.NewRequest("PUT", fmt.Sprintf("/v2/service_instances/instance-1?accepts_incomplete=%t", !test.sync),
+				strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id"}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.expected {
+				t.Fatalf(`expected status %d, got: %d (%s)`, test.expected, w.Code, w.Body.String())
+			}
+			waitForJobs(t, broker)
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPIBindIsIdempotent(t *testing.T) {
+	testCases := map[string]struct {
+		instance string
+		app      string
+		expected int
+	}{
+		"same binding":   {instance: "instance-1", app: "app-guid", expected: http.StatusOK},
+		"different app":  {instance: "instance-1", app: "other-app-guid", expected: http.StatusConflict},
+		"other instance": {instance: "instance-2", app: "app-guid", expected: http.StatusConflict},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			router := mux.NewRouter()
+			AttachRoutes(router, &Broker{db: db, Host: "db.example.com", Port: "5432"}, lager.NewLogger("test"))
+
+			mock.ExpectQuery(`FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = \$1`).
+				WithArgs("binding-1").
+				WillReturnRows(sqlmock.NewRows(bindingRowColumns).
+					AddRow("binding-1", test.instance, "u1", "p4ssw0rd", mockDbName, test.app, "", "done", "", "", "", ""))
+			mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+			req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1",
+				strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id","bind_resource":{"app_guid":"app-guid"}}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.expected {
+				t.Fatalf(`expected status %d, got: %d (%s)`, test.expected, w.Code, w.Body.String())
+			}
+			if test.expected == http.StatusOK && !strings.Contains(w.Body.String(), `"password":"p4ssw0rd"`) {
+				t.Fatalf(`expected the original credentials, got: %s`, w.Body.String())
+			}
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPICatalogAdvertisesRetrievability(t *testing.T) {
+	broker := &Broker{Plans: []Plan{{ID: "plan-id", Name: "shared"}}}
+	broker.Service.ID = "service-id"
+
+	router := mux.NewRouter()
+	AttachRoutes(router, broker, lager.NewLogger("test"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/catalog", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusOK, w.Code)
+	}
+	for _, field := range []string{`"id":"service-id"`, `"instances_retrievable":true`, `"bindings_retrievable":true`} {
+		if !strings.Contains(w.Body.String(), field) {
+			t.Fatalf(`expected catalog to contain %s, got: %s`, field, w.Body.String())
+		}
+	}
+}
+
+func TestAPIFetchInstance(t *testing.T) {
+	testCases := map[string]struct {
+		state    string
+		expected int
+		body     string
+	}{
+		"provisioned": {state: "done", expected: http.StatusOK,
+			body: `{"service_id":"service-id","plan_id":"plan-id","parameters":{"size":"10G"}}`},
+		"suspended": {state: "suspended", expected: http.StatusOK,
+			body: `{"service_id":"service-id","plan_id":"plan-id","parameters":{"size":"10G"},"description":"The database has been suspended.  Please contact your operator."}`},
+		"still provisioning": {state: "setup", expected: http.StatusNotFound},
+		"deprovisioned":      {state: "gone", expected: http.StatusNotFound},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			broker := &Broker{db: db}
+			broker.Service.ID = "service-id"
+
+			mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+				WithArgs("instance-1").
+				WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+					AddRow("instance-1", mockDbName, test.state, "plan-id", "", "org-id", "space-id", "", time.Now(), "", "", "", `{"size":"10G"}`, "{}", "null", "", "", "", nil, ""))
+
+			router := mux.NewRouter()
+			AttachRoutes(router, broker, lager.NewLogger("test"))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/instance-1", nil))
+
+			if w.Code != test.expected {
+				t.Fatalf(`expected status %d, got: %d (%s)`, test.expected, w.Code, w.Body.String())
+			}
+			if test.expected == http.StatusOK && strings.TrimSpace(w.Body.String()) != test.body {
+				t.Fatalf(`unexpected instance: %s`, w.Body.String())
+			}
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPIFetchBinding(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachRoutes(router, &Broker{db: db, Host: "db.example.com", Port: "5432"}, lager.NewLogger("test"))
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(`FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = \$1`).
+			WithArgs("binding-1").
+			WillReturnRows(sqlmock.NewRows(bindingRowColumns).
+				AddRow("binding-1", "instance-1", "u1", "p4ssw0rd", mockDbName, "app-guid", `{"role":"readonly"}`, "done", "", "", "", ""))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/instance-1/service_bindings/binding-1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusOK, w.Code, w.Body.String())
+	}
+	for _, field := range []string{`"password":"p4ssw0rd"`, `"username":"u1"`, `"parameters":{"role":"readonly"}`} {
+		if !strings.Contains(w.Body.String(), field) {
+			t.Fatalf(`expected binding to contain %s, got: %s`, field, w.Body.String())
+		}
+	}
+
+	/* bindings can only be fetched through the instance they belong to */
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/instance-2/service_bindings/binding-1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusNotFound, w.Code, w.Body.String())
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
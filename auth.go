@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultBrokerUsername string = "b-postgres"
+	defaultBrokerPassword string = "postgres"
+)
+
+type Credential struct {
+	Username string
+	Hash     []byte
+}
+
+type Credentials []Credential
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+func newCredential(username, password string) (Credential, error) {
+	if username == "" {
+		return Credential{}, fmt.Errorf("missing username")
+	}
+	if password == "" {
+		return Credential{}, fmt.Errorf("missing password for '%s'", username)
+	}
+
+	if isBcryptHash(password) {
+		if _, err := bcrypt.Cost([]byte(password)); err != nil {
+			return Credential{}, fmt.Errorf("invalid bcrypt hash for '%s': %w", username, err)
+		}
+		return Credential{Username: username, Hash: []byte(password)}, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Credential{}, fmt.Errorf("unable to hash password for '%s': %w", username, err)
+	}
+	return Credential{Username: username, Hash: hash}, nil
+}
+
+// parseCredentials takes a comma- or whitespace-separated list of
+// `username:password` pairs, where password is (ideally) a bcrypt hash.
+// The same username may appear more than once, which lets operators
+// roll out a new password before retiring the old one.
+func parseCredentials(s string) (Credentials, error) {
+	var creds Credentials
+	for _, pair := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		l := strings.SplitN(pair, ":", 2)
+		if len(l) != 2 {
+			return nil, fmt.Errorf("malformed credential '%s' (expected username:password)", l[0])
+		}
+		cred, err := newCredential(l[0], l[1])
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+func brokerCredentials() (Credentials, error) {
+	var (
+		creds Credentials
+		err   error
+	)
+
+	if s := os.Getenv("SB_BROKER_CREDENTIALS"); s != "" {
+		creds, err = parseCredentials(s)
+		if err != nil {
+			return nil, fmt.Errorf("SB_BROKER_CREDENTIALS: %w", err)
+		}
+	} else {
+		cred, err := newCredential(cfg(defaultBrokerUsername, "SB_BROKER_USERNAME"), cfg(defaultBrokerPassword, "SB_BROKER_PASSWORD"))
+		if err != nil {
+			return nil, fmt.Errorf("SB_BROKER_PASSWORD: %w", err)
+		}
+		creds = Credentials{cred}
+	}
+
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("no broker credentials configured")
+	}
+
+	if creds.Insecure() {
+		if !devMode() {
+			return nil, fmt.Errorf("refusing to start with the default broker password; set SB_BROKER_CREDENTIALS (or SB_BROKER_PASSWORD), or set SB_DEV_MODE=true to override")
+		}
+		oops("WARNING: running with the default broker password (SB_DEV_MODE is set)\n")
+	}
+
+	return creds, nil
+}
+
+func devMode() bool {
+	return cfg("false", "SB_DEV_MODE") == "true"
+}
+
+func (cc Credentials) Insecure() bool {
+	for _, c := range cc {
+		if bcrypt.CompareHashAndPassword(c.Hash, []byte(defaultBrokerPassword)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc Credentials) Authenticate(username, password string) bool {
+	for _, c := range cc {
+		if c.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword(c.Hash, []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type Auth struct {
+	Credentials Credentials
+	Lockout     *Lockout
+	Proxies     []*net.IPNet
+}
+
+func (a Auth) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		/* failures count against the username and the address they
+		   came from together, so that somebody guessing at one
+		   account can't lock everyone behind the same proxy out */
+		ip := clientIP(r, a.Proxies)
+		username, password, ok := r.BasicAuth()
+		who := username + "@" + ip
+		if wait, locked := a.Lockout.Locked(who, time.Now()); locked {
+			tooManyRequests(w, wait, "too many failed authentication attempts; please try again later")
+			return
+		}
+
+		if !ok || !a.Credentials.Authenticate(username, password) {
+			if ok {
+				oops("failed authentication attempt as '%s' from %s\n", username, ip)
+				a.Lockout.Fail(who, time.Now())
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="postgres-tinsmith"`)
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		a.Lockout.Reset(who)
+
+		handler.ServeHTTP(w, r)
+	})
+}
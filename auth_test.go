@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unable to hash password: %s", err)
+	}
+	return string(hash)
+}
+
+func TestParseCredentials(t *testing.T) {
+	cfOne, cfTwo := hashPassword(t, "one-secret"), hashPassword(t, "two-secret")
+
+	creds, err := parseCredentials("cf-one:" + cfOne + ", cf-two:" + cfTwo + "\ncf-two:plaintext")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if len(creds) != 3 {
+		t.Fatalf(`expected 3 credentials, got: %d`, len(creds))
+	}
+
+	testCases := map[string]struct {
+		username string
+		password string
+		expected bool
+	}{
+		"first credential": {
+			username: "cf-one",
+			password: "one-secret",
+			expected: true,
+		},
+		"second credential": {
+			username: "cf-two",
+			password: "two-secret",
+			expected: true,
+		},
+		"rotated plaintext credential": {
+			username: "cf-two",
+			password: "plaintext",
+			expected: true,
+		},
+		"password for another user": {
+			username: "cf-one",
+			password: "two-secret",
+			expected: false,
+		},
+		"unknown user": {
+			username: "cf-three",
+			password: "one-secret",
+			expected: false,
+		},
+		"hash used as password": {
+			username: "cf-one",
+			password: cfOne,
+			expected: false,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if ok := creds.Authenticate(test.username, test.password); ok != test.expected {
+				t.Fatalf(`expected Authenticate(%q, %q) = %v, got: %v`, test.username, test.password, test.expected, ok)
+			}
+		})
+	}
+}
+
+func TestParseCredentialsMalformed(t *testing.T) {
+	for _, s := range []string{"just-a-username", "user:", ":password", "user:$2a$10$not-a-real-hash"} {
+		if _, err := parseCredentials(s); err == nil {
+			t.Fatalf(`expected parseCredentials(%q) to fail`, s)
+		}
+	}
+}
+
+func TestBrokerCredentialsRefusesDefaultPassword(t *testing.T) {
+	os.Unsetenv("SB_BROKER_CREDENTIALS")
+	os.Unsetenv("SB_BROKER_PASSWORD")
+	os.Unsetenv("SB_DEV_MODE")
+
+	if _, err := brokerCredentials(); err == nil {
+		t.Fatalf(`expected default password to be refused`)
+	}
+
+	os.Setenv("SB_BROKER_CREDENTIALS", "cf-one:"+hashPassword(t, defaultBrokerPassword))
+	if _, err := brokerCredentials(); err == nil {
+		t.Fatalf(`expected hashed default password to be refused`)
+	}
+	os.Unsetenv("SB_BROKER_CREDENTIALS")
+
+	os.Setenv("SB_DEV_MODE", "true")
+	creds, err := brokerCredentials()
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if !creds.Authenticate(defaultBrokerUsername, defaultBrokerPassword) {
+		t.Fatalf(`expected default credentials to authenticate in dev mode`)
+	}
+	os.Unsetenv("SB_DEV_MODE")
+
+	os.Setenv("SB_BROKER_PASSWORD", "a-secret")
+	creds, err = brokerCredentials()
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if !creds.Authenticate(defaultBrokerUsername, "a-secret") {
+		t.Fatalf(`expected SB_BROKER_PASSWORD to authenticate`)
+	}
+	os.Unsetenv("SB_BROKER_PASSWORD")
+}
+
+func TestAuthWrap(t *testing.T) {
+	creds, err := parseCredentials("cf-one:" + hashPassword(t, "one-secret") + ",cf-two:" + hashPassword(t, "two-secret"))
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	auth := Auth{
+		Credentials: creds,
+		Lockout:     NewLockout(3, time.Minute),
+	}
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	testCases := []struct {
+		remote   string
+		username string
+		password string
+		expected int
+	}{
+		{remote: "10.0.0.1:1234", username: "cf-one", password: "one-secret", expected: http.StatusTeapot},
+		{remote: "10.0.0.1:1234", expected: http.StatusUnauthorized},
+		{remote: "10.0.0.2:1234", username: "cf-one", password: "wrong", expected: http.StatusUnauthorized},
+		{remote: "10.0.0.2:1234", username: "cf-one", password: "wrong", expected: http.StatusUnauthorized},
+		{remote: "10.0.0.2:1234", username: "cf-one", password: "wrong", expected: http.StatusUnauthorized},
+		/* 10.0.0.2 is now locked out, even with the right password */
+		{remote: "10.0.0.2:1234", username: "cf-one", password: "one-secret", expected: http.StatusTooManyRequests},
+		{remote: "10.0.0.1:1234", username: "cf-one", password: "one-secret", expected: http.StatusTeapot},
+		/* but only as cf-one; other users behind the same address aren't */
+		{remote: "10.0.0.2:1234", username: "cf-two", password: "two-secret", expected: http.StatusTeapot},
+	}
+
+	for i, test := range testCases {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		req.RemoteAddr = test.remote
+		if test.username != "" {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Fatalf(`request #%d: expected status %d, got: %d`, i, test.expected, w.Code)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Fatalf(`request #%d: expected a Retry-After header`, i)
+		}
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var ErrBackupsDisabled = errors.New("backups are not enabled on this broker")
+var ErrNotBackupable = errors.New("only ready instances with a database of their own can be backed up or restored")
+var ErrNoBackup = errors.New("no such backup")
+var ErrBackupNotReady = errors.New("only finished backups can be restored")
+
+/* how many of each instance's backups are kept, unless its plan says */
+const defaultBackupsKept = 7
+
+/* how long backups of a deleted instance are kept, unless its plan says */
+const defaultDeletedBackupsKept = 30 * 24 * time.Hour
+
+// BackupPolicy is how often a plan's instances are backed up, how many
+// of their backups are kept, and for how long once they're deleted.
+type BackupPolicy struct {
+	Every       string `json:"every"`
+	Keep        int    `json:"keep"`
+	KeepDeleted string `json:"keep_deleted"`
+	every       time.Duration
+	keepDeleted time.Duration
+}
+
+// Backup is one logical backup of an instance database: the plain SQL
+// output of pg_dump, gzipped, in the backup bucket.
+type Backup struct {
+	ID           string     `json:"id"`
+	Instance     string     `json:"instance"`
+	Database     string     `json:"database"`
+	Plan         string     `json:"plan"`
+	Organization string     `json:"organization"`
+	Space        string     `json:"space"`
+	Object       string     `json:"object"`
+	State        string     `json:"state"`
+	Size         int64      `json:"size"`
+	RequestedBy  string     `json:"requested_by,omitempty"`
+	Started      time.Time  `json:"started"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func (p *Plan) validateBackups() error {
+	if p.Backups.Keep < 0 {
+		return fmt.Errorf("plan '%s' has to keep at least one backup", p.Name)
+	}
+	if p.Backups.Keep == 0 {
+		p.Backups.Keep = defaultBackupsKept
+	}
+	p.Backups.keepDeleted = defaultDeletedBackupsKept
+	if p.Backups.KeepDeleted != "" {
+		d, err := time.ParseDuration(p.Backups.KeepDeleted)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("plan '%s' has an invalid keep_deleted '%s' (try i.e. 720h)", p.Name, p.Backups.KeepDeleted)
+		}
+		p.Backups.keepDeleted = d
+	}
+	if p.Backups.Every == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(p.Backups.Every)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("plan '%s' has an invalid backup schedule '%s' (try i.e. 24h)", p.Name, p.Backups.Every)
+	}
+	if p.Mode == "schema" {
+		return fmt.Errorf("plan '%s' gives each instance a schema, so its instances cannot be backed up", p.Name)
+	}
+	p.Backups.every = d
+	return nil
+}
+
+func (b *Broker) createBackupSchemas() {
+	b.db.Exec(`
+CREATE TABLE IF NOT EXISTS
+backups (
+  id           TEXT NOT NULL PRIMARY KEY,
+  instance     TEXT NOT NULL,
+  db           TEXT NOT NULL,
+  plan         TEXT,
+  org          TEXT,
+  space        TEXT,
+  object       TEXT NOT NULL,
+  state        TEXT NOT NULL DEFAULT 'running',
+  size         BIGINT NOT NULL DEFAULT 0,
+  requested_by TEXT,
+  started      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  finished     TIMESTAMP WITH TIME ZONE,
+  error        TEXT
+)`)
+	b.db.Exec(`CREATE INDEX IF NOT EXISTS backups_instance_idx ON backups (instance, started)`)
+}
+
+const backupColumns string = `
+id, instance, db, COALESCE(plan, ''), COALESCE(org, ''), COALESCE(space, ''), object, state, size,
+COALESCE(requested_by, ''), started, finished, COALESCE(error, '')`
+
+func scanBackup(r *sql.Rows) (Backup, error) {
+	var (
+		bk       Backup
+		finished sql.NullTime
+	)
+	err := r.Scan(&bk.ID, &bk.Instance, &bk.Database, &bk.Plan, &bk.Organization, &bk.Space, &bk.Object, &bk.State, &bk.Size,
+		&bk.RequestedBy, &bk.Started, &finished, &bk.Error)
+	if err != nil {
+		return bk, err
+	}
+	if finished.Valid {
+		bk.Finished = &finished.Time
+	}
+	return bk, nil
+}
+
+func (b *Broker) backups(where string, args ...interface{}) ([]Backup, error) {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `SELECT `+backupColumns+` FROM backups WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Backup, 0)
+	for r.Next() {
+		bk, err := scanBackup(r)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, bk)
+	}
+	return l, r.Err()
+}
+
+// Backups lists an instance's backups, most recent first.
+func (b *Broker) Backups(instance string) ([]Backup, error) {
+	return b.backups(`instance = $1 ORDER BY started DESC`, instance)
+}
+
+// GetBackup looks up a single backup, returning nil if there isn't one.
+func (b *Broker) GetBackup(id string) (*Backup, error) {
+	l, err := b.backups(`id = $1`, id)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	return &l[0], nil
+}
+
+// StartBackup backs an instance up, in the background.
+func (b *Broker) StartBackup(instance, identity string) (Backup, error) {
+	bk := Backup{Instance: instance, State: "running", RequestedBy: identity}
+	if b.Store == nil {
+		return bk, ErrBackupsDisabled
+	}
+
+	inst, err := b.GetInstance(instance)
+	if err != nil {
+		return bk, err
+	}
+	if inst == nil || inst.State == "gone" {
+		return bk, brokerapi.ErrInstanceDoesNotExist
+	}
+	if inst.State != "done" || inst.SharedDatabase != "" {
+		return bk, ErrNotBackupable
+	}
+
+	if !b.startJob() {
+		return bk, ErrTooManyJobs
+	}
+	bk.ID = random(24)
+	bk.Database = inst.Database
+	bk.Plan = inst.Plan
+	bk.Organization = inst.Organization
+	bk.Space = inst.Space
+	bk.Started = time.Now().UTC().Truncate(time.Second)
+	bk.Object = instance + "/" + bk.Started.Format("20060102T150405Z") + "-" + bk.ID + ".sql.gz"
+
+	if _, err := b.exec(context.Background(), `INSERT INTO backups (id, instance, db, plan, org, space, object, state, requested_by, started)
+     VALUES ($1, $2, $3, $4, $5, $6, $7, 'running', $8, $9)`,
+		bk.ID, bk.Instance, bk.Database, bk.Plan, bk.Organization, bk.Space, bk.Object, bk.RequestedBy, bk.Started); err != nil {
+		b.finishJob()
+		return bk, err
+	}
+
+	info("backing up instance %s to %s\n", instance, b.Store.key(bk.Object))
+	go func() {
+		defer b.finishJob()
+		b.runBackup(bk)
+	}()
+	return bk, nil
+}
+
+func (b *Broker) runBackup(bk Backup) {
+	ctx, cancel := operation(b.BackupTimeout)
+	defer cancel()
+
+	size, err := b.dump(ctx, bk.Database, bk.Object)
+	if err != nil {
+		oops("failed to back up instance %s: %s\n", bk.Instance, err)
+		bk.State, bk.Error = "failed", err.Error()
+		b.exec(context.Background(), `UPDATE backups SET state = 'failed', finished = now(), error = $2 WHERE id = $1`, bk.ID, bk.Error)
+	} else {
+		info("backed up instance %s (%d bytes)\n", bk.Instance, size)
+		bk.State, bk.Size = "done", size
+		if _, err = b.exec(ctx, `UPDATE backups SET state = 'done', finished = now(), size = $2 WHERE id = $1`, bk.ID, size); err != nil {
+			oops("failed to record the backup of instance %s: %s\n", bk.Instance, err)
+		}
+	}
+	now := time.Now()
+	bk.Finished = &now
+
+	b.record(Event{
+		Operation: "backup",
+		Instance:  bk.Instance,
+		Plan:      bk.Plan,
+		Identity:  bk.RequestedBy,
+		Outcome:   outcome(err, outcomeSucceeded),
+		Error:     errorString(err),
+	})
+	if err != nil {
+		b.notify("backup.failed", bk)
+		return
+	}
+	b.notify("backup.created", bk)
+	b.pruneBackups(ctx, bk.Instance, bk.Plan)
+}
+
+// dump streams pg_dump's output for a database, gzipped, into the
+// backup bucket.  If pg_dump fails, so does the upload, so that a
+// truncated dump is never mistaken for a backup.
+func (b *Broker) dump(ctx context.Context, db, key string) (int64, error) {
+	cmd := exec.CommandContext(ctx, b.PgDump, "--no-owner", "--no-privileges", "--dbname", db)
+	cmd.Env = b.clientEnv()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		z := gzip.NewWriter(w)
+		_, err := io.Copy(z, out)
+		if err == nil {
+			err = z.Close()
+		} else {
+			/* nobody is listening any more */
+			cmd.Process.Kill()
+		}
+		if werr := cmd.Wait(); err == nil && werr != nil {
+			err = clientError(werr, &stderr)
+		}
+		w.CloseWithError(err)
+		done <- err
+	}()
+
+	size, err := b.Store.Put(ctx, key, r)
+	r.Close()
+	if derr := <-done; derr != nil {
+		return 0, derr
+	}
+	return size, err
+}
+
+// load feeds a backup into a database, with psql, all or nothing.
+func (b *Broker) load(ctx context.Context, key, db string) error {
+	body, err := b.Store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	z, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("%s is not a backup: %w", b.Store.key(key), err)
+	}
+
+	cmd := exec.CommandContext(ctx, b.Psql, "--quiet", "--no-psqlrc", "--single-transaction", "--set", "ON_ERROR_STOP=1", "--dbname", db)
+	cmd.Env = b.clientEnv()
+	cmd.Stdin = z
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return clientError(err, &stderr)
+	}
+	return nil
+}
+
+// pruneBackups deletes all but the most recent of an instance's
+// backups, as many as its plan keeps.
+func (b *Broker) pruneBackups(ctx context.Context, instance, plan string) {
+	keep := defaultBackupsKept
+	if p, ok := b.plan(plan); ok && p.Backups.Keep > 0 {
+		keep = p.Backups.Keep
+	}
+
+	old, err := b.backups(`instance = $1 AND state = 'done' ORDER BY started DESC OFFSET $2`, instance, keep)
+	if err != nil {
+		oops("failed to check for old backups of instance %s: %s\n", instance, err)
+		return
+	}
+	for _, bk := range old {
+		if err := b.deleteBackup(ctx, bk); err != nil {
+			oops("failed to delete old backup %s of instance %s: %s\n", bk.ID, instance, err)
+			continue
+		}
+		info("deleted old backup %s of instance %s\n", bk.ID, instance)
+	}
+}
+
+// PruneDeletedBackups deletes the backups of instances that have been
+// deprovisioned, once they're older than their plan's keep_deleted;
+// with no more backups being taken, pruneBackups never gets to them.
+func (b *Broker) PruneDeletedBackups() {
+	if b.Store == nil {
+		return
+	}
+
+	orphaned, err := b.backups(`state <> 'running'
+   AND NOT EXISTS (SELECT 1 FROM dbs WHERE TRIM(dbs.instance) = backups.instance AND dbs.state <> 'gone')`)
+	if err != nil {
+		oops("failed to check for backups of deleted instances: %s\n", err)
+		return
+	}
+	now := time.Now()
+	for _, bk := range orphaned {
+		keep := defaultDeletedBackupsKept
+		if p, ok := b.plan(bk.Plan); ok && p.Backups.keepDeleted > 0 {
+			keep = p.Backups.keepDeleted
+		}
+		if now.Sub(bk.Started) < keep {
+			continue
+		}
+
+		ctx, cancel := operation(b.DeprovisionTimeout)
+		err := b.deleteBackup(ctx, bk)
+		cancel()
+		if err != nil {
+			oops("failed to delete backup %s of deleted instance %s: %s\n", bk.ID, bk.Instance, err)
+			continue
+		}
+		info("deleted backup %s of deleted instance %s\n", bk.ID, bk.Instance)
+	}
+}
+
+func (b *Broker) deleteBackup(ctx context.Context, bk Backup) error {
+	if err := b.Store.Delete(ctx, bk.Object); err != nil {
+		return err
+	}
+	_, err := b.exec(ctx, `DELETE FROM backups WHERE id = $1`, bk.ID)
+	return err
+}
+
+// DeleteBackup deletes a backup, from the bucket and the broker.
+func (b *Broker) DeleteBackup(id string) error {
+	if b.Store == nil {
+		return ErrBackupsDisabled
+	}
+	bk, err := b.GetBackup(id)
+	if err != nil {
+		return err
+	}
+	if bk == nil {
+		return ErrNoBackup
+	}
+	if bk.State == "running" {
+		return ErrConcurrentOperation
+	}
+	ctx, cancel := operation(b.DeprovisionTimeout)
+	defer cancel()
+	return b.deleteBackup(ctx, *bk)
+}
+
+// ScheduleBackups starts a backup of every instance whose plan wants
+// one, and that hasn't had one for that long.  A backup that failed is
+// tried again an hour later.
+func (b *Broker) ScheduleBackups() {
+	if b.Store == nil {
+		return
+	}
+
+	/* backups that were running when a previous incarnation of the
+	   broker went away will never finish */
+	if b.BackupTimeout > 0 {
+		if _, err := b.exec(context.Background(), `UPDATE backups SET state = 'failed', finished = now(), error = 'timed out'
+ WHERE state = 'running' AND started < $1`, time.Now().Add(-b.BackupTimeout)); err != nil {
+			oops("failed to expire stuck backups: %s\n", err)
+		}
+	}
+
+	now := time.Now()
+	for _, p := range b.Plans {
+		if p.Backups.every == 0 {
+			continue
+		}
+		due, err := b.column(context.Background(), `SELECT TRIM(dbs.instance) FROM dbs
+ WHERE dbs.plan = $1 AND dbs.state = 'done' AND dbs.shared_db IS NULL
+   AND NOT EXISTS (SELECT 1 FROM backups WHERE backups.instance = TRIM(dbs.instance) AND backups.started > $2
+                      AND (backups.state <> 'failed' OR backups.started > $3))`,
+			p.ID, now.Add(-p.Backups.every), now.Add(-time.Hour))
+		if err != nil {
+			oops("failed to check for instances of plan %s due a backup: %s\n", p.Name, err)
+			continue
+		}
+		for _, instance := range due {
+			_, err := b.StartBackup(instance, "janitor")
+			if err == ErrTooManyJobs {
+				/* the rest will have to wait for the next run */
+				return
+			}
+			if err != nil {
+				oops("failed to start a scheduled backup of instance %s: %s\n", instance, err)
+			}
+		}
+	}
+}
+
+// backupSource looks up the backup that a developer wants a new
+// instance restored from: either a backup ID, or the ID of an instance
+// (maybe long gone) to take the latest backup of.  Like clones, it
+// has to come from the same org and space.
+func (b *Broker) backupSource(plan Plan, params ProvisionParameters, details brokerapi.ProvisionDetails) (*Backup, error) {
+	if b.Store == nil {
+		return nil, parameterError("backups are not enabled")
+	}
+	if plan.Mode == "schema" {
+		return nil, parameterError("this plan does not support restoring backups")
+	}
+	if params.CloneFrom != "" {
+		return nil, parameterError("an instance can be a clone, or restored from a backup, but not both")
+	}
+
+	bk, err := b.GetBackup(params.RestoreFrom)
+	if err == nil && bk == nil {
+		var l []Backup
+		l, err = b.backups(`instance = $1 AND state = 'done' ORDER BY started DESC LIMIT 1`, params.RestoreFrom)
+		if len(l) > 0 {
+			bk = &l[0]
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up backup %s: %w", params.RestoreFrom, err)
+	}
+	/* don't let on that backups in other spaces exist */
+	if bk == nil || details.OrganizationGUID == "" || bk.Organization != details.OrganizationGUID || bk.Space != details.SpaceGUID {
+		return nil, parameterError("there is no backup '%s' in this space to restore", params.RestoreFrom)
+	}
+	if bk.State != "done" {
+		return nil, parameterError("backup '%s' is in '%s' state, and cannot be restored", params.RestoreFrom, bk.State)
+	}
+	return bk, nil
+}
+
+// fromBackup creates a new instance database from a backup, returning
+// the step that failed, if any.  As with a clone by dump and restore,
+// a failed restore drops the new database, and one left behind by an
+// attempt that never got that far is started over.
+func (b *Broker) fromBackup(ctx context.Context, inst Instance) (string, error) {
+	bk, err := b.GetBackup(inst.Backup)
+	if err == nil && bk == nil {
+		err = fmt.Errorf("backup %s no longer exists", inst.Backup)
+	}
+	if err == nil && b.Store == nil {
+		err = ErrBackupsDisabled
+	}
+	if err != nil {
+		return "looking up the backup", err
+	}
+	if _, err := b.exec(ctx, `UPDATE dbs SET backup = $2 WHERE instance = $1`, inst.ID, bk.ID); err != nil {
+		return "recording the backup", err
+	}
+
+	if err := b.createAfresh(ctx, inst.Database, inst.Options.clause()); err != nil {
+		return "creating instance database", err
+	}
+	if err := b.load(ctx, bk.Object, inst.Database); err != nil {
+		b.execBackend(ctx, `DROP DATABASE `+inst.Database)
+		return "restoring the backup", err
+	}
+	return "", nil
+}
+
+// RestoreBackup replaces the database of an instance (the one that was
+// backed up, unless into says otherwise) with a backup, in the
+// background.  The instance is `restoring` until it's done, so that the
+// platform can poll it and nothing else can touch it in the meantime.
+// It returns the instance being restored.
+func (b *Broker) RestoreBackup(id, into, identity string) (string, error) {
+	if b.Store == nil {
+		return "", ErrBackupsDisabled
+	}
+	bk, err := b.GetBackup(id)
+	if err != nil {
+		return "", err
+	}
+	if bk == nil {
+		return "", ErrNoBackup
+	}
+	if bk.State != "done" {
+		return "", ErrBackupNotReady
+	}
+	if into == "" {
+		into = bk.Instance
+	}
+
+	inst, err := b.GetInstance(into)
+	if err != nil {
+		return into, err
+	}
+	if inst == nil || inst.State == "gone" {
+		return into, brokerapi.ErrInstanceDoesNotExist
+	}
+	switch {
+	case inst.State == "setup" || inst.State == "teardown" || inst.State == "restoring":
+		return into, ErrConcurrentOperation
+	case inst.SharedDatabase != "":
+		return into, ErrNotBackupable
+	case inst.State == "failed" && inst.Failure != nil && inst.Failure.Operation == "restore":
+		/* a restore that failed part way through can be tried again */
+	case inst.State != "done":
+		return into, ErrNotBackupable
+	}
+
+	if !b.startJob() {
+		return into, ErrTooManyJobs
+	}
+	ctx, cancel := operation(b.BackupTimeout)
+	/* claim the instance, unless something else got to it first */
+	r, err := b.exec(ctx, `
+UPDATE dbs SET state = 'restoring'::state, restoring = $2, started = now(), deadline = $3,
+               failed_operation = NULL, failed_step = NULL, failure = NULL
+ WHERE instance = $1 AND (state = 'done' OR (state = 'failed' AND failed_operation = 'restore'))`,
+		into, bk.ID, deadline(ctx))
+	if err == nil {
+		if n, _ := r.RowsAffected(); n == 0 {
+			err = ErrConcurrentOperation
+		}
+	}
+	if err != nil {
+		cancel()
+		b.finishJob()
+		return into, err
+	}
+
+	info("restoring backup %s of instance %s into instance %s\n", bk.ID, bk.Instance, into)
+	go func() {
+		defer b.finishJob()
+		defer cancel()
+
+		if step, err := b.replace(ctx, *bk, *inst); err != nil {
+			b.fail("restore", step, into, err)
+			return
+		}
+		if _, err := b.exec(ctx, `UPDATE dbs SET state = 'done'::state, restoring = NULL WHERE instance = $1 AND state = 'restoring'`, into); err != nil {
+			b.fail("restore", "finishing the restore", into, err)
+			return
+		}
+		b.record(Event{
+			Operation: "restore",
+			Instance:  into,
+			Plan:      inst.Plan,
+			Identity:  identity,
+			Outcome:   outcomeSucceeded,
+		})
+		info("restored backup %s into instance %s\n", bk.ID, into)
+		b.notify("backup.restored", struct {
+			Backup   Backup   `json:"backup"`
+			Instance Instance `json:"instance"`
+		}{*bk, *inst})
+	}()
+	return into, nil
+}
+
+// replace loads a backup into a new database alongside an instance's,
+// and only then swaps it in, so that a backup that can't be restored
+// leaves the instance as it was.  Sessions to the old database are
+// terminated, but the instance's bindings keep working.  It returns
+// the step that failed, if any; a restore that failed after moving the
+// old database aside can be run again, and will finish the swap.
+func (b *Broker) replace(ctx context.Context, bk Backup, inst Instance) (string, error) {
+	db := inst.Database
+	restoring, replaced := "restoring_"+db, "replaced_"+db
+
+	if _, err := b.execBackend(ctx, `DROP DATABASE IF EXISTS `+restoring); err != nil {
+		return "clearing out a previous restore", err
+	}
+	if _, err := b.execBackend(ctx, `CREATE DATABASE `+restoring+inst.Options.clause()); err != nil {
+		return "creating a database to restore into", err
+	}
+	if err := b.load(ctx, bk.Object, restoring); err != nil {
+		b.execBackend(ctx, `DROP DATABASE `+restoring)
+		return "restoring the backup", err
+	}
+
+	_, err := b.execBackend(ctx, `ALTER DATABASE `+db+` ALLOW_CONNECTIONS false`)
+	switch {
+	case isPqError(err, "3D000"):
+		/* a previous attempt already moved it aside, as replaced */
+	case err != nil:
+		return "stopping connections to the instance database", err
+	default:
+		if _, err := b.execBackend(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()`, db); err != nil {
+			b.execBackend(ctx, `ALTER DATABASE `+db+` ALLOW_CONNECTIONS true`)
+			return "terminating sessions to the instance database", err
+		}
+		/* left over from a restore that didn't manage to clean up after itself */
+		if _, err := b.execBackend(ctx, `DROP DATABASE IF EXISTS `+replaced); err != nil {
+			b.execBackend(ctx, `ALTER DATABASE `+db+` ALLOW_CONNECTIONS true`)
+			return "clearing out a previous restore", err
+		}
+		if _, err := b.execBackend(ctx, `ALTER DATABASE `+db+` RENAME TO `+replaced); err != nil {
+			b.execBackend(ctx, `ALTER DATABASE `+db+` ALLOW_CONNECTIONS true`)
+			return "moving the instance database aside", err
+		}
+	}
+	if _, err := b.execBackend(ctx, `ALTER DATABASE `+restoring+` RENAME TO `+db); err != nil {
+		return "swapping in the restored database", err
+	}
+
+	if step, err := b.isolate(ctx, db); err != nil {
+		return step, err
+	}
+	users, err := b.column(ctx, `SELECT creds.name FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1`, inst.ID)
+	if err != nil {
+		return "looking up the instance's users", err
+	}
+	for _, user := range users {
+		if err := b.grantExisting(ctx, db, user); err != nil {
+			return "granting " + user + " access to the restored database", err
+		}
+	}
+	if _, err := b.exec(ctx, `UPDATE dbs SET backup = $2 WHERE instance = $1`, inst.ID, bk.ID); err != nil {
+		return "recording the backup", err
+	}
+
+	if _, err := b.execBackend(ctx, `DROP DATABASE `+replaced); err != nil {
+		oops("unable to drop %s, which restoring backup %s replaced: %s\n", replaced, bk.ID, err)
+	}
+	return "", nil
+}
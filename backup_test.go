@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-golang/lager"
+)
+
+var backupRowColumns = []string{"id", "instance", "db", "plan", "org", "space", "object", "state", "size", "requested_by", "started", "finished", "error"}
+
+func expectBackup(mock sqlmock.Sqlmock, space string) {
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM backups WHERE id = $1`)).
+		WithArgs("backup-1").
+		WillReturnRows(sqlmock.NewRows(backupRowColumns).
+			AddRow("backup-1", "instance-1", mockDbName, "plan-id", "org-id", space, "instance-1/backup-1.sql.gz", "done", int64(64), "admin:admin", time.Now(), time.Now(), ""))
+}
+
+func gzipped(s string) []byte {
+	var b bytes.Buffer
+	z := gzip.NewWriter(&b)
+	z.Write([]byte(s))
+	z.Close()
+	return b.Bytes()
+}
+
+func TestRunBackup(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+	store, f, done := fakeStore(t)
+	defer done()
+	broker.Store = store
+	broker.PgDump = "echo"
+	f.objects["/backups/tinsmith/instance-1/backup-0.sql.gz"] = gzipped("old")
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE backups SET state = 'done'`)).
+		WithArgs("backup-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock, "backup", outcomeSucceeded)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM backups WHERE instance = $1 AND state = 'done' ORDER BY started DESC OFFSET $2`)).
+		WithArgs("instance-1", defaultBackupsKept).
+		WillReturnRows(sqlmock.NewRows(backupRowColumns).
+			AddRow("backup-0", "instance-1", mockDbName, "plan-id", "org-id", "space-id", "instance-1/backup-0.sql.gz", "done", int64(64), "janitor", time.Now(), time.Now(), ""))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM backups WHERE id = $1`)).
+		WithArgs("backup-0").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	broker.runBackup(Backup{ID: "backup-1", Instance: "instance-1", Database: mockDbName, Plan: "plan-id", Object: "instance-1/backup-1.sql.gz"})
+
+	obj, ok := f.objects["/backups/tinsmith/instance-1/backup-1.sql.gz"]
+	if !ok {
+		t.Fatalf(`expected the backup to be uploaded, got: %v`, f.objects)
+	}
+	z, err := gzip.NewReader(bytes.NewReader(obj))
+	if err != nil {
+		t.Fatalf(`expected a gzipped backup: %s`, err)
+	}
+	dump, _ := ioutil.ReadAll(z)
+	if string(dump) != "--no-owner --no-privileges --dbname "+mockDbName+"\n" {
+		t.Fatalf(`unexpected backup: %q`, dump)
+	}
+	if _, ok := f.objects["/backups/tinsmith/instance-1/backup-0.sql.gz"]; ok {
+		t.Fatalf(`expected the old backup to be pruned`)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRunBackupFails(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+	store, f, done := fakeStore(t)
+	defer done()
+	broker.Store = store
+	broker.PgDump = "false"
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE backups SET state = 'failed'`)).
+		WithArgs("backup-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock, "backup", outcomeFailed)
+
+	broker.runBackup(Backup{ID: "backup-1", Instance: "instance-1", Database: mockDbName, Plan: "plan-id", Object: "instance-1/backup-1.sql.gz"})
+
+	if len(f.objects) != 0 {
+		t.Fatalf(`expected a failed dump not to be uploaded, got: %v`, f.objects)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPruneDeletedBackups(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+	store, f, done := fakeStore(t)
+	defer done()
+	broker.Store = store
+	f.objects["/backups/tinsmith/instance-1/old.sql.gz"] = gzipped("CREATE TABLE t ();")
+	f.objects["/backups/tinsmith/instance-1/new.sql.gz"] = gzipped("CREATE TABLE t ();")
+
+	old := time.Now().Add(-defaultDeletedBackupsKept - time.Hour)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM backups WHERE state <> 'running'`)).
+		WillReturnRows(sqlmock.NewRows(backupRowColumns).
+			AddRow("old", "instance-1", mockDbName, "plan-id", "org-id", "space-id", "instance-1/old.sql.gz", "done", int64(64), "janitor", old, old, "").
+			AddRow("new", "instance-1", mockDbName, "plan-id", "org-id", "space-id", "instance-1/new.sql.gz", "done", int64(64), "janitor", time.Now(), time.Now(), ""))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM backups WHERE id = $1`)).
+		WithArgs("old").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	broker.PruneDeletedBackups()
+
+	if _, ok := f.objects["/backups/tinsmith/instance-1/old.sql.gz"]; ok {
+		t.Fatalf(`expected the old backup to be deleted from the bucket`)
+	}
+	if _, ok := f.objects["/backups/tinsmith/instance-1/new.sql.gz"]; !ok {
+		t.Fatalf(`expected the recent backup to be kept`)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetupRestoresBackup(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+	store, f, done := fakeStore(t)
+	defer done()
+	broker.Store = store
+	broker.Psql = "true"
+	f.objects["/backups/tinsmith/instance-1/backup-1.sql.gz"] = gzipped("CREATE TABLE t ();")
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectBackup(mock, "space-id")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET backup = $2 WHERE instance = $1`)).
+		WithArgs("instance-2", "backup-1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsolation(mock, tenant, mockDbName)
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'setup'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "provision", outcomeSucceeded)
+
+	broker.Setup(Instance{ID: "instance-2", Database: mockDbName, Plan: "plan-id", Backup: "backup-1"})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReplaceWithBackup(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+	store, f, done := fakeStore(t)
+	defer done()
+	broker.Store = store
+	broker.Psql = "true"
+	f.objects["/backups/tinsmith/instance-1/backup-1.sql.gz"] = gzipped("CREATE TABLE t ();")
+
+	mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE IF EXISTS restoring_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE restoring_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` ALLOW_CONNECTIONS false`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity`)).
+		WithArgs(mockDbName).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE IF EXISTS replaced_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` RENAME TO replaced_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE restoring_` + mockDbName + ` RENAME TO ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectIsolation(mock, tenant, mockDbName)
+	expectUsers(mock)
+	tenant.ExpectExec(`GRANT ALL ON SCHEMA %I TO u1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectExec(`GRANT ALL ON SCHEMA %I TO u2`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET backup = $2 WHERE instance = $1`)).
+		WithArgs("instance-1", "backup-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE replaced_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	bk := Backup{ID: "backup-1", Instance: "instance-1", Object: "instance-1/backup-1.sql.gz"}
+	if _, err := broker.replace(context.Background(), bk, Instance{ID: "instance-1", Database: mockDbName}); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	/* a backup that can't be restored leaves the instance alone */
+	broker.Psql = "false"
+	mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE IF EXISTS restoring_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE restoring_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE restoring_` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if step, err := broker.replace(context.Background(), bk, Instance{ID: "instance-1", Database: mockDbName}); err == nil || step != "restoring the backup" {
+		t.Fatalf(`expected a failed restore to fail while restoring the backup, got %q: %v`, step, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIUpdateRestoresBackup(t *testing.T) {
+	testCases := map[string]struct {
+		async    bool
+		claimed  bool
+		expected int
+	}{
+		"accepted":     {async: true, claimed: true, expected: http.StatusAccepted},
+		"synchronous":  {expected: http.StatusUnprocessableEntity},
+		"already busy": {async: true, expected: http.StatusUnprocessableEntity},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			broker, mock, _ := tenantBroker(t)
+			defer broker.db.Close()
+			broker.Store = &ObjectStore{}
+			broker.jobs = make(chan struct{}, 1)
+			/* the restore runs alongside the response */
+			mock.MatchExpectationsInOrder(false)
+
+			expectInstance(mock, "done", "")
+			if test.async {
+				expectBackup(mock, "space-id")
+				expectBackup(mock, "space-id")
+				expectInstance(mock, "done", "")
+				claimed := int64(0)
+				if test.claimed {
+					claimed = 1
+				}
+				mock.ExpectExec(`UPDATE dbs SET state = 'restoring'::state, restoring = \$2, started = now\(\), deadline = \$3, .* WHERE instance = \$1 AND \(state = 'done' OR \(state = 'failed' AND failed_operation = 'restore'\)\)`).
+					WithArgs("instance-1", "backup-1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, claimed))
+			}
+			if test.claimed {
+				expectEvent(mock, "update", outcomeAccepted)
+				mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE IF EXISTS restoring_` + mockDbName)).
+					WillReturnError(fmt.Errorf("out of disk"))
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'failed'::state, failed_operation = $2, failed_step = $3, failure = $4 WHERE instance = $1`)).
+					WithArgs("instance-1", "restore", "clearing out a previous restore", "out of disk").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectEvent(mock, "restore", outcomeFailed)
+			} else {
+				expectEvent(mock, "update", outcomeFailed)
+			}
+
+			router := mux.NewRouter()
+			AttachRoutes(router, broker, lager.NewLogger("test"))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PATCH", fmt.Sprintf("/v2/service_instances/instance-1?accepts_incomplete=%t", test.async),
+				strings.NewReader(`{"parameters":{"restore_from":"backup-1"}}`)))
+			if w.Code != test.expected {
+				t.Fatalf(`expected status %d, got: %d (%s)`, test.expected, w.Code, w.Body.String())
+			}
+			waitForJobs(t, broker)
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAPIProvisionRestoreRefusesOtherBackups(t *testing.T) {
+	testCases := map[string]struct {
+		params   string
+		disabled bool
+		space    string
+	}{
+		"other space": {params: `{"restore_from": "backup-1"}`, space: "other-space-id"},
+		"unknown":     {params: `{"restore_from": "backup-1"}`},
+		"disabled":    {params: `{"restore_from": "backup-1"}`, disabled: true},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			broker, mock, _ := tenantBroker(t)
+			defer broker.db.Close()
+			if !test.disabled {
+				broker.Store = &ObjectStore{}
+			}
+
+			switch {
+			case test.space != "":
+				expectBackup(mock, test.space)
+			case !test.disabled:
+				mock.ExpectQuery(regexp.QuoteMeta(`FROM backups WHERE id = $1`)).
+					WillReturnRows(sqlmock.NewRows(backupRowColumns))
+				mock.ExpectQuery(regexp.QuoteMeta(`FROM backups WHERE instance = $1 AND state = 'done'`)).
+					WithArgs("backup-1").
+					WillReturnRows(sqlmock.NewRows(backupRowColumns))
+			}
+			expectEvent(mock, "provision", outcomeFailed)
+
+			router := mux.NewRouter()
+			AttachRoutes(router, broker, lager.NewLogger("test"))
+
+			req := httptest.NewRequest("PUT", "/v2/service_instances/instance-2?accepts_incomplete=true",
+				strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id","organization_guid":"org-id","space_guid":"space-id","parameters":`+test.params+`}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusBadRequest, w.Code, w.Body.String())
+			}
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAdminBackupRequiresOwnDatabase(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+	broker.Store = &ObjectStore{}
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, broker)
+
+	expectInstance(mock, "done", "tenants")
+	expectEvent(mock, "backup", outcomeFailed)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/instances/instance-1/backups", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusConflict, w.Code, w.Body.String())
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
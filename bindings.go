@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// startGrant records a new binding as being set up, and creates its
+// user in the background, for platforms that will poll for it.
+func (b *Broker) startGrant(instance string, binding Binding) error {
+	ctx, cancel := operation(b.ProvisionTimeout)
+
+	t, err := b.bindable(ctx, instance)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if !b.startJob() {
+		cancel()
+		oops("refusing to bind %s: %d jobs already running\n", instance, b.MaxJobs)
+		return ErrTooManyJobs
+	}
+
+	user := "u" + random(16)
+	pass := random(64)
+	_, err = b.exec(ctx, `INSERT INTO creds (binding, db, name, pass, app, requested_by, parameters, state, deadline, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, 'setup', $8, $9)`,
+		binding.ID, t.Name, user, pass, binding.App, binding.RequestedBy, nullJSON(binding.Parameters), deadline(ctx), binding.Expires)
+	if err != nil {
+		cancel()
+		b.finishJob()
+		return fmt.Errorf("failed to record binding: %w", err)
+	}
+
+	go func() {
+		defer b.finishJob()
+		defer cancel()
+
+		if err := b.createUser(ctx, t, user, pass, binding.Expires); err != nil {
+			b.failBinding("bind", "creating the database user", instance, binding.ID, err)
+			return
+		}
+		if _, err := b.exec(ctx, `UPDATE creds SET state = 'done' WHERE binding = $1 AND state = 'setup'`, binding.ID); err != nil {
+			oops("unable to transition binding %s from [setup] -> [done]: %s\n", binding.ID, err)
+		}
+		b.record(Event{Operation: "bind", Instance: instance, Binding: binding.ID, Outcome: outcomeSucceeded})
+
+		binding.Instance = instance
+		binding.Username = user
+		binding.Database = t.Database
+		binding.Schema = t.Schema
+		binding.State = "done"
+		binding.Created = time.Now()
+		b.notify("binding.created", binding)
+	}()
+	return nil
+}
+
+// startRevoke marks a binding as being torn down, and drops its user
+// in the background; the binding is forgotten once that's done.
+func (b *Broker) startRevoke(instance, id string) error {
+	binding, _, err := b.existingBinding(id)
+	if err != nil {
+		return fmt.Errorf("unable to look up binding %s: %w", id, err)
+	}
+	if binding == nil || binding.Instance != instance {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	switch binding.State {
+	case "teardown":
+		/* already on its way out; the platform can keep polling */
+		return nil
+	case "setup":
+		return ErrConcurrentOperation
+	}
+
+	if !b.startJob() {
+		oops("refusing to unbind %s: %d jobs already running\n", id, b.MaxJobs)
+		return ErrTooManyJobs
+	}
+
+	ctx, cancel := operation(b.DeprovisionTimeout)
+	_, err = b.exec(ctx, `UPDATE creds SET state = 'teardown', deadline = $2, failed_operation = NULL, failed_step = NULL, failure = NULL WHERE binding = $1`,
+		id, deadline(ctx))
+	if err != nil {
+		cancel()
+		b.finishJob()
+		return fmt.Errorf("failed to record unbinding: %w", err)
+	}
+
+	go func() {
+		defer b.finishJob()
+		defer cancel()
+
+		role := binding.Database
+		if binding.Schema != "" {
+			role = binding.Schema
+		}
+		if step, err := b.dropUser(ctx, role, binding.Database, binding.Username); err != nil {
+			b.failBinding("unbind", step, instance, id, err)
+			return
+		}
+		b.exec(ctx, `DELETE FROM creds WHERE binding = $1`, id)
+		b.record(Event{Operation: "unbind", Instance: instance, Binding: id, Outcome: outcomeSucceeded})
+
+		binding.State = ""
+		binding.Parameters = nil
+		b.notify("binding.deleted", *binding)
+	}()
+	return nil
+}
+
+// dropUser cuts a binding's user off from its instance, and then drops
+// it, returning the step that failed, if any.  Anything the user still
+// owns is handed to the instance role first, so that it can be dropped
+// at all; until it is, it can't log in or act as the instance role.
+func (b *Broker) dropUser(ctx context.Context, role, db, user string) (string, error) {
+	if _, err := b.execBackend(ctx, `REVOKE `+role+` FROM `+user); err != nil && !isPqError(err, "42704") {
+		return "revoking the instance role", err
+	}
+	_, err := b.execBackend(ctx, `ALTER ROLE `+user+` NOLOGIN`)
+	if isPqError(err, "42704") {
+		/* a binding that failed may never have gotten its user */
+		return "", nil
+	}
+	if err != nil {
+		return "disabling the database user", err
+	}
+	if _, err := b.execBackend(ctx, `REVOKE ALL PRIVILEGES ON DATABASE `+db+` FROM `+user); err != nil {
+		return "revoking privileges", err
+	}
+	if err := b.dropOwner(ctx, db, role, user); err != nil {
+		return "dropping the database user", err
+	}
+	return "", nil
+}
+
+func (b *Broker) failBinding(op, what, instance, id string, err error) {
+	oops("failed %s: %s\n", what, err)
+	/* the operation may have run out of time, but recording that shouldn't */
+	b.exec(context.Background(), `UPDATE creds SET state = 'failed', failed_operation = $2, failed_step = $3, failure = $4 WHERE binding = $1`,
+		id, op, what, failureReason(err))
+	b.record(Event{
+		Operation: op,
+		Instance:  instance,
+		Binding:   id,
+		Outcome:   outcomeFailed,
+		Error:     fmt.Sprintf("failed %s: %s", what, err),
+	})
+}
+
+func describeBinding(state string, f Failure) string {
+	switch state {
+	case "setup":
+		return "Creating the database user."
+	case "teardown":
+		return "Deleting the database user."
+	case "done":
+		return "The binding is ready."
+	default:
+		return describe(state, f)
+	}
+}
+
+// LastBindingOperation reports on an asynchronous bind or unbind; an
+// unbind that has finished leaves no binding behind, and so reports
+// brokerapi.ErrBindingDoesNotExist.
+func (b *Broker) LastBindingOperation(instance, id string) (brokerapi.LastOperation, error) {
+	info("somebody wants to know how binding %s is progressing...\n", id)
+
+	binding, _, err := b.existingBinding(id)
+	if err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+	if binding == nil || binding.Instance != instance {
+		return brokerapi.LastOperation{}, brokerapi.ErrBindingDoesNotExist
+	}
+
+	var f Failure
+	if binding.Failure != nil {
+		f = *binding.Failure
+	}
+	switch binding.State {
+	case "setup", "teardown":
+		return brokerapi.LastOperation{State: "in progress", Description: describeBinding(binding.State, f)}, nil
+	case "done":
+		return brokerapi.LastOperation{State: "succeeded", Description: describeBinding(binding.State, f)}, nil
+	case "failed":
+		return brokerapi.LastOperation{State: "failed", Description: describeBinding(binding.State, f)}, nil
+	default:
+		return brokerapi.LastOperation{}, fmt.Errorf("invalid binding state '%s'", binding.State)
+	}
+}
+
+// ExpireBindings fails every asynchronous bind or unbind that has run
+// past its deadline, as ExpireOperations does for instances.
+func (b *Broker) ExpireBindings() {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `
+UPDATE creds SET state = 'failed',
+                 failed_operation = CASE WHEN creds.state = 'setup' THEN 'bind' ELSE 'unbind' END,
+                 failed_step = 'waiting for the operation to finish',
+                 failure = 'it did not finish before its deadline'
+  FROM dbs
+ WHERE creds.db = dbs.name AND creds.state IN ('setup', 'teardown') AND creds.deadline < now()
+ RETURNING creds.binding, dbs.instance, creds.failed_operation`)
+	if err != nil {
+		oops("failed to check for stuck bindings: %s\n", err)
+		return
+	}
+	var expired []Event
+	for r.Next() {
+		var binding, instance, op string
+		if err := r.Scan(&binding, &instance, &op); err != nil {
+			oops("failed to check for stuck bindings: %s\n", err)
+			continue
+		}
+		expired = append(expired, Event{Operation: op, Instance: strings.TrimSpace(instance), Binding: strings.TrimSpace(binding)})
+	}
+	r.Close()
+
+	for _, e := range expired {
+		oops("%s of binding [%s] did not finish before its deadline; marking it as failed\n", e.Operation, e.Binding)
+		e.Outcome = outcomeFailed
+		e.Error = "failed waiting for the operation to finish: it did not finish before its deadline"
+		b.record(e)
+	}
+}
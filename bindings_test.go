@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/pivotal-golang/lager"
+)
+
+func waitForJobs(t *testing.T, broker *Broker) {
+	for i := 0; len(broker.jobs) > 0; i++ {
+		if i > 100 {
+			t.Fatalf(`background jobs did not finish`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPIAsyncBind(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	broker := &Broker{db: db, jobs: make(chan struct{}, 1)}
+	router := mux.NewRouter()
+	AttachRoutes(router, broker, lager.NewLogger("test"))
+
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "state", "populated", "shared_db"}).AddRow(mockDbName, "done", false, ""))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO creds (binding, db, name, pass, app, requested_by, parameters, state, deadline, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, 'setup', $8, $9)`)).
+		WithArgs("binding-1", mockDbName, UsernameArg(), PasswordArg(), "app-guid", "", nil, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "bind", outcomeAccepted)
+	mock.ExpectExec(`CREATE USER`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`GRANT ` + mockDbName + ` TO`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE creds SET state = 'done' WHERE binding = $1 AND state = 'setup'`)).
+		WithArgs("binding-1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "bind", outcomeSucceeded)
+
+	req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1?accepts_incomplete=true",
+		strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id","bind_resource":{"app_guid":"app-guid"}}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusAccepted, w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "credentials") {
+		t.Fatalf(`expected no credentials from an asynchronous bind, got: %s`, w.Body.String())
+	}
+	waitForJobs(t, broker)
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIAsyncUnbind(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	broker := &Broker{db: db, jobs: make(chan struct{}, 1)}
+	tenant := stubTenants(t, broker)
+	router := mux.NewRouter()
+	AttachRoutes(router, broker, lager.NewLogger("test"))
+
+	mock.ExpectQuery(`FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = \$1`).
+		WithArgs("binding-1").
+		WillReturnRows(sqlmock.NewRows(bindingRowColumns).
+			AddRow("binding-1", "instance-1", "u1", "p4ssw0rd", mockDbName, "app-guid", "", "done", "", "", "", ""))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE creds SET state = 'teardown'`)).
+		WithArgs("binding-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "unbind", outcomeAccepted)
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ` + mockDbName + ` FROM u1`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u1 NOLOGIN`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL PRIVILEGES ON DATABASE ` + mockDbName + ` FROM u1`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	/* the user made tables of its own, which the instance role inherits */
+	mock.ExpectExec(regexp.QuoteMeta(`DROP USER u1`)).
+		WillReturnError(&pq.Error{Code: "2BP01", Message: `role "u1" cannot be dropped because some objects depend on it`})
+	tenant.ExpectExec(regexp.QuoteMeta(`REASSIGN OWNED BY u1 TO ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP USER u1`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM creds WHERE binding = $1`)).
+		WithArgs("binding-1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "unbind", outcomeSucceeded)
+	expectNoBinding(mock)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/v2/service_instances/instance-1/service_bindings/binding-1?accepts_incomplete=true", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusAccepted, w.Code, w.Body.String())
+	}
+	waitForJobs(t, broker)
+
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	/* once the unbind is done, there's nothing left to poll */
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/instance-1/service_bindings/binding-1/last_operation", nil))
+	if w.Code != http.StatusGone {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusGone, w.Code, w.Body.String())
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPILastBindingOperation(t *testing.T) {
+	testCases := map[string]struct {
+		row         []interface{}
+		state       string
+		description string
+	}{
+		"in progress": {
+			row:         []interface{}{"setup", "", "", ""},
+			state:       "in progress",
+			description: "Creating the database user.",
+		},
+		"failed": {
+			row:         []interface{}{"failed", "bind", "creating the database user", `role "u1" already exists`},
+			state:       "failed",
+			description: `Binding the database failed while creating the database user: role "u1" already exists.  Please contact your operator.`,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			router := mux.NewRouter()
+			AttachRoutes(router, &Broker{db: db}, lager.NewLogger("test"))
+
+			mock.ExpectQuery(`FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = \$1`).
+				WithArgs("binding-1").
+				WillReturnRows(sqlmock.NewRows(bindingRowColumns).
+					AddRow("binding-1", "instance-1", "u1", "p4ssw0rd", mockDbName, "app-guid", "", test.row[0], test.row[1], test.row[2], test.row[3], ""))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/instance-1/service_bindings/binding-1/last_operation", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var op lastOperationResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &op); err != nil {
+				t.Fatalf(`unexpected error decoding '%s': %s`, w.Body.String(), err)
+			}
+			if string(op.State) != test.state || op.Description != test.description {
+				t.Fatalf(`unexpected last operation: %+v`, op)
+			}
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
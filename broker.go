@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"database/sql"
 
@@ -14,21 +20,96 @@ import (
 
 const brokerDatabaseName string = "broker"
 
+var ErrTooManyJobs = errors.New("too many provision / deprovision operations are in progress; please try again later")
+var ErrNothingToRetry = errors.New("only failed instances can be retried")
+var ErrConcurrentOperation = errors.New("another operation for this service instance is in progress")
+
 type Broker struct {
-	Description   string
-	Tags          []string
-	Service, Plan struct {
+	Description string
+	Tags        []string
+	Service     struct {
 		Name string
 		ID   string
 	}
+	Plans []Plan
 
 	Host            string
 	Port            string
 	Username        string
 	Password        string
 	ServiceDatabase string
+	Metadata        *Backend
+	PgDump          string
+	Psql            string
+	MaxJobs         int
+	EventRetention  time.Duration
+	Webhooks        []Webhook
+	WebhookAttempts int
+	Store           *ObjectStore
+	Limits          *RateLimits
+
+	ProvisionTimeout   time.Duration
+	DeprovisionTimeout time.Duration
+	StatementTimeout   time.Duration
+	BackupTimeout      time.Duration
+
+	db     *sql.DB
+	server *sql.DB
+	jobs   chan struct{}
+	outbox chan struct{}
+
+	/* connects to instance databases; tests stub this out */
+	dial func(db string) (*sql.DB, error)
+	/* connects as a binding's user, for the isolation test */
+	login func(user, pass, db string) (*sql.DB, error)
+
+	/* instances already flagged as open to PUBLIC, by the janitor */
+	exposed map[string]bool
+}
+
+// Backend is a PostgreSQL service bound to the broker.
+type Backend struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	Database string
+}
+
+type Instance struct {
+	ID             string          `json:"instance"`
+	Database       string          `json:"database"`
+	State          string          `json:"state"`
+	Failure        *Failure        `json:"failure,omitempty"`
+	Plan           string          `json:"plan"`
+	Name           string          `json:"name,omitempty"`
+	Organization   string          `json:"organization"`
+	Space          string          `json:"space"`
+	Parameters     json.RawMessage `json:"parameters,omitempty"`
+	Options        DatabaseOptions `json:"options"`
+	Extensions     []string        `json:"extensions,omitempty"`
+	Seed           string          `json:"seed,omitempty"`
+	Source         string          `json:"source,omitempty"`
+	SharedDatabase string          `json:"shared_database,omitempty"`
+	Backup         string          `json:"backup,omitempty"`
+	RequestedBy    string          `json:"requested_by,omitempty"`
+	Created        time.Time       `json:"created"`
+	Expires        *time.Time      `json:"expires_at,omitempty"`
+}
 
-	db *sql.DB
+type Binding struct {
+	ID          string          `json:"binding"`
+	Instance    string          `json:"instance"`
+	Username    string          `json:"username"`
+	Database    string          `json:"database"`
+	Schema      string          `json:"schema,omitempty"`
+	App         string          `json:"app,omitempty"`
+	State       string          `json:"state,omitempty"`
+	Failure     *Failure        `json:"failure,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	RequestedBy string          `json:"requested_by,omitempty"`
+	Created     time.Time       `json:"created"`
+	Expires     *time.Time      `json:"expires_at,omitempty"`
 }
 
 func getDatabaseName(instance vcaptive.Instance) (string, bool) {
@@ -71,58 +152,104 @@ func (b *Broker) Init() error {
 		}
 	}
 
+	tenant := backend(instance)
+	b.Host, b.Port, b.Username, b.Password, b.ServiceDatabase = tenant.Host, tenant.Port, tenant.Username, tenant.Password, tenant.Database
+
+	/* the broker's own metadata can live apart from its tenants */
+	home := tenant
+	if name := os.Getenv("SB_METADATA_SERVICE"); name != "" {
+		instance, found := services.Named(name)
+		if !found {
+			fmt.Fprintf(os.Stderr, "VCAP_SERVICES: no service named '%s' found, for SB_METADATA_SERVICE\n", name)
+			os.Exit(2)
+		}
+		home = backend(instance)
+		b.Metadata = &home
+	}
+
+	serviceDatabase, err := home.open(home.Database)
+	if err != nil {
+		return err
+	}
+	err = b.createBrokerDb(serviceDatabase)
+	serviceDatabase.Close()
+	if err != nil {
+		return err
+	}
+
+	db, err := home.open(brokerDatabaseName)
+	if err != nil {
+		return err
+	}
+	b.db = db
+
+	if b.Metadata != nil {
+		server, err := b.openDbConnection(b.ServiceDatabase)
+		if err != nil {
+			return err
+		}
+		b.server = server
+	}
+
+	if b.MaxJobs > 0 {
+		b.jobs = make(chan struct{}, b.MaxJobs)
+	}
+	if len(b.Webhooks) > 0 {
+		b.outbox = make(chan struct{}, 1)
+	}
+
+	if err := b.createBrokerDbSchemas(); err != nil {
+		return err
+	}
+	return b.lockDown()
+}
+
+// backend reads the credentials of a bound PostgreSQL service.
+func backend(instance vcaptive.Instance) Backend {
+	var be Backend
 	if s, ok := instance.GetString("username"); ok {
-		b.Username = s
+		be.Username = s
 	} else {
 		fmt.Fprintf(os.Stderr, "VCAP_SERVICES: '%s' service has no 'username' credential\n", instance.Label)
 		os.Exit(3)
 	}
 	if s, ok := instance.GetString("password"); ok {
-		b.Password = s
+		be.Password = s
 	} else {
 		fmt.Fprintf(os.Stderr, "VCAP_SERVICES: '%s' service has no 'password' credential\n", instance.Label)
 		os.Exit(3)
 	}
 	if s, ok := instance.GetString("host"); ok {
-		b.Host = s
+		be.Host = s
 	} else {
 		fmt.Fprintf(os.Stderr, "VCAP_SERVICES: '%s' service has no 'host' credential\n", instance.Label)
 		os.Exit(3)
 	}
 	if s, ok := getDatabaseName(instance); ok {
-		b.ServiceDatabase = s
+		be.Database = s
 	} else {
 		fmt.Fprintf(os.Stderr, "VCAP_SERVICES: '%s' service has no database name credential\n", instance.Label)
 		os.Exit(3)
 	}
 	if s, ok := instance.GetString("port"); ok {
-		b.Port = s
+		be.Port = s
 	} else {
 		fmt.Fprintf(os.Stderr, "VCAP_SERVICES: '%s' service has no 'port' credential; using default of 5432\n", instance.Label)
-		b.Port = "5432"
-	}
-
-	serviceDatabase, err := b.openDbConnection(b.ServiceDatabase)
-	if err != nil {
-		return err
-	}
-	err = b.createBrokerDb(serviceDatabase)
-	serviceDatabase.Close()
-	if err != nil {
-		return err
+		be.Port = "5432"
 	}
+	return be
+}
 
-	db, err := b.openDbConnection(brokerDatabaseName)
-	if err != nil {
-		return err
-	}
-	b.db = db
+func (b *Broker) openDbConnection(dbName string) (*sql.DB, error) {
+	return b.connect(b.Username, b.Password, dbName)
+}
 
-	return b.createBrokerDbSchemas()
+func (b *Broker) connect(username, password, dbName string) (*sql.DB, error) {
+	return Backend{Host: b.Host, Port: b.Port, Username: username, Password: password}.open(dbName)
 }
 
-func (b *Broker) openDbConnection(dbName string) (*sql.DB, error) {
-	dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", b.Username, b.Password, b.Host, b.Port, dbName)
+func (be Backend) open(dbName string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", be.Username, be.Password, be.Host, be.Port, dbName)
 
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
@@ -147,6 +274,8 @@ func (b *Broker) createBrokerDb(db *sql.DB) error {
 
 func (b *Broker) createBrokerDbSchemas() error {
 	b.db.Exec(`CREATE TYPE state AS ENUM ('setup', 'in-use', 'teardown', 'done', 'gone', 'failed', 'error')`)
+	b.db.Exec(`ALTER TYPE state ADD VALUE IF NOT EXISTS 'suspended'`)
+	b.db.Exec(`ALTER TYPE state ADD VALUE IF NOT EXISTS 'restoring'`)
 	b.db.Exec(`
 CREATE TABLE dbs (
   instance CHAR(36)          UNIQUE,
@@ -162,17 +291,73 @@ creds (
   pass    CHAR(64) NOT NULL,
   db      CHAR(42) NOT NULL
 )`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS plan          TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS org           TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS space         TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS instance_name TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS requested_by  TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS created       TIMESTAMP WITH TIME ZONE DEFAULT now()`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS failed_operation TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS failed_step      TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS failure          TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS started          TIMESTAMP WITH TIME ZONE`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS deadline         TIMESTAMP WITH TIME ZONE`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS parameters       TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS options          TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS extensions       TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS seed             TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS source           CHAR(36)`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS shared_db        TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS trial_state      TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS backup           TEXT`)
+	b.db.Exec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS restoring        TEXT`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS app          TEXT`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS requested_by TEXT`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS created      TIMESTAMP WITH TIME ZONE DEFAULT now()`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS parameters   TEXT`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS state            TEXT NOT NULL DEFAULT 'done'`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS failed_operation TEXT`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS failed_step      TEXT`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS failure          TEXT`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS deadline         TIMESTAMP WITH TIME ZONE`)
+	b.db.Exec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS expires          TIMESTAMP WITH TIME ZONE`)
+	b.createQuotaSchemas()
+	b.createEventSchemas()
+	b.createWebhookSchemas()
+	b.createTombstoneSchemas()
+	b.createBackupSchemas()
 	return nil
 }
 
-func (b *Broker) Exists(instance string) bool {
-	r, err := b.db.Query(`SELECT name FROM dbs WHERE instance = $1`, instance)
-	return err == nil && r.Next()
+func (b *Broker) fail(op, what, instance string, err error) {
+	fmt.Fprintf(os.Stderr, "failed %s: %s\n", what, err)
+	/* the operation may have run out of time, but recording that shouldn't */
+	b.exec(context.Background(), `UPDATE dbs SET state = 'failed'::state, failed_operation = $2, failed_step = $3, failure = $4 WHERE instance = $1`,
+		instance, op, what, failureReason(err))
+	b.record(Event{
+		Operation: op,
+		Instance:  instance,
+		Outcome:   outcomeFailed,
+		Error:     fmt.Sprintf("failed %s: %s", what, err),
+	})
 }
 
-func (b *Broker) fail(what, instance string, err error) {
-	fmt.Fprintf(os.Stderr, "failed %s: %s\n", what, err)
-	b.db.Exec(`UPDATE dbs SET state = 'failed'::state WHERE instance = $1`, instance)
+func (b *Broker) startJob() bool {
+	if b.jobs == nil {
+		return true
+	}
+	select {
+	case b.jobs <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Broker) finishJob() {
+	if b.jobs != nil {
+		<-b.jobs
+	}
 }
 
 func (b *Broker) generatedRandomDbName() string {
@@ -180,138 +365,443 @@ func (b *Broker) generatedRandomDbName() string {
 	return db
 }
 
-func (b *Broker) Setup(instance string, dbName string) {
-	_, err := b.db.Exec(`INSERT INTO dbs (instance, name, state, expires) VALUES ($1, $2, $3, $4)`,
-		instance, dbName, "setup", 0)
+func (b *Broker) Setup(inst Instance) {
+	ctx, cancel := operation(b.ProvisionTimeout)
+	defer cancel()
+
+	/* every step tolerates having been done before, so that a failed
+	   provision can be retried without cleaning up after it first; the
+	   row is normally claimed already, but never taken over from a live
+	   instance (or from another database) */
+	instance := inst.ID
+	options, _ := json.Marshal(inst.Options)
+	extensions, _ := json.Marshal(inst.Extensions)
+	r, err := b.exec(ctx, `INSERT INTO dbs (instance, name, state, expires, plan, org, space, instance_name, requested_by, started, deadline, parameters, options, extensions) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now(), $10, $11, $12, $13)
+  ON CONFLICT (instance) DO UPDATE SET state = 'setup', started = now(), deadline = $10,
+                                       failed_operation = NULL, failed_step = NULL, failure = NULL
+   WHERE TRIM(dbs.name) = $2 AND (dbs.state = 'setup' OR (dbs.state = 'failed' AND dbs.failed_operation = 'provision'))`,
+		instance, inst.Database, "setup", b.trialExpiry(inst.Plan), inst.Plan, inst.Organization, inst.Space, inst.Name, inst.RequestedBy, deadline(ctx), nullJSON(inst.Parameters), options, extensions)
 	if err != nil {
-		b.fail("creating `dbs` entry", instance, err)
+		b.fail("provision", "creating `dbs` entry", instance, err)
+		return
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		oops("refusing to set up instance %s: it is already in use\n", instance)
 		return
 	}
 
-	_, err = b.db.Exec(`CREATE DATABASE ` + dbName)
-	if err != nil {
-		b.fail("creating instance database", instance, err)
+	if inst.SharedDatabase != "" {
+		if step, err := b.createSchema(ctx, inst); err != nil {
+			b.fail("provision", step, instance, err)
+			return
+		}
+	} else if inst.Source != "" {
+		if step, err := b.clone(ctx, inst); err != nil {
+			b.fail("provision", step, instance, err)
+			return
+		}
+	} else if inst.Backup != "" {
+		if step, err := b.fromBackup(ctx, inst); err != nil {
+			b.fail("provision", step, instance, err)
+			return
+		}
+	} else {
+		_, err = b.execBackend(ctx, `CREATE DATABASE `+inst.Database+inst.Options.clause())
+		if isPqError(err, "42P04") {
+			info("instance database %s already exists, continuing\n", inst.Database)
+			err = nil
+		}
+		if err != nil {
+			b.fail("provision", "creating instance database", instance, err)
+			return
+		}
+	}
+	if inst.SharedDatabase == "" {
+		if step, err := b.isolate(ctx, inst.Database); err != nil {
+			b.fail("provision", step, instance, err)
+			return
+		}
+	}
+	/* a clone's objects go to the instance role, once there is one */
+	if inst.Source != "" {
+		if err := b.adopt(ctx, inst.Database); err != nil {
+			b.fail("provision", "taking ownership of the cloned objects", instance, err)
+			return
+		}
+	}
+
+	if ext, err := b.installExtensions(ctx, inst.Database, inst.Extensions); err != nil {
+		b.fail("provision", "installing extension "+ext, instance, err)
+		return
+	}
+
+	if step, err := b.seed(ctx, inst); err != nil {
+		b.fail("provision", step, instance, err)
 		return
 	}
 
-	if _, err := b.db.Exec(`UPDATE dbs SET state = 'done' WHERE instance = $1`, instance); err != nil {
+	/* if we ran out of time, the instance has already been failed */
+	if _, err := b.exec(ctx, `UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'setup'`, instance); err != nil {
 		fmt.Fprintf(os.Stderr, "unable to transition instance from [setup] -> [done]: %s\n", err)
 	}
+	b.record(Event{Operation: "provision", Instance: instance, Plan: inst.Plan, Outcome: outcomeSucceeded})
+
+	inst.State = "done"
+	inst.Created = time.Now()
+	b.notify("instance.created", inst)
 }
 
-func (b *Broker) CheckOn(instance string) string {
-	r, err := b.db.Query(`SELECT state FROM dbs WHERE instance = $1`, instance)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to retrieve instance [%s] database state: %s\n", instance, err)
-		return "error"
+// CheckOn reports the state of an instance, how its last operation
+// failed (if it did), and when it expires (if it's a trial).
+func (b *Broker) CheckOn(instance string) (string, Failure, time.Time) {
+	state, f, expires, overdue := b.checkOn(instance)
+	if overdue {
+		/* don't make the platform wait for the janitor to notice */
+		b.ExpireOperations()
+		state, f, expires, _ = b.checkOn(instance)
 	}
-	if !r.Next() {
+	return state, f, expires
+}
+
+func (b *Broker) checkOn(instance string) (string, Failure, time.Time, bool) {
+	var (
+		f       Failure
+		state   string
+		overdue bool
+		expires int64
+	)
+	err := b.scan(context.Background(), `SELECT state, COALESCE(failed_operation, ''), COALESCE(failed_step, ''), COALESCE(failure, ''),
+       COALESCE(state IN ('setup', 'teardown', 'restoring') AND deadline < now(), false), COALESCE(expires, 0) FROM dbs WHERE instance = $1`, []interface{}{instance},
+		&state, &f.Operation, &f.Step, &f.Reason, &overdue, &expires)
+	if err == sql.ErrNoRows {
 		fmt.Fprintf(os.Stderr, "failed to retrieve instance [%s] database state: no entry in dbs table\n", instance)
-		return "error"
+		return "error", f, time.Time{}, false
 	}
-
-	var state string
-	if err := r.Scan(&state); err != nil {
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to retrieve instance [%s] database state: %s\n", instance, err)
-		return "error"
+		return "error", f, time.Time{}, false
+	}
+
+	var until time.Time
+	if expires > 0 {
+		until = time.Unix(expires, 0)
 	}
+	return state, f, until, overdue
+}
+
+// bindable finds the database of an instance that is ready to be bound.
+// bindTarget is what a new binding's user gets access to.
+type bindTarget struct {
+	Name     string /* dbs.name, which the binding is recorded against */
+	Database string
+	Schema   string
 
-	return state
+	/* whether it started out with anything in it (from a seed, as a
+	   clone, or restored from a backup) */
+	Populated bool
 }
 
-func (b *Broker) Grant(instance, binding string) (string, string, string, error) {
-	var db, state string
-	r, err := b.db.Query(`SELECT name, state FROM dbs WHERE instance = $1`, instance)
-	if err != nil || !r.Next() || r.Scan(&db, &state) != nil {
-		return "", "", "", fmt.Errorf("failed to retrieve database instance")
+// bindable looks up what an instance that can be bound to gives its
+// bindings access to.
+func (b *Broker) bindable(ctx context.Context, instance string) (bindTarget, error) {
+	var (
+		t      bindTarget
+		state  string
+		shared string
+	)
+	err := b.scan(ctx, `SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`,
+		[]interface{}{instance}, &t.Name, &state, &t.Populated, &shared)
+	if err == sql.ErrNoRows || (err == nil && state == "gone") {
+		return t, brokerapi.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return t, fmt.Errorf("failed to retrieve database instance")
+	}
+	if state == "suspended" {
+		return t, ErrSuspended
 	}
 	if state != "done" {
-		return "", "", "", fmt.Errorf("database is still in '%s' state", state)
+		return t, fmt.Errorf("database is still in '%s' state", state)
 	}
 
-	user := "u" + random(16)
-	pass := random(64)
+	t.Database = t.Name
+	if shared != "" {
+		t.Database, t.Schema = shared, t.Name
+	}
+	return t, nil
+}
 
-	_, err = b.db.Exec(`CREATE USER ` + user + ` WITH NOCREATEDB NOCREATEROLE NOREPLICATION PASSWORD '` + pass + `'`)
+func (b *Broker) createUser(ctx context.Context, t bindTarget, user, pass string, expires *time.Time) error {
+	_, err := b.execBackend(ctx, `CREATE USER `+user+` WITH NOCREATEDB NOCREATEROLE NOREPLICATION PASSWORD '`+pass+`'`+validUntil(expires))
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to provision a user: %w", err)
+		return fmt.Errorf("failed to provision a user: %w", err)
+	}
+	if t.Schema != "" {
+		return b.grantSchema(ctx, t, user)
 	}
 
-	_, err = b.db.Exec(`GRANT ALL PRIVILEGES ON DATABASE ` + db + ` TO ` + user)
+	/* instances from before each had a role of its own get the
+	   privileges granted directly */
+	db := t.Database
+	_, err = b.execBackend(ctx, `GRANT `+db+` TO `+user)
+	if isPqError(err, "42704") {
+		_, err = b.execBackend(ctx, `GRANT ALL PRIVILEGES ON DATABASE `+db+` TO `+user)
+	}
 	if err != nil {
-		b.db.Exec(`DROP USER ` + user)
-		return "", "", "", fmt.Errorf("failed to grant db access to user: %w", err)
+		b.execBackend(ctx, `DROP USER `+user)
+		return fmt.Errorf("failed to grant db access to user: %w", err)
 	}
 
-	_, err = b.db.Exec(`INSERT INTO creds (binding, db, name, pass) VALUES ($1, $2, $3, $4)`,
-		binding, db, user, pass)
+	if t.Populated {
+		if err := b.grantExisting(ctx, db, user); err != nil {
+			b.execBackend(ctx, `REVOKE ALL PRIVILEGES ON DATABASE `+db+` FROM `+user)
+			b.execBackend(ctx, `DROP USER `+user)
+			return fmt.Errorf("failed to grant access to existing objects: %w", err)
+		}
+	}
+	return nil
+}
+
+// Grant creates a binding's user, returning the binding (as it was
+// made) and the user's password.
+func (b *Broker) Grant(instance string, binding Binding) (Binding, string, error) {
+	ctx := context.Background()
+
+	t, err := b.bindable(ctx, instance)
 	if err != nil {
-		b.db.Exec(`DROP USER ` + user)
-		return "", "", "", fmt.Errorf("failed to grant db access to user: %w", err)
+		return binding, "", err
 	}
 
-	return user, pass, db, nil
-}
+	user := "u" + random(16)
+	pass := random(64)
 
-func (b *Broker) Revoke(instance, binding string) error {
-	var state, db, user string
-	r, err := b.db.Query(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`, binding)
+	if err := b.createUser(ctx, t, user, pass, binding.Expires); err != nil {
+		return binding, "", err
+	}
+
+	_, err = b.exec(ctx, `INSERT INTO creds (binding, db, name, pass, app, requested_by, parameters, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		binding.ID, t.Name, user, pass, binding.App, binding.RequestedBy, nullJSON(binding.Parameters), binding.Expires)
 	if err != nil {
-		return err
+		b.execBackend(ctx, `DROP USER `+user)
+		return binding, "", fmt.Errorf("failed to grant db access to user: %w", err)
 	}
-	if !r.Next() {
-		return fmt.Errorf("database binding not %s not found", binding)
+
+	binding.Instance = instance
+	binding.Username = user
+	binding.Database = t.Database
+	binding.Schema = t.Schema
+	binding.Created = time.Now()
+	b.notify("binding.created", binding)
+
+	return binding, pass, nil
+}
+
+func (b *Broker) Revoke(instance, binding string) error {
+	ctx := context.Background()
+
+	var state, db, user, role string
+	err := b.scan(ctx, `SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`,
+		[]interface{}{binding}, &state, &user, &db, &role)
+	if err == sql.ErrNoRows {
+		return brokerapi.ErrBindingDoesNotExist
 	}
-	if err := r.Scan(&state, &user, &db); err != nil {
+	if err != nil {
 		return err
 	}
-	if state != "done" {
+	if state != "done" && state != "suspended" {
 		return fmt.Errorf("database is still in '%s' state", state)
 	}
 
-	_, err = b.db.Exec(`REVOKE ALL PRIVILEGES ON DATABASE ` + db + ` FROM ` + user)
-	if err != nil {
-		return fmt.Errorf("failed to revoke privileges: %w", err)
+	if step, err := b.dropUser(ctx, role, db, user); err != nil {
+		return fmt.Errorf("failed %s: %w", step, err)
 	}
+	b.exec(ctx, `DELETE FROM creds WHERE name = $1`, user)
 
-	b.db.Exec(`DROP USER ` + user)
-	b.db.Exec(`DELETE FROM creds WHERE name = $1`, user)
-
+	b.notify("binding.deleted", Binding{ID: binding, Instance: instance, Username: user, Database: db})
 	return nil
 }
 
 func (b *Broker) Teardown(instance string) {
-	var state, db, user string
-	r, err := b.db.Query(`SELECT state, name FROM dbs WHERE instance = $1`, instance)
-	if err != nil || !r.Next() || r.Scan(&state, &db) != nil {
-		b.fail("retrieving instance database entry", instance, err)
+	ctx, cancel := operation(b.DeprovisionTimeout)
+	defer cancel()
+
+	inst, err := b.GetInstance(instance)
+	if err == nil && inst == nil {
+		err = fmt.Errorf("no entry in dbs table")
+	}
+	if err != nil {
+		b.fail("deprovision", "retrieving instance database entry", instance, err)
 		return
 	}
+	db := inst.Database
 
-	b.db.Exec(`UPDATE dbs SET state = 'teardown' WHERE instance = $1`, instance)
+	b.exec(ctx, `UPDATE dbs SET state = 'teardown', started = now(), deadline = $2, failed_operation = NULL, failed_step = NULL, failure = NULL WHERE instance = $1`, instance, deadline(ctx))
 
-	r, err = b.db.Query(`SELECT creds.name FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1`, instance)
+	users, err := b.column(ctx, `SELECT creds.name FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1`, instance)
 	if err != nil {
-		b.fail("retreiving instance database credentials", instance, err)
+		b.fail("deprovision", "retreiving instance database credentials", instance, err)
 		return
 	}
 
+	if inst.SharedDatabase != "" {
+		if step, err := b.dropSchema(ctx, *inst, users); err != nil {
+			b.fail("deprovision", step, instance, err)
+			return
+		}
+	} else if p, _ := b.plan(inst.Plan); p.retention > 0 {
+		if step, err := b.entomb(ctx, *inst, users, p.retention); err != nil {
+			b.fail("deprovision", step, instance, err)
+			return
+		}
+	} else {
+		/* drop the database first, taking everything the users own with it;
+		   anything that's already gone (from an earlier attempt, or a half-built
+		   instance) is skipped */
+		if _, err := b.execBackend(ctx, `DROP DATABASE `+db); err != nil && !isPqError(err, "3D000") {
+			b.fail("deprovision", "dropping instance database", instance, err)
+			return
+		}
+		for _, user := range users {
+			if _, err := b.execBackend(ctx, `DROP USER `+user); err != nil && !isPqError(err, "42704") {
+				b.fail("deprovision", "dropping user "+user, instance, err)
+				return
+			}
+		}
+		if _, err := b.execBackend(ctx, `DROP ROLE IF EXISTS `+db); err != nil {
+			b.fail("deprovision", "dropping instance role", instance, err)
+			return
+		}
+	}
+
+	b.exec(ctx, `DELETE FROM creds WHERE db = $1`, db)
+	b.exec(ctx, `UPDATE dbs SET state = 'gone', expires = extract(epoch from now()) + 3600 WHERE instance = $1 AND state = 'teardown'`, instance)
+	b.record(Event{Operation: "deprovision", Instance: instance, Outcome: outcomeSucceeded})
+
+	inst.State = "gone"
+	b.notify("instance.deleted", inst)
+}
+
+const instanceColumns string = `
+instance, name, state, COALESCE(plan, ''), COALESCE(instance_name, ''),
+COALESCE(org, ''), COALESCE(space, ''), COALESCE(requested_by, ''), created,
+COALESCE(failed_operation, ''), COALESCE(failed_step, ''), COALESCE(failure, ''),
+COALESCE(parameters, ''), COALESCE(options, '{}'), COALESCE(extensions, 'null'), COALESCE(seed, ''),
+COALESCE(TRIM(source), ''), COALESCE(shared_db, ''),
+CASE WHEN expires > 0 AND state <> 'gone' THEN to_timestamp(expires) END, COALESCE(backup, '')`
+
+func scanInstance(r *sql.Rows) (Instance, error) {
+	var (
+		inst       Instance
+		f          Failure
+		params     string
+		options    string
+		extensions string
+		expires    sql.NullTime
+	)
+	err := r.Scan(&inst.ID, &inst.Database, &inst.State, &inst.Plan, &inst.Name,
+		&inst.Organization, &inst.Space, &inst.RequestedBy, &inst.Created,
+		&f.Operation, &f.Step, &f.Reason, &params, &options, &extensions, &inst.Seed, &inst.Source, &inst.SharedDatabase, &expires, &inst.Backup)
+	if err != nil {
+		return inst, err
+	}
+	inst.ID = strings.TrimSpace(inst.ID)
+	if expires.Valid {
+		inst.Expires = &expires.Time
+	}
+	if f.Step != "" {
+		inst.Failure = &f
+	}
+	if params != "" {
+		inst.Parameters = json.RawMessage(params)
+	}
+	if err := json.Unmarshal([]byte(extensions), &inst.Extensions); err != nil {
+		return inst, err
+	}
+	return inst, json.Unmarshal([]byte(options), &inst.Options)
+}
+
+// nullJSON stores absent (or empty) parameters as NULL, rather than as
+// an empty string that isn't valid JSON.
+func nullJSON(raw json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(raw), Valid: len(raw) > 0}
+}
+
+func (b *Broker) Instances(org, space string) ([]Instance, error) {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `SELECT `+instanceColumns+` FROM dbs
+ WHERE ($1 = '' OR org = $1)
+   AND ($2 = '' OR space = $2)
+ ORDER BY created`, org, space)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Instance, 0)
 	for r.Next() {
-		if r.Scan(&user) != nil {
-			continue
+		inst, err := scanInstance(r)
+		if err != nil {
+			return nil, err
 		}
+		l = append(l, inst)
+	}
+	return l, r.Err()
+}
 
-		b.db.Exec(`REVOKE ALL PRIVILEGES ON DATABASE ` + db + ` FROM ` + user)
-		b.db.Exec(`DROP USER ` + user)
+func (b *Broker) GetInstance(instance string) (*Instance, error) {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `SELECT `+instanceColumns+` FROM dbs WHERE instance = $1`, instance)
+	if err != nil {
+		return nil, err
 	}
+	defer r.Close()
 
-	b.db.Exec(`DROP DATABASE ` + db)
-	b.db.Exec(`DELETE FROM creds WHERE db = $1`, db)
-	b.db.Exec(`UPDATE dbs SET state = 'gone', expires = extract(epoch from now()) + 3600 WHERE instance = $1`, instance)
+	if !r.Next() {
+		return nil, r.Err()
+	}
+	inst, err := scanInstance(r)
+	if err != nil {
+		return nil, err
+	}
+	return &inst, nil
+}
+
+func (b *Broker) Bindings(instance string) ([]Binding, error) {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `
+SELECT creds.binding, dbs.instance, creds.name, creds.db, creds.state,
+       COALESCE(creds.app, ''), COALESCE(creds.requested_by, ''), creds.created, creds.expires
+  FROM creds INNER JOIN dbs ON creds.db = dbs.name
+ WHERE dbs.instance = $1
+ ORDER BY creds.created`, instance)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Binding, 0)
+	for r.Next() {
+		var binding Binding
+		if err := r.Scan(&binding.ID, &binding.Instance, &binding.Username, &binding.Database, &binding.State,
+			&binding.App, &binding.RequestedBy, &binding.Created, &binding.Expires); err != nil {
+			return nil, err
+		}
+		binding.ID = strings.TrimSpace(binding.ID)
+		binding.Instance = strings.TrimSpace(binding.Instance)
+		binding.Username = strings.TrimSpace(binding.Username)
+		l = append(l, binding)
+	}
+	return l, r.Err()
 }
 
 func (b *Broker) Track(instance, db, state string) {
-	b.db.Exec(`INSERT INTO dbs (instance, name, state, expires) VALUES ($1, $2, $3, 0)`, instance, db, state)
+	b.exec(context.Background(), `INSERT INTO dbs (instance, name, state, expires) VALUES ($1, $2, $3, 0)`, instance, db, state)
 }
 
 /*************************************************************/
@@ -324,72 +814,315 @@ func (b *Broker) Services() []brokerapi.Service {
 			Description: b.Description,
 			Bindable:    true,
 			Tags:        b.Tags,
-			Plans: []brokerapi.ServicePlan{
-				brokerapi.ServicePlan{
-					ID:          b.Plan.ID,
-					Name:        b.Plan.Name,
-					Description: b.Description,
-				},
-			},
+			Plans:       b.servicePlans(),
 		},
 	}
 }
 
+func (b *Broker) servicePlans() []brokerapi.ServicePlan {
+	l := make([]brokerapi.ServicePlan, len(b.Plans))
+	for i, p := range b.Plans {
+		l[i] = brokerapi.ServicePlan{
+			ID:          p.ID,
+			Name:        p.Name,
+			Description: p.Description,
+		}
+	}
+	return l
+}
+
 func (b *Broker) Provision(instance string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	spec, _, err := b.provision(Instance{ID: instance}, details, asyncAllowed)
+	return spec, err
+}
+
+// provision also reports whether the instance already existed, exactly
+// as requested, in which case nothing new was started.
+func (b *Broker) provision(inst Instance, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, bool, error) {
+	spec, existed, err := b.startProvision(inst, details, asyncAllowed)
+	b.record(Event{
+		Operation: "provision",
+		Instance:  inst.ID,
+		Plan:      details.PlanID,
+		Identity:  inst.RequestedBy,
+		Outcome:   outcome(err, outcomeAccepted),
+		Error:     errorString(err),
+	})
+	return spec, existed, err
+}
+
+// sameInstance checks if a repeated provision request asks for the
+// instance we already have; rows from before we tracked the plan, org,
+// space and options match anything.
+func sameInstance(existing, requested Instance) bool {
+	same := func(a, b string) bool { return a == "" || a == b }
+	return same(existing.Plan, requested.Plan) &&
+		same(existing.Organization, requested.Organization) &&
+		same(existing.Space, requested.Space) &&
+		(existing.Options == DatabaseOptions{} || existing.Options == requested.Options) &&
+		len(merge(existing.Extensions, requested.Extensions)) == len(existing.Extensions) &&
+		same(existing.Source, requested.Source) &&
+		sameParameters(existing.Parameters, requested.Parameters)
+}
+
+// sameParameters compares provision parameters as JSON, so that key
+// order and whitespace don't make a repeated request look different.
+func sameParameters(a, b json.RawMessage) bool {
+	decode := func(raw json.RawMessage) (interface{}, bool) {
+		var v interface{}
+		if len(raw) > 0 && json.Unmarshal(raw, &v) != nil {
+			return nil, false
+		}
+		if v == nil {
+			v = map[string]interface{}{}
+		}
+		return v, true
+	}
+	x, ok := decode(a)
+	if !ok {
+		return false
+	}
+	y, ok := decode(b)
+	return ok && reflect.DeepEqual(x, y)
+}
+
+// provisioned answers a provision request for an instance that already
+// exists: a 200 if it is done and is what was asked for, a 202 if it is
+// still being set up, and a 409 otherwise.
+func provisioned(existing, requested Instance, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, bool, error) {
+	if !sameInstance(existing, requested) {
+		oops("refusing to provision %s: it already exists, with a different plan, org, space or parameters\n", requested.ID)
+		return brokerapi.ProvisionedServiceSpec{}, false, brokerapi.ErrInstanceAlreadyExists
+	}
+	switch existing.State {
+	case "done", "suspended":
+		return brokerapi.ProvisionedServiceSpec{IsAsync: false}, true, nil
+	case "setup":
+		if !asyncAllowed {
+			return brokerapi.ProvisionedServiceSpec{}, false, brokerapi.ErrAsyncRequired
+		}
+		return brokerapi.ProvisionedServiceSpec{IsAsync: true}, true, nil
+	default:
+		oops("refusing to provision %s: it already exists, and is in '%s' state\n", requested.ID, existing.State)
+		return brokerapi.ProvisionedServiceSpec{}, false, brokerapi.ErrInstanceAlreadyExists
+	}
+}
+
+// claim records a new instance as being set up, unless another request
+// got there first, in which case it reports false.  Deleted instances
+// don't count, and make way for the new one.  The new instance is
+// checked against its quotas in the same transaction, with the quotas
+// locked, so that concurrent provisions can't both take the last slot.
+func (b *Broker) claim(ctx context.Context, inst Instance) (bool, error) {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+	if _, err := tx.ExecContext(sctx, `DELETE FROM dbs WHERE instance = $1 AND state = 'gone'`, inst.ID); err != nil {
+		return false, err
+	}
+	options, _ := json.Marshal(inst.Options)
+	extensions, _ := json.Marshal(inst.Extensions)
+	r, err := tx.ExecContext(sctx, `INSERT INTO dbs (instance, name, state, expires, plan, org, space, instance_name, requested_by, started, deadline, parameters, options, extensions) VALUES ($1, $2, 'setup', $3, $4, $5, $6, $7, $8, now(), $9, $10, $11, $12)
+  ON CONFLICT (instance) DO NOTHING`,
+		inst.ID, inst.Database, b.trialExpiry(inst.Plan), inst.Plan, inst.Organization, inst.Space, inst.Name, inst.RequestedBy, deadline(ctx), nullJSON(inst.Parameters), options, extensions)
+	if err != nil {
+		return false, err
+	}
+	if n, err := r.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	if err := b.CheckQuotas(tx, inst); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (b *Broker) startProvision(inst Instance, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, bool, error) {
 	spec := brokerapi.ProvisionedServiceSpec{IsAsync: true}
+	instance := inst.ID
 
 	info("somebody wants to provision a %s/%s\n", details.ServiceID, details.PlanID)
-	if details.ServiceID != b.Service.ID && details.PlanID != b.Plan.ID {
-		/* we only allow one service/plan */
-		oops("invalid plan %s/%s (we only accept %s/%s)\n", details.ServiceID, details.PlanID, b.Service.ID, b.Plan.ID)
-		return spec, fmt.Errorf("invalid plan %s/%s", details.ServiceID, details.PlanID)
+	plan, ok := b.plan(details.PlanID)
+	if details.ServiceID != b.Service.ID || !ok {
+		/* we only allow our own service, and its plans */
+		oops("invalid plan %s/%s (we only offer service %s)\n", details.ServiceID, details.PlanID, b.Service.ID)
+		return spec, false, fmt.Errorf("invalid plan %s/%s", details.ServiceID, details.PlanID)
+	}
+
+	params, err := parseProvisionParameters(details.RawParameters)
+	if err != nil {
+		return spec, false, err
+	}
+	if inst.Options, err = plan.databaseOptions(params); err != nil {
+		oops("refusing to provision %s: %s\n", instance, err)
+		return spec, false, err
+	}
+	if inst.Extensions, err = plan.extensions(params.Extensions); err != nil {
+		oops("refusing to provision %s: %s\n", instance, err)
+		return spec, false, err
+	}
+	if params.CloneFrom != "" {
+		source, err := b.cloneSource(plan, params, details)
+		if err != nil {
+			oops("refusing to provision %s: %s\n", instance, err)
+			return spec, false, err
+		}
+		inst.Source = source.ID
+		inst.Options = source.Options
+		inst.Extensions = merge(source.Extensions, inst.Extensions)
+	}
+	if params.RestoreFrom != "" {
+		bk, err := b.backupSource(plan, params, details)
+		if err != nil {
+			oops("refusing to provision %s: %s\n", instance, err)
+			return spec, false, err
+		}
+		inst.Backup = bk.ID
+	}
+
+	if plan.Mode == "schema" {
+		inst.SharedDatabase = plan.SharedDatabase
 	}
 
-	dbName := b.generatedRandomDbName()
+	inst.Database = b.generatedRandomDbName()
+	inst.Plan = details.PlanID
+	inst.Organization = details.OrganizationGUID
+	inst.Space = details.SpaceGUID
+	inst.Parameters = details.RawParameters
 
-	go b.Setup(instance, dbName)
-	return spec, nil
+	existing, err := b.GetInstance(instance)
+	if err != nil {
+		return spec, false, fmt.Errorf("unable to check for an existing instance %s: %w", instance, err)
+	}
+	if existing != nil && existing.State != "gone" {
+		return provisioned(*existing, inst, asyncAllowed)
+	}
+	if !asyncAllowed {
+		/* creating a database always takes a while */
+		return spec, false, brokerapi.ErrAsyncRequired
+	}
+
+	if !b.startJob() {
+		oops("refusing to provision %s: %d jobs already running\n", instance, b.MaxJobs)
+		return spec, false, ErrTooManyJobs
+	}
+	/* only one of several concurrent requests for the same instance gets to set it up */
+	ctx, cancel := operation(b.ProvisionTimeout)
+	defer cancel()
+	claimed, err := b.claim(ctx, inst)
+	if err != nil || !claimed {
+		b.finishJob()
+	}
+	var qe *QuotaError
+	if errors.As(err, &qe) {
+		oops("refusing to provision %s: %s\n", instance, err)
+		b.notify("quota.exceeded", struct {
+			Scope    string `json:"scope"`
+			GUID     string `json:"guid"`
+			Instance string `json:"instance"`
+			Plan     string `json:"plan"`
+			Error    string `json:"error"`
+		}{qe.Scope, qe.GUID, instance, inst.Plan, qe.Error()})
+		return spec, false, err
+	}
+	if err != nil {
+		return spec, false, fmt.Errorf("unable to record instance %s: %w", instance, err)
+	}
+	if !claimed {
+		existing, err := b.GetInstance(instance)
+		if err != nil {
+			return spec, false, fmt.Errorf("unable to check for an existing instance %s: %w", instance, err)
+		}
+		if existing == nil || existing.State == "gone" {
+			return spec, false, ErrConcurrentOperation
+		}
+		return provisioned(*existing, inst, asyncAllowed)
+	}
+	go func() {
+		defer b.finishJob()
+		b.Setup(inst)
+	}()
+	return spec, false, nil
 }
 
 func (b *Broker) Deprovision(instance string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.IsAsync, error) {
+	return b.deprovision(instance, details, asyncAllowed, "")
+}
+
+func (b *Broker) deprovision(instance string, details brokerapi.DeprovisionDetails, asyncAllowed bool, identity string) (brokerapi.IsAsync, error) {
+	async, err := b.startDeprovision(instance, details)
+	b.record(Event{
+		Operation: "deprovision",
+		Instance:  instance,
+		Plan:      details.PlanID,
+		Identity:  identity,
+		Outcome:   outcome(err, outcomeAccepted),
+		Error:     errorString(err),
+	})
+	return async, err
+}
+
+func (b *Broker) startDeprovision(instance string, details brokerapi.DeprovisionDetails) (brokerapi.IsAsync, error) {
 	info("somebody wants to deprovision %s (a %s/%s)\n", instance, details.ServiceID, details.PlanID)
 
-	if !b.Exists(instance) {
+	inst, err := b.GetInstance(instance)
+	if err != nil {
+		return false, fmt.Errorf("unable to look up instance %s: %w", instance, err)
+	}
+	if inst == nil || inst.State == "gone" {
 		/* return a 410 Gone to the caller */
 		return false, brokerapi.ErrInstanceDoesNotExist
 	}
+	switch inst.State {
+	case "teardown":
+		/* already on its way out; the platform can keep polling */
+		return true, nil
+	case "setup", "restoring":
+		return false, ErrConcurrentOperation
+	}
 
-	go b.Teardown(instance)
+	if !b.startJob() {
+		oops("refusing to deprovision %s: %d jobs already running\n", instance, b.MaxJobs)
+		return false, ErrTooManyJobs
+	}
+	go func() {
+		defer b.finishJob()
+		b.Teardown(instance)
+	}()
 	return true, nil
 }
 
 func (b *Broker) LastOperation(instance string) (brokerapi.LastOperation, error) {
 	info("somebody wants to know how instance %s is progressing...\n", instance)
 
-	state := b.CheckOn(instance)
+	state, f, expires := b.CheckOn(instance)
 	switch state {
-	case "setup", "teardown":
-		return brokerapi.LastOperation{State: "in progress"}, nil
-	case "done", "gone":
-		return brokerapi.LastOperation{State: "succeeded"}, nil
+	case "setup", "teardown", "restoring":
+		return brokerapi.LastOperation{State: "in progress", Description: describe(state, f)}, nil
+	case "done", "suspended":
+		return brokerapi.LastOperation{State: "succeeded", Description: describe(state, f) + describeTrial(state, expires)}, nil
+	case "gone":
+		return brokerapi.LastOperation{State: "succeeded", Description: describe(state, f)}, nil
 	case "failed", "error":
-		return brokerapi.LastOperation{State: "failed"}, nil
+		return brokerapi.LastOperation{State: "failed", Description: describe(state, f)}, nil
 	default:
 		return brokerapi.LastOperation{}, fmt.Errorf("invalid state '%s'", state)
 	}
 }
 
 func (b *Broker) Bind(instance, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	var binding brokerapi.Binding
-
-	info("somebody wants to bind service instance %s...\n", instance)
-	user, pass, db, err := b.Grant(instance, bindingID)
-	if err != nil {
-		oops("failed to bind %s: %s\n", instance, err)
-		return binding, err
-	}
+	spec, err := b.bind(instance, Binding{ID: bindingID}, details, false)
+	return spec.Binding, err
+}
 
-	binding.Credentials = map[string]interface{}{
+func (b *Broker) credentials(user, pass, db, schema string) map[string]interface{} {
+	creds := map[string]interface{}{
 		"username": user,
 		"password": pass,
 		"database": db,
@@ -397,26 +1130,261 @@ func (b *Broker) Bind(instance, bindingID string, details brokerapi.BindDetails)
 		"port":     b.Port,
 		"dsn":      fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", user, pass, b.Host, b.Port, db),
 	}
+	if schema != "" {
+		creds["schema"] = schema
+	}
+	return creds
+}
 
-	info("bound %s:%s@%s:%s/%s\n", user, pass, b.Host, b.Port, db)
-	info("creds = %v\n", binding.Credentials)
-	return binding, nil
+// existingBinding looks up a binding (and its password) by ID, so that
+// a repeated bind can be answered with the credentials it already got.
+func (b *Broker) existingBinding(id string) (*Binding, string, error) {
+	var (
+		binding Binding
+		pass    string
+		params  string
+		shared  string
+		f       Failure
+	)
+	err := b.scan(context.Background(), `
+SELECT creds.binding, dbs.instance, creds.name, creds.pass, creds.db, COALESCE(creds.app, ''), COALESCE(creds.parameters, ''),
+       creds.state, COALESCE(creds.failed_operation, ''), COALESCE(creds.failed_step, ''), COALESCE(creds.failure, ''),
+       COALESCE(dbs.shared_db, '')
+  FROM creds INNER JOIN dbs ON creds.db = dbs.name
+ WHERE creds.binding = $1`, []interface{}{id},
+		&binding.ID, &binding.Instance, &binding.Username, &pass, &binding.Database, &binding.App, &params,
+		&binding.State, &f.Operation, &f.Step, &f.Reason, &shared)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	binding.ID = strings.TrimSpace(binding.ID)
+	binding.Instance = strings.TrimSpace(binding.Instance)
+	binding.Username = strings.TrimSpace(binding.Username)
+	if shared != "" {
+		binding.Database, binding.Schema = shared, binding.Database
+	}
+	if params != "" {
+		binding.Parameters = json.RawMessage(params)
+	}
+	if f.Step != "" {
+		binding.Failure = &f
+	}
+	return &binding, strings.TrimSpace(pass), nil
+}
+
+// BindingSpec is what came of a bind request: the credentials (unless
+// the binding is still being made in the background), and whether the
+// binding already existed, exactly as requested.
+type BindingSpec struct {
+	brokerapi.Binding
+	IsAsync bool
+	Existed bool
+}
+
+func (b *Broker) bind(instance string, request Binding, details brokerapi.BindDetails, asyncAllowed bool) (BindingSpec, error) {
+	request.App = details.AppGUID
+	if request.App == "" && details.BindResource != nil {
+		request.App = details.BindResource.AppGuid
+	}
+	if len(details.Parameters) > 0 {
+		request.Parameters, _ = json.Marshal(details.Parameters)
+	}
+
+	info("somebody wants to bind service instance %s...\n", instance)
+	var spec BindingSpec
+	params, err := parseBindParameters(request.Parameters)
+	if err == nil {
+		plan, _ := b.plan(details.PlanID)
+		request.Expires, err = plan.expiry(params, request.App, time.Now())
+	}
+	if err == nil {
+		spec, err = b.startBind(instance, request, asyncAllowed)
+	}
+	ok := outcomeSucceeded
+	if spec.IsAsync {
+		ok = outcomeAccepted
+	}
+	b.record(Event{
+		Operation: "bind",
+		Instance:  instance,
+		Binding:   request.ID,
+		Plan:      details.PlanID,
+		Identity:  request.RequestedBy,
+		Outcome:   outcome(err, ok),
+		Error:     errorString(err),
+	})
+	if err != nil {
+		oops("failed to bind %s: %s\n", instance, err)
+		return spec, err
+	}
+	return spec, nil
+}
+
+func (b *Broker) startBind(instance string, request Binding, async bool) (BindingSpec, error) {
+	var spec BindingSpec
+
+	existing, pass, err := b.existingBinding(request.ID)
+	if err != nil {
+		return spec, fmt.Errorf("unable to check for an existing binding %s: %w", request.ID, err)
+	}
+	if existing != nil {
+		if existing.Instance != instance || existing.App != request.App {
+			return spec, brokerapi.ErrBindingAlreadyExists
+		}
+		switch existing.State {
+		case "done":
+			spec.Credentials = b.credentials(existing.Username, pass, existing.Database, existing.Schema)
+			spec.Existed = true
+			return spec, nil
+		case "setup":
+			if !async {
+				return spec, ErrConcurrentOperation
+			}
+			return BindingSpec{IsAsync: true, Existed: true}, nil
+		case "teardown":
+			return spec, ErrConcurrentOperation
+		default:
+			/* a failed binding has to be unbound before it can be tried again */
+			return spec, brokerapi.ErrBindingAlreadyExists
+		}
+	}
+
+	if async {
+		if err := b.startGrant(instance, request); err != nil {
+			return spec, err
+		}
+		return BindingSpec{IsAsync: true}, nil
+	}
+
+	binding, pass, err := b.Grant(instance, request)
+	if err != nil {
+		return spec, err
+	}
+
+	spec.Credentials = b.credentials(binding.Username, pass, binding.Database, binding.Schema)
+
+	info("bound %s@%s:%s/%s\n", binding.Username, b.Host, b.Port, binding.Database)
+	return spec, nil
 }
 
 func (b *Broker) Unbind(instance, bindingID string, details brokerapi.UnbindDetails) error {
+	_, err := b.unbind(instance, bindingID, details, false, "")
+	return err
+}
+
+func (b *Broker) unbind(instance, bindingID string, details brokerapi.UnbindDetails, asyncAllowed bool, identity string) (brokerapi.IsAsync, error) {
 	info("somebody wants to unbind %s from service instance %s...\n", bindingID, instance)
 
-	err := b.Revoke(instance, bindingID)
+	var err error
+	ok := outcomeSucceeded
+	if asyncAllowed {
+		ok = outcomeAccepted
+		err = b.startRevoke(instance, bindingID)
+	} else {
+		err = b.Revoke(instance, bindingID)
+	}
+	b.record(Event{
+		Operation: "unbind",
+		Instance:  instance,
+		Binding:   bindingID,
+		Plan:      details.PlanID,
+		Identity:  identity,
+		Outcome:   outcome(err, ok),
+		Error:     errorString(err),
+	})
 	if err != nil {
 		oops("failed to unbind %s from %s: %s\n", bindingID, instance, err)
-		return err
+		return false, err
 	}
 
-	info("unbound %s from %s\n", bindingID, instance)
-	return nil
+	if asyncAllowed {
+		info("unbinding %s from %s in the background\n", bindingID, instance)
+	} else {
+		info("unbound %s from %s\n", bindingID, instance)
+	}
+	return brokerapi.IsAsync(asyncAllowed), nil
 }
 
 func (b *Broker) Update(instance string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.IsAsync, error) {
-	oops("update operation not implemented")
-	return false, fmt.Errorf("not implemented")
+	return b.update(instance, details, asyncAllowed, "")
+}
+
+func (b *Broker) update(instance string, details brokerapi.UpdateDetails, asyncAllowed bool, identity string) (brokerapi.IsAsync, error) {
+	info("somebody wants to update %s\n", instance)
+
+	async, err := b.startUpdate(instance, details, asyncAllowed, identity)
+	ok := outcomeSucceeded
+	if async {
+		ok = outcomeAccepted
+	}
+	b.record(Event{
+		Operation: "update",
+		Instance:  instance,
+		Plan:      details.PlanID,
+		Identity:  identity,
+		Outcome:   outcome(err, ok),
+		Error:     errorString(err),
+	})
+	if err != nil {
+		oops("failed to update %s: %s\n", instance, err)
+	}
+	return async, err
+}
+
+// startUpdate applies an update, which (since plans can't be changed)
+// can only install more of the plan's extensions, or restore a backup.
+// Restoring a backup is asynchronous, and the platform polls the
+// instance until it's done.
+func (b *Broker) startUpdate(instance string, details brokerapi.UpdateDetails, asyncAllowed bool, identity string) (brokerapi.IsAsync, error) {
+	inst, err := b.GetInstance(instance)
+	if err != nil {
+		return false, fmt.Errorf("unable to look up instance %s: %w", instance, err)
+	}
+	if inst == nil || inst.State == "gone" {
+		return false, brokerapi.ErrInstanceDoesNotExist
+	}
+	if details.PlanID != "" && details.PlanID != inst.Plan {
+		return false, brokerapi.ErrPlanChangeNotSupported
+	}
+	if inst.State == "suspended" {
+		return false, ErrSuspended
+	}
+	if inst.State != "done" {
+		return false, ErrConcurrentOperation
+	}
+
+	raw, _ := json.Marshal(details.Parameters)
+	params, err := parseProvisionParameters(raw)
+	if err != nil {
+		return false, err
+	}
+	if params.Encoding != "" || params.Locale != "" || params.CollationProvider != "" || params.Template != "" {
+		return false, parameterError("only extensions can be changed once the database has been created")
+	}
+
+	plan, _ := b.plan(inst.Plan)
+	if params.RestoreFrom != "" {
+		if len(params.Extensions) > 0 {
+			return false, parameterError("a backup can be restored, or extensions installed, but not both at once")
+		}
+		if !asyncAllowed {
+			return false, brokerapi.ErrAsyncRequired
+		}
+		bk, err := b.backupSource(plan, params, brokerapi.ProvisionDetails{OrganizationGUID: inst.Organization, SpaceGUID: inst.Space})
+		if err != nil {
+			return false, err
+		}
+		if _, err := b.RestoreBackup(bk.ID, instance, identity); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	extensions, err := plan.extensions(params.Extensions)
+	if err != nil {
+		return false, err
+	}
+	return false, b.AddExtensions(*inst, extensions)
 }
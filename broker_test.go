@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jhunt/vcaptive"
@@ -78,17 +79,22 @@ func (mockBroker *MockBroker) generatedRandomDbName() string {
 	return mockDbName
 }
 
-func (mockBroker *MockBroker) Setup(instance string, dbName string) {
+func (mockBroker *MockBroker) Setup(inst Instance) {
 	defer mockBroker.wg.Done()
 
-	mockBroker.Broker.Setup(instance, dbName)
+	mockBroker.Broker.Setup(inst)
 }
 
 func (mockBroker *MockBroker) Provision(instance string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
 	spec := brokerapi.ProvisionedServiceSpec{IsAsync: true}
 
-	dbName := mockBroker.generatedRandomDbName()
-	go mockBroker.Setup(instance, dbName)
+	go mockBroker.Setup(Instance{
+		ID:           instance,
+		Database:     mockBroker.generatedRandomDbName(),
+		Plan:         details.PlanID,
+		Organization: details.OrganizationGUID,
+		Space:        details.SpaceGUID,
+	})
 
 	return spec, nil
 }
@@ -104,6 +110,25 @@ func (mockBroker *MockBroker) Deprovision(instance string, details brokerapi.Dep
 	return true, nil
 }
 
+func expectNoInstance(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns))
+}
+
+var bindingRowColumns = []string{"binding", "instance", "name", "pass", "db", "app", "parameters",
+	"state", "failed_operation", "failed_step", "failure", "shared_db"}
+
+func expectNoBinding(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = \$1`).
+		WillReturnRows(sqlmock.NewRows(bindingRowColumns))
+}
+
+func expectEvent(mock sqlmock.Sqlmock, operation, outcome string) {
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).
+		WithArgs(operation, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), outcome, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
 func setVcapServicesEnv(credentialKey string, credentialValue string) {
 	os.Setenv("VCAP_SERVICES", fmt.Sprintf(vcapServicesDbCredsJson, credentialKey, credentialValue))
 }
@@ -242,6 +267,10 @@ func TestCreateBrokerDatabaseSchemasSuccess(t *testing.T) {
 
 	mock.ExpectExec(regexp.QuoteMeta(`CREATE TYPE state AS ENUM ('setup', 'in-use', 'teardown', 'done', 'gone', 'failed', 'error')`)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TYPE state ADD VALUE IF NOT EXISTS 'suspended'`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TYPE state ADD VALUE IF NOT EXISTS 'restoring'`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
 	mock.ExpectExec(regexp.QuoteMeta(`
 	CREATE TABLE dbs (
 	  instance CHAR(36)          UNIQUE,
@@ -257,6 +286,36 @@ func TestCreateBrokerDatabaseSchemasSuccess(t *testing.T) {
 		pass    CHAR(64) NOT NULL,
 		db      CHAR(42) NOT NULL
 	)`)).WillReturnResult(sqlmock.NewResult(1, 1))
+	for _, column := range []string{"plan", "org", "space", "instance_name", "requested_by", "created",
+		"failed_operation", "failed_step", "failure", "started", "deadline", "parameters", "options", "extensions", "seed", "source", "shared_db", "trial_state", "backup", "restoring"} {
+		mock.ExpectExec(`ALTER TABLE dbs ADD COLUMN IF NOT EXISTS ` + column + ` `).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	for _, column := range []string{"app", "requested_by", "created", "parameters",
+		"state", "failed_operation", "failed_step", "failure", "deadline", "expires"} {
+		mock.ExpectExec(`ALTER TABLE creds ADD COLUMN IF NOT EXISTS ` + column + ` `).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS quotas`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS events`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS events_instance_idx`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS events_at_idx`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS outbox`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS outbox_pending_idx`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS tombstones`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS tombstones_instance_idx`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS backups`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS backups_instance_idx`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	dbErr := mockBroker.createBrokerDbSchemas()
 	if dbErr != nil {
@@ -281,19 +340,26 @@ func TestBrokerProvisionDatabaseSuccess(t *testing.T) {
 			db: db,
 		},
 	}
+	tenant := stubTenants(t, &mockBroker.Broker)
 
 	mockInstance := "instance-" + random(8)
-	fakeDetails := brokerapi.ProvisionDetails{}
+	fakeDetails := brokerapi.ProvisionDetails{
+		PlanID:           "plan-" + random(8),
+		OrganizationGUID: "org-" + random(8),
+		SpaceGUID:        "space-" + random(8),
+	}
 
-	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs (instance, name, state, expires) VALUES ($1, $2, $3, $4)`)).
-		WithArgs(mockInstance, mockDbName, "setup", 0).
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs (instance, name, state, expires, plan, org, space, instance_name, requested_by, started, deadline, parameters, options, extensions) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now(), $10, $11, $12, $13)`)).
+		WithArgs(mockInstance, mockDbName, "setup", 0, fakeDetails.PlanID, fakeDetails.OrganizationGUID, fakeDetails.SpaceGUID, "", "", sqlmock.AnyArg(), nil, []byte("{}"), []byte("null")).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec(fmt.Sprintf("CREATE DATABASE %s", mockDbName)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsolation(mock, tenant, mockDbName)
 	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done' WHERE instance = $1`)).
 		WithArgs(mockInstance).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	expectEvent(mock, "provision", outcomeSucceeded)
 	mockBroker.wg.Add(1)
 	_, dbErr := mockBroker.Provision(mockInstance, fakeDetails, true)
 	mockBroker.wg.Wait()
@@ -324,12 +390,12 @@ func TestBrokerDeprovisionDatabaseSuccess(t *testing.T) {
 	mockInstance := "instance-" + random(8)
 	mockDetails := brokerapi.DeprovisionDetails{}
 
-	dbColumns := []string{"state", "name"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT state, name FROM dbs WHERE instance = $1`)).
-		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow("enabled", mockDbName))
-	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'teardown' WHERE instance = $1`)).
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
 		WithArgs(mockInstance).
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow(mockInstance, mockDbName, "done", "plan-1", "", "org-1", "space-1", "", time.Now(), "", "", "", "", "{}", "null", "", "", "", nil, ""))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'teardown', started = now(), deadline = $2, failed_operation = NULL, failed_step = NULL, failure = NULL WHERE instance = $1`)).
+		WithArgs(mockInstance, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	credsColumns := []string{"name"}
@@ -338,12 +404,11 @@ func TestBrokerDeprovisionDatabaseSuccess(t *testing.T) {
 	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.name FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1`)).
 		WithArgs(mockInstance).
 		WillReturnRows(mockedCredRows)
-	mock.ExpectExec(fmt.Sprintf("REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s", mockDbName, credsRows[0])).
+	mock.ExpectExec(fmt.Sprintf("DROP DATABASE %s", mockDbName)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec(fmt.Sprintf("DROP USER %s", credsRows[0])).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-
-	mock.ExpectExec(fmt.Sprintf("DROP DATABASE %s", mockDbName)).
+	mock.ExpectExec(fmt.Sprintf("DROP ROLE IF EXISTS %s", mockDbName)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM creds WHERE db = $1")).
 		WithArgs(mockDbName).
@@ -352,6 +417,7 @@ func TestBrokerDeprovisionDatabaseSuccess(t *testing.T) {
 		WithArgs(mockInstance).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	expectEvent(mock, "deprovision", outcomeSucceeded)
 	mockBroker.wg.Add(1)
 	_, dbErr := mockBroker.Deprovision(mockInstance, mockDetails, true)
 	mockBroker.wg.Wait()
@@ -384,18 +450,20 @@ func TestBrokerBindDatabaseSuccess(t *testing.T) {
 
 	mockInstance, mockBindingId, mockDetails := "instance-"+random(8), "binding-"+random(8), brokerapi.BindDetails{}
 
-	dbColumns := []string{"name", "state"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state FROM dbs WHERE instance = $1`)).
+	dbColumns := []string{"name", "state", "populated", "shared_db"}
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
 		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done"))
+		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done", false, ""))
 	mock.ExpectExec(`CREATE USER u[0-9|a-z]{16} WITH NOCREATEDB NOCREATEROLE NOREPLICATION PASSWORD \'[0-9|a-z]{64}\'`).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", mockDbName, usernameRegex)).
+	mock.ExpectExec(fmt.Sprintf("GRANT %s TO %s", mockDbName, usernameRegex)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO creds (binding, db, name, pass) VALUES ($1, $2, $3, $4)")).
-		WithArgs(mockBindingId, mockDbName, UsernameArg(), PasswordArg()).
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO creds (binding, db, name, pass, app, requested_by, parameters, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")).
+		WithArgs(mockBindingId, mockDbName, UsernameArg(), PasswordArg(), mockDetails.AppGUID, "", nil, nil).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	expectEvent(mock, "bind", outcomeSucceeded)
 	// TODO: do we want to test the shape of the returned binding?
 	_, dbErr := mockBroker.Bind(mockInstance, mockBindingId, mockDetails)
 
@@ -427,10 +495,12 @@ func TestBrokerBindDatabaseSelectCredsFailure(t *testing.T) {
 	mockDetails := brokerapi.BindDetails{}
 	expectedDbError := errors.New("select creds error")
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state FROM dbs WHERE instance = $1`)).
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
 		WithArgs(mockInstance).
 		WillReturnError(expectedDbError)
 
+	expectEvent(mock, "bind", outcomeFailed)
 	_, dbErr := mockBroker.Bind(mockInstance, mockBindingId, mockDetails)
 	if dbErr == nil {
 		t.Fatalf(`expected error, got: %s`, dbErr)
@@ -459,12 +529,14 @@ func TestBrokerBindDatabaseNotReadyFailure(t *testing.T) {
 	mockBindingId := "binding-" + random(8)
 	mockDetails := brokerapi.BindDetails{}
 
-	dbColumns := []string{"name", "state"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state FROM dbs WHERE instance = $1`)).
+	dbColumns := []string{"name", "state", "populated", "shared_db"}
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
 		WithArgs(mockInstance).
 		// mock state to not equal "done"
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "not ready"))
+		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "not ready", false, ""))
 
+	expectEvent(mock, "bind", outcomeFailed)
 	_, dbErr := mockBroker.Bind(mockInstance, mockBindingId, mockDetails)
 	if dbErr == nil {
 		t.Fatalf(`expected error, got: %s`, dbErr)
@@ -494,13 +566,15 @@ func TestBrokerBindDatabaseCreateUserFailure(t *testing.T) {
 	mockDetails := brokerapi.BindDetails{}
 	expectedDbError := errors.New("create user error")
 
-	dbColumns := []string{"name", "state"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state FROM dbs WHERE instance = $1`)).
+	dbColumns := []string{"name", "state", "populated", "shared_db"}
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
 		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done"))
+		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done", false, ""))
 	mock.ExpectExec(`CREATE USER u[0-9|a-z]{16} WITH NOCREATEDB NOCREATEROLE NOREPLICATION PASSWORD \'[0-9|a-z]{64}\'`).
 		WillReturnError(expectedDbError)
 
+	expectEvent(mock, "bind", outcomeFailed)
 	_, dbErr := mockBroker.Bind(mockInstance, mockBindingId, mockDetails)
 	if dbErr == nil || !errors.Is(dbErr, expectedDbError) {
 		t.Fatalf(`expected error: %s, got: %s`, expectedDbError, dbErr)
@@ -530,17 +604,19 @@ func TestBrokerBindDatabaseGrantPrivilegesFailure(t *testing.T) {
 	mockDetails := brokerapi.BindDetails{}
 	expectedDbError := errors.New("grant privileges error")
 
-	dbColumns := []string{"name", "state"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state FROM dbs WHERE instance = $1`)).
+	dbColumns := []string{"name", "state", "populated", "shared_db"}
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
 		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done"))
+		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done", false, ""))
 	mock.ExpectExec(fmt.Sprintf(`CREATE USER %s WITH NOCREATEDB NOCREATEROLE NOREPLICATION PASSWORD \'%s\'`, usernameRegex, passwordRegex)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", mockDbName, usernameRegex)).
+	mock.ExpectExec(fmt.Sprintf("GRANT %s TO %s", mockDbName, usernameRegex)).
 		WillReturnError(expectedDbError)
 	mock.ExpectExec(fmt.Sprintf("DROP USER %s", usernameRegex)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	expectEvent(mock, "bind", outcomeFailed)
 	_, dbErr := mockBroker.Bind(mockInstance, mockBindingId, mockDetails)
 	if dbErr == nil || !errors.Is(dbErr, expectedDbError) {
 		t.Fatalf(`expected error: %s, got: %s`, expectedDbError, dbErr)
@@ -570,20 +646,22 @@ func TestBrokerBindDatabaseInsertCredentialsFailure(t *testing.T) {
 	mockDetails := brokerapi.BindDetails{}
 	expectedDbError := errors.New("insert credentials error")
 
-	dbColumns := []string{"name", "state"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state FROM dbs WHERE instance = $1`)).
+	dbColumns := []string{"name", "state", "populated", "shared_db"}
+	expectNoBinding(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
 		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done"))
+		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(mockDbName, "done", false, ""))
 	mock.ExpectExec(fmt.Sprintf(`CREATE USER %s WITH NOCREATEDB NOCREATEROLE NOREPLICATION PASSWORD \'%s\'`, usernameRegex, passwordRegex)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", mockDbName, usernameRegex)).
+	mock.ExpectExec(fmt.Sprintf("GRANT %s TO %s", mockDbName, usernameRegex)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO creds (binding, db, name, pass) VALUES ($1, $2, $3, $4)")).
-		WithArgs(mockBindingId, mockDbName, UsernameArg(), PasswordArg()).
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO creds (binding, db, name, pass, app, requested_by, parameters, expires) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")).
+		WithArgs(mockBindingId, mockDbName, UsernameArg(), PasswordArg(), mockDetails.AppGUID, "", nil, nil).
 		WillReturnError(expectedDbError)
 	mock.ExpectExec(fmt.Sprintf("DROP USER %s", usernameRegex)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	expectEvent(mock, "bind", outcomeFailed)
 	_, dbErr := mockBroker.Bind(mockInstance, mockBindingId, mockDetails)
 	if dbErr == nil || !errors.Is(dbErr, expectedDbError) {
 		t.Fatalf(`expected error: %s, got: %s`, expectedDbError, dbErr)
@@ -610,11 +688,12 @@ func TestBrokerUnbindDatabaseSuccess(t *testing.T) {
 
 	mockInstance, mockBindingId, mockDetails := "instance-"+random(8), "binding-"+random(8), brokerapi.UnbindDetails{}
 
-	dbColumns := []string{"state", "name", "db"}
-	dbRowValues := []driver.Value{"done", random(5), mockDbName}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
+	dbColumns := []string{"state", "name", "db", "role"}
+	dbRowValues := []driver.Value{"done", random(5), mockDbName, mockDbName}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
 		WithArgs(mockBindingId).
 		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(dbRowValues...))
+	expectDisableUser(mock, dbRowValues[1])
 	mock.ExpectExec(fmt.Sprintf("REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s", mockDbName, dbRowValues[1])).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec(fmt.Sprintf("DROP USER %s", dbRowValues[1])).
@@ -623,6 +702,7 @@ func TestBrokerUnbindDatabaseSuccess(t *testing.T) {
 		WithArgs(dbRowValues[1]).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	expectEvent(mock, "unbind", outcomeSucceeded)
 	err = mockBroker.Unbind(mockInstance, mockBindingId, mockDetails)
 	if err != nil {
 		t.Fatalf(`unexpected error: %s`, err)
@@ -651,10 +731,11 @@ func TestBrokerUnbindDatabaseSelectCredsFailure(t *testing.T) {
 
 	expectedErr := errors.New("select creds error")
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
 		WithArgs(mockBindingId).
 		WillReturnError(expectedErr)
 
+	expectEvent(mock, "unbind", outcomeFailed)
 	err = mockBroker.Unbind(mockInstance, mockBindingId, mockDetails)
 	if err != expectedErr {
 		t.Fatalf(`expected error: %s, got: %s`, expectedErr, err)
@@ -681,11 +762,12 @@ func TestBrokerUnbindDatabaseSelectCredsEmpty(t *testing.T) {
 
 	mockInstance, mockBindingId, mockDetails := "instance-"+random(8), "binding-"+random(8), brokerapi.UnbindDetails{}
 
-	dbColumns := []string{"state", "name", "db"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
+	dbColumns := []string{"state", "name", "db", "role"}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
 		WithArgs(mockBindingId).
 		WillReturnRows(sqlmock.NewRows(dbColumns))
 
+	expectEvent(mock, "unbind", outcomeFailed)
 	err = mockBroker.Unbind(mockInstance, mockBindingId, mockDetails)
 	if err == nil {
 		t.Fatal("expected error but received nil")
@@ -712,13 +794,14 @@ func TestBrokerUnbindDatabaseNotDoneError(t *testing.T) {
 
 	mockInstance, mockBindingId, mockDetails := "instance-"+random(8), "binding-"+random(8), brokerapi.UnbindDetails{}
 
-	dbColumns := []string{"state", "name", "db"}
+	dbColumns := []string{"state", "name", "db", "role"}
 	// mock "state" value to not be "done"
-	dbRowValues := []driver.Value{"not done", random(5), mockDbName}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
+	dbRowValues := []driver.Value{"not done", random(5), mockDbName, mockDbName}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
 		WithArgs(mockBindingId).
 		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(dbRowValues...))
 
+	expectEvent(mock, "unbind", outcomeFailed)
 	err = mockBroker.Unbind(mockInstance, mockBindingId, mockDetails)
 	if err == nil {
 		t.Fatal("expected error but received nil")
@@ -745,16 +828,18 @@ func TestBrokerUnbindDatabaseRevokePrivilegesError(t *testing.T) {
 
 	mockInstance, mockBindingId, mockDetails := "instance-"+random(8), "binding-"+random(8), brokerapi.UnbindDetails{}
 
-	dbColumns := []string{"state", "name", "db"}
-	dbRowValues := []driver.Value{"done", random(5), mockDbName}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
+	dbColumns := []string{"state", "name", "db", "role"}
+	dbRowValues := []driver.Value{"done", random(5), mockDbName, mockDbName}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
 		WithArgs(mockBindingId).
 		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(dbRowValues...))
 
 	expectedErr := errors.New("revoke privileges error")
+	expectDisableUser(mock, dbRowValues[1])
 	mock.ExpectExec(fmt.Sprintf("REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s", mockDbName, dbRowValues[1])).
 		WillReturnError(expectedErr)
 
+	expectEvent(mock, "unbind", outcomeFailed)
 	err = mockBroker.Unbind(mockInstance, mockBindingId, mockDetails)
 	if !errors.Is(err, expectedErr) {
 		t.Fatalf(`expected error %s to wrap %s`, err, expectedErr)
@@ -766,6 +851,13 @@ func TestBrokerUnbindDatabaseRevokePrivilegesError(t *testing.T) {
 	}
 }
 
+func expectDisableUser(mock sqlmock.Sqlmock, user driver.Value) {
+	mock.ExpectExec(fmt.Sprintf("REVOKE %s FROM %s", mockDbName, user)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(fmt.Sprintf("ALTER ROLE %s NOLOGIN", user)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
 func TestBrokerUnbindDatabaseDropUserFailure(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -781,25 +873,26 @@ func TestBrokerUnbindDatabaseDropUserFailure(t *testing.T) {
 
 	mockInstance, mockBindingId, mockDetails := "instance-"+random(8), "binding-"+random(8), brokerapi.UnbindDetails{}
 
-	dbColumns := []string{"state", "name", "db"}
-	dbRowValues := []driver.Value{"done", random(5), mockDbName}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
+	dbColumns := []string{"state", "name", "db", "role"}
+	dbRowValues := []driver.Value{"done", random(5), mockDbName, mockDbName}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
 		WithArgs(mockBindingId).
 		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(dbRowValues...))
+	expectDisableUser(mock, dbRowValues[1])
 	mock.ExpectExec(fmt.Sprintf("REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s", mockDbName, dbRowValues[1])).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
+	// a user that can't be dropped fails the unbind (and the binding is
+	// kept), rather than being left behind; it can no longer log in, or
+	// use the instance role, either way
 	dropUserErr := errors.New("drop user error")
 	mock.ExpectExec(fmt.Sprintf("DROP USER %s", dbRowValues[1])).
 		WillReturnError(dropUserErr)
 
-	// error to DROP USER **should not** cause unbind to fail.
-	// for example: DROP USER may fail if there are still database objects
-	// created/owned by that user, which cannot be resolved without deleting
-	// those objects
+	expectEvent(mock, "unbind", outcomeFailed)
 	err = mockBroker.Unbind(mockInstance, mockBindingId, mockDetails)
-	if err != nil {
-		t.Fatalf("unexpected err: %s", err)
+	if !errors.Is(err, dropUserErr) {
+		t.Fatalf(`expected error %v to wrap %s`, err, dropUserErr)
 	}
 
 	// we make sure that all expectations were met
@@ -823,11 +916,12 @@ func TestBrokerUnbindDatabaseDeleteCredsFailure(t *testing.T) {
 
 	mockInstance, mockBindingId, mockDetails := "instance-"+random(8), "binding-"+random(8), brokerapi.UnbindDetails{}
 
-	dbColumns := []string{"state", "name", "db"}
-	dbRowValues := []driver.Value{"done", random(5), mockDbName}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
+	dbColumns := []string{"state", "name", "db", "role"}
+	dbRowValues := []driver.Value{"done", random(5), mockDbName, mockDbName}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT dbs.state, creds.name, COALESCE(dbs.shared_db, creds.db), creds.db FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE creds.binding = $1`)).
 		WithArgs(mockBindingId).
 		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(dbRowValues...))
+	expectDisableUser(mock, dbRowValues[1])
 	mock.ExpectExec(fmt.Sprintf("REVOKE ALL PRIVILEGES ON DATABASE %s FROM %s", mockDbName, dbRowValues[1])).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec(fmt.Sprintf("DROP USER %s", dbRowValues[1])).
@@ -838,6 +932,7 @@ func TestBrokerUnbindDatabaseDeleteCredsFailure(t *testing.T) {
 		WithArgs(dbRowValues[1]).
 		WillReturnError(deleteCredsErr)
 
+	expectEvent(mock, "unbind", outcomeSucceeded)
 	err = mockBroker.Unbind(mockInstance, mockBindingId, mockDetails)
 	if err != nil {
 		t.Fatalf("unexpected err: %s", err)
@@ -849,6 +944,8 @@ func TestBrokerUnbindDatabaseDeleteCredsFailure(t *testing.T) {
 	}
 }
 
+var stateColumns = []string{"state", "failed_operation", "failed_step", "failure", "overdue", "expires"}
+
 func TestBrokerLastOperationSuccess(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -864,16 +961,89 @@ func TestBrokerLastOperationSuccess(t *testing.T) {
 
 	mockInstance := "instance-" + random(8)
 
-	dbColumns := []string{"state"}
-	dbRowValues := []driver.Value{"done"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT state FROM dbs WHERE instance = $1`)).
+	dbRowValues := []driver.Value{"done", "", "", "", false, 0}
+	mock.ExpectQuery(`SELECT state, .* FROM dbs WHERE instance = \$1`).
 		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(dbRowValues...))
+		WillReturnRows(sqlmock.NewRows(stateColumns).AddRow(dbRowValues...))
 
-	_, err = mockBroker.LastOperation(mockInstance)
+	lastOperation, err := mockBroker.LastOperation(mockInstance)
 	if err != nil {
 		t.Fatalf(`unexpected error: %s`, err)
 	}
+	if lastOperation.State != "succeeded" || lastOperation.Description != "The database is ready." {
+		t.Fatalf("unexpected operation: %v", lastOperation)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestBrokerLastOperationRestoring(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mockBroker := &MockBroker{
+		Broker: Broker{
+			db: db,
+		},
+	}
+
+	mockInstance := "instance-" + random(8)
+
+	mock.ExpectQuery(`SELECT state, .* FROM dbs WHERE instance = \$1`).
+		WithArgs(mockInstance).
+		WillReturnRows(sqlmock.NewRows(stateColumns).AddRow("restoring", "", "", "", false, 0))
+
+	lastOperation, err := mockBroker.LastOperation(mockInstance)
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if lastOperation.State != "in progress" || lastOperation.Description != "Restoring the database from a backup." {
+		t.Fatalf("unexpected operation: %v", lastOperation)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestBrokerLastOperationFailedDescription(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mockBroker := &MockBroker{
+		Broker: Broker{
+			db: db,
+		},
+	}
+
+	mockInstance := "instance-" + random(8)
+	expectedOperation := brokerapi.LastOperation{
+		State:       "failed",
+		Description: "Creating the database failed while creating instance database: the database server could not be reached.  Please contact your operator.",
+	}
+
+	dbRowValues := []driver.Value{"failed", "provision", "creating instance database", "dial tcp 10.0.0.5:5432: i/o timeout", false, 0}
+	mock.ExpectQuery(`SELECT state, .* FROM dbs WHERE instance = \$1`).
+		WithArgs(mockInstance).
+		WillReturnRows(sqlmock.NewRows(stateColumns).AddRow(dbRowValues...))
+
+	lastOperation, err := mockBroker.LastOperation(mockInstance)
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if lastOperation != expectedOperation {
+		t.Fatalf("expected operation: %s, received: %s", expectedOperation, lastOperation)
+	}
 
 	// we make sure that all expectations were met
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -896,9 +1066,9 @@ func TestBrokerLastOperationQueryFailure(t *testing.T) {
 
 	mockInstance := "instance-" + random(8)
 	expectedErr := errors.New("select query error")
-	expectedOperation := brokerapi.LastOperation{State: "failed"}
+	expectedOperation := brokerapi.LastOperation{State: "failed", Description: "Unable to determine the state of this database."}
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT state FROM dbs WHERE instance = $1`)).
+	mock.ExpectQuery(`SELECT state, .* FROM dbs WHERE instance = \$1`).
 		WithArgs(mockInstance).
 		WillReturnError(expectedErr)
 
@@ -930,12 +1100,11 @@ func TestBrokerLastOperationNoResultsFailure(t *testing.T) {
 	}
 
 	mockInstance := "instance-" + random(8)
-	expectedOperation := brokerapi.LastOperation{State: "failed"}
+	expectedOperation := brokerapi.LastOperation{State: "failed", Description: "Unable to determine the state of this database."}
 
-	dbColumns := []string{"state"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT state FROM dbs WHERE instance = $1`)).
+	mock.ExpectQuery(`SELECT state, .* FROM dbs WHERE instance = \$1`).
 		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns))
+		WillReturnRows(sqlmock.NewRows(stateColumns))
 
 	lastOperation, err := mockBroker.LastOperation(mockInstance)
 	if err != nil {
@@ -966,11 +1135,10 @@ func TestBrokerLastOperationUnexpectedState(t *testing.T) {
 
 	mockInstance := "instance-" + random(8)
 
-	dbColumns := []string{"state"}
-	dbRowValues := []driver.Value{"unexpected"}
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT state FROM dbs WHERE instance = $1`)).
+	dbRowValues := []driver.Value{"unexpected", "", "", "", false, 0}
+	mock.ExpectQuery(`SELECT state, .* FROM dbs WHERE instance = \$1`).
 		WithArgs(mockInstance).
-		WillReturnRows(sqlmock.NewRows(dbColumns).AddRow(dbRowValues...))
+		WillReturnRows(sqlmock.NewRows(stateColumns).AddRow(dbRowValues...))
 
 	_, err = mockBroker.LastOperation(mockInstance)
 	if err == nil {
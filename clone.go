@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// cloneSource looks up the instance that a developer wants a new one
+// cloned from, making sure that it lives in the same org and space.
+func (b *Broker) cloneSource(plan Plan, params ProvisionParameters, details brokerapi.ProvisionDetails) (*Instance, error) {
+	if plan.Mode == "schema" {
+		return nil, parameterError("this plan does not support cloning")
+	}
+	if params.Encoding != "" || params.Locale != "" || params.CollationProvider != "" || params.Template != "" {
+		return nil, parameterError("a clone always has the same encoding, locale, collation provider and template as the instance it was cloned from")
+	}
+
+	source, err := b.GetInstance(params.CloneFrom)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up instance %s: %w", params.CloneFrom, err)
+	}
+	/* don't let on that instances in other spaces exist */
+	if source == nil || source.State == "gone" || details.OrganizationGUID == "" ||
+		source.Organization != details.OrganizationGUID || source.Space != details.SpaceGUID {
+		return nil, parameterError("there is no instance '%s' in this space to clone", params.CloneFrom)
+	}
+	if source.State != "done" {
+		return nil, parameterError("instance '%s' is in '%s' state, and cannot be cloned", params.CloneFrom, source.State)
+	}
+	if source.SharedDatabase != "" {
+		return nil, parameterError("instance '%s' is a schema in a shared database, and cannot be cloned", params.CloneFrom)
+	}
+	return source, nil
+}
+
+// clone creates a new instance database as a copy of its source's,
+// returning the step that failed, if any.  Copying the database as a
+// template is quickest, but only works when nobody is connected to it;
+// otherwise we fall back to dumping and restoring it.  Either way, the
+// copy still belongs to the source instance's roles until it's adopted.
+func (b *Broker) clone(ctx context.Context, inst Instance) (string, error) {
+	source, err := b.GetInstance(inst.Source)
+	if err == nil && (source == nil || source.State == "gone") {
+		err = fmt.Errorf("instance %s no longer exists", inst.Source)
+	}
+	if err != nil {
+		return "looking up the source instance", err
+	}
+	if _, err := b.exec(ctx, `UPDATE dbs SET source = $2 WHERE instance = $1`, inst.ID, source.ID); err != nil {
+		return "recording the source instance", err
+	}
+
+	var sessions int
+	sctx, cancel := b.statement(ctx)
+	err = b.backend().QueryRowContext(sctx, `SELECT count(*) FROM pg_stat_activity WHERE datname = $1`, source.Database).Scan(&sessions)
+	cancel()
+	if err != nil {
+		return "checking for sessions on the source database", err
+	}
+
+	copied := false
+	if sessions == 0 {
+		err := b.createAfresh(ctx, inst.Database, ` TEMPLATE `+source.Database)
+		switch {
+		case err == nil:
+			copied = true
+		case isPqError(err, "55006"):
+			/* somebody connected in the meantime */
+		default:
+			return "copying the source database", err
+		}
+	}
+	if !copied {
+		info("%s has open sessions, so cloning it into %s by dump and restore\n", source.Database, inst.Database)
+		if step, err := b.dumpAndRestore(ctx, source.Database, inst); err != nil {
+			return step, err
+		}
+	}
+	return "", nil
+}
+
+// createAfresh creates a new instance database.  One left behind by an
+// earlier attempt may not have been filled in all the way before that
+// attempt died, so rather than trust it, it is dropped and started over.
+func (b *Broker) createAfresh(ctx context.Context, db, clause string) error {
+	_, err := b.execBackend(ctx, `CREATE DATABASE `+db+clause)
+	if !isPqError(err, "42P04") {
+		return err
+	}
+	info("instance database %s already exists, so starting it over\n", db)
+	if _, err := b.execBackend(ctx, `DROP DATABASE `+db); err != nil {
+		return err
+	}
+	_, err = b.execBackend(ctx, `CREATE DATABASE `+db+clause)
+	return err
+}
+
+// dumpAndRestore copies one database into a new one, with pg_dump and
+// psql.  A failed restore drops the new database, so that a retry can
+// start over.
+func (b *Broker) dumpAndRestore(ctx context.Context, from string, inst Instance) (string, error) {
+	if err := b.createAfresh(ctx, inst.Database, inst.Options.clause()); err != nil {
+		return "creating instance database", err
+	}
+
+	if err := b.pipe(ctx,
+		exec.CommandContext(ctx, b.PgDump, "--no-owner", "--no-privileges", "--dbname", from),
+		exec.CommandContext(ctx, b.Psql, "--quiet", "--no-psqlrc", "--single-transaction", "--set", "ON_ERROR_STOP=1", "--dbname", inst.Database),
+	); err != nil {
+		b.execBackend(ctx, `DROP DATABASE `+inst.Database)
+		return "restoring a dump of the source database", err
+	}
+	return "", nil
+}
+
+// pipe runs one PostgreSQL client program into another, connected to
+// the backend as the broker.
+func (b *Broker) pipe(ctx context.Context, from, to *exec.Cmd) error {
+	var stderr bytes.Buffer
+	for _, cmd := range []*exec.Cmd{from, to} {
+		cmd.Env = b.clientEnv()
+		cmd.Stderr = &stderr
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	from.Stdout = w
+	to.Stdin = r
+	if err := from.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return err
+	}
+	if err := to.Start(); err != nil {
+		r.Close()
+		w.Close()
+		from.Wait()
+		return err
+	}
+	/* the children have their own copies; closing ours lets each of
+	   them see the other one go away */
+	r.Close()
+	w.Close()
+
+	ferr := from.Wait()
+	terr := to.Wait()
+	for _, err := range []error{ferr, terr} {
+		if err != nil {
+			return clientError(err, &stderr)
+		}
+	}
+	return nil
+}
+
+// clientEnv is the environment PostgreSQL client programs need to
+// connect to the backend as the broker.
+func (b *Broker) clientEnv() []string {
+	return append(os.Environ(), "PGHOST="+b.Host, "PGPORT="+b.Port, "PGUSER="+b.Username, "PGPASSWORD="+b.Password)
+}
+
+// clientError explains why a client program failed, in its own words
+// if it had any.
+func clientError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s: %s", err, msg)
+	}
+	return err
+}
+
+// revokeAll takes away everything a role was granted in the schemas of
+// the database it is run in (but nowhere else).
+func revokeAll(role string) string {
+	role = pq.QuoteIdentifier(role)
+	return `DO $$
+DECLARE s name;
+BEGIN
+	FOR s IN SELECT nspname FROM pg_namespace WHERE nspname !~ '^pg_' AND nspname <> 'information_schema' LOOP
+		EXECUTE format('REVOKE ALL ON ALL FUNCTIONS IN SCHEMA %I FROM ` + role + `', s);
+		EXECUTE format('REVOKE ALL ON ALL SEQUENCES IN SCHEMA %I FROM ` + role + `', s);
+		EXECUTE format('REVOKE ALL ON ALL TABLES IN SCHEMA %I FROM ` + role + `', s);
+		EXECUTE format('REVOKE ALL ON SCHEMA %I FROM ` + role + `', s);
+	END LOOP;
+END $$`
+}
+
+// adopt hands everything in a cloned database over to its instance
+// role, taking it away from the source instance's roles, so that the
+// new instance's own bindings have access to it through that role.
+func (b *Broker) adopt(ctx context.Context, db string) error {
+	conn, err := b.tenant(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+
+	r, err := conn.QueryContext(sctx, `SELECT DISTINCT r.rolname FROM pg_shdepend d INNER JOIN pg_roles r ON r.oid = d.refobjid
+ WHERE d.dbid = (SELECT oid FROM pg_database WHERE datname = current_database()) AND r.rolname NOT IN (current_user, $1)`, db)
+	if err != nil {
+		return err
+	}
+	var roles []string
+	for r.Next() {
+		var role string
+		if err := r.Scan(&role); err != nil {
+			r.Close()
+			return err
+		}
+		roles = append(roles, role)
+	}
+	r.Close()
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if _, err := conn.ExecContext(sctx, `REASSIGN OWNED BY `+pq.QuoteIdentifier(role)+` TO `+db); err != nil {
+			return err
+		}
+		/* not DROP OWNED, which would also take away the role's rights
+		   to shared objects, like the source instance's own database */
+		if _, err := conn.ExecContext(sctx, revokeAll(role)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
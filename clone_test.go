@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/pivotal-golang/lager"
+)
+
+func expectSourceInstance(mock sqlmock.Sqlmock, state, space string) {
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WithArgs("source-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("source-1", "sourceDbName", state, "plan-id", "", "org-id", space, "", time.Now(), "", "", "", "", `{"encoding":"UTF8"}`, `["pgcrypto"]`, "", "", "", nil, ""))
+}
+
+func TestAPIProvisionCloneRefusesOtherInstances(t *testing.T) {
+	testCases := map[string]struct {
+		params string
+		state  string
+		space  string
+	}{
+		"other space":      {params: `{"clone_from": "source-1"}`, state: "done", space: "other-space-id"},
+		"not ready":        {params: `{"clone_from": "source-1"}`, state: "setup", space: "space-id"},
+		"creation options": {params: `{"clone_from": "source-1", "encoding": "UTF8"}`},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			broker, mock, _ := tenantBroker(t)
+			defer broker.db.Close()
+
+			if test.state != "" {
+				expectSourceInstance(mock, test.state, test.space)
+			}
+			expectEvent(mock, "provision", outcomeFailed)
+
+			router := mux.NewRouter()
+			AttachRoutes(router, broker, lager.NewLogger("test"))
+
+			req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1?accepts_incomplete=true",
+				strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id","organization_guid":"org-id","space_guid":"space-id","parameters":`+test.params+`}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusBadRequest, w.Code, w.Body.String())
+			}
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSetupClonesByTemplate(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSourceInstance(mock, "done", "space-id")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET source = $2 WHERE instance = $1`)).
+		WithArgs("instance-1", "source-1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM pg_stat_activity WHERE datname = $1`)).
+		WithArgs("sourceDbName").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName + ` TEMPLATE sourceDbName`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsolation(mock, tenant, mockDbName)
+	tenant.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT r.rolname FROM pg_shdepend`)).
+		WithArgs(mockDbName).
+		WillReturnRows(sqlmock.NewRows([]string{"rolname"}).AddRow("u0123456789abcdef"))
+	tenant.ExpectExec(regexp.QuoteMeta(`REASSIGN OWNED BY "u0123456789abcdef" TO ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON SCHEMA %I FROM "u0123456789abcdef"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'setup'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "provision", outcomeSucceeded)
+
+	broker.Setup(Instance{ID: "instance-1", Database: mockDbName, Plan: "plan-id", Source: "source-1"})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetupClonesByDumpAndRestore(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+	broker.PgDump = "true"
+	broker.Psql = "true"
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSourceInstance(mock, "done", "space-id")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET source = $2 WHERE instance = $1`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM pg_stat_activity WHERE datname = $1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName + ` ENCODING 'UTF8'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsolation(mock, tenant, mockDbName)
+	tenant.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT r.rolname FROM pg_shdepend`)).
+		WillReturnRows(sqlmock.NewRows([]string{"rolname"}))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'setup'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "provision", outcomeSucceeded)
+
+	broker.Setup(Instance{ID: "instance-1", Database: mockDbName, Plan: "plan-id", Source: "source-1", Options: DatabaseOptions{Encoding: "UTF8"}})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetupStartsCloneOverOnRetry(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectSourceInstance(mock, "done", "space-id")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET source = $2 WHERE instance = $1`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM pg_stat_activity WHERE datname = $1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	/* an earlier attempt may have died halfway through a restore */
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName + ` TEMPLATE sourceDbName`)).
+		WillReturnError(&pq.Error{Code: "42P04", Message: "database already exists"})
+	mock.ExpectExec(`^` + regexp.QuoteMeta(`DROP DATABASE `+mockDbName) + `$`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName + ` TEMPLATE sourceDbName`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsolation(mock, tenant, mockDbName)
+	tenant.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT r.rolname FROM pg_shdepend`)).
+		WillReturnRows(sqlmock.NewRows([]string{"rolname"}))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'setup'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "provision", outcomeSucceeded)
+
+	broker.Setup(Instance{ID: "instance-1", Database: mockDbName, Plan: "plan-id", Source: "source-1"})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdoptKeepsSourceRolesRights(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	tenant.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT r.rolname FROM pg_shdepend`)).
+		WillReturnRows(sqlmock.NewRows([]string{"rolname"}).AddRow("sourceDbName").AddRow("u0123456789abcdef"))
+	for _, role := range []string{"sourceDbName", "u0123456789abcdef"} {
+		tenant.ExpectExec(`^` + regexp.QuoteMeta(`REASSIGN OWNED BY "`+role+`" TO `+mockDbName) + `$`).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		tenant.ExpectExec(`^` + regexp.QuoteMeta(revokeAll(role)) + `$`).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	if err := broker.adopt(context.Background(), mockDbName); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	for _, role := range []string{"sourceDbName", "u0123456789abcdef"} {
+		if !strings.Contains(revokeAll(role), `REVOKE ALL ON ALL TABLES IN SCHEMA %I FROM "`+role+`"`) || strings.Contains(revokeAll(role), "DROP") {
+			t.Fatalf(`unexpected revocation for %s: %s`, role, revokeAll(role))
+		}
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	outcomeAccepted  string = "accepted"
+	outcomeSucceeded string = "succeeded"
+	outcomeFailed    string = "failed"
+)
+
+// Event is a single, append-only entry in the audit log of everything
+// the broker (and its operators) have done.
+type Event struct {
+	ID        int64     `json:"id"`
+	At        time.Time `json:"at"`
+	Operation string    `json:"operation"`
+	Instance  string    `json:"instance,omitempty"`
+	Binding   string    `json:"binding,omitempty"`
+	Plan      string    `json:"plan,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type EventFilter struct {
+	Instance  string
+	Binding   string
+	Operation string
+	Identity  string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (b *Broker) createEventSchemas() {
+	b.db.Exec(`
+CREATE TABLE IF NOT EXISTS
+events (
+  id        BIGSERIAL PRIMARY KEY,
+  at        TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  operation TEXT NOT NULL,
+  instance  TEXT,
+  binding   TEXT,
+  plan      TEXT,
+  identity  TEXT,
+  outcome   TEXT NOT NULL,
+  error     TEXT
+)`)
+	b.db.Exec(`CREATE INDEX IF NOT EXISTS events_instance_idx ON events (instance)`)
+	b.db.Exec(`CREATE INDEX IF NOT EXISTS events_at_idx ON events (at)`)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func outcome(err error, ok string) string {
+	if err != nil {
+		return outcomeFailed
+	}
+	return ok
+}
+
+func (b *Broker) record(e Event) {
+	/* the plan can usually be found from the instance, if the caller doesn't know it */
+	_, err := b.exec(context.Background(), `INSERT INTO events (operation, instance, binding, plan, identity, outcome, error)
+VALUES ($1, $2, $3, COALESCE(NULLIF($4, ''), (SELECT plan FROM dbs WHERE instance = $2 LIMIT 1)), $5, $6, $7)`,
+		e.Operation, e.Instance, e.Binding, e.Plan, e.Identity, e.Outcome, e.Error)
+	if err != nil {
+		oops("failed to record %s %s event for instance [%s]: %s\n", e.Operation, e.Outcome, e.Instance, err)
+	}
+}
+
+func (b *Broker) Events(filter EventFilter) ([]Event, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+
+	if filter.Instance != "" {
+		add(`instance = $%d`, filter.Instance)
+	}
+	if filter.Binding != "" {
+		add(`binding = $%d`, filter.Binding)
+	}
+	if filter.Operation != "" {
+		add(`operation = $%d`, filter.Operation)
+	}
+	if filter.Identity != "" {
+		add(`identity = $%d`, filter.Identity)
+	}
+	if !filter.Since.IsZero() {
+		add(`at >= $%d`, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add(`at < $%d`, filter.Until)
+	}
+
+	query := `SELECT id, at, operation, COALESCE(instance, ''), COALESCE(binding, ''), COALESCE(plan, ''),
+       COALESCE(identity, ''), outcome, COALESCE(error, '') FROM events`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY id`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, filter.Limit)
+	}
+
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+	r, err := b.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Event, 0)
+	for r.Next() {
+		var e Event
+		if err := r.Scan(&e.ID, &e.At, &e.Operation, &e.Instance, &e.Binding, &e.Plan,
+			&e.Identity, &e.Outcome, &e.Error); err != nil {
+			return nil, err
+		}
+		l = append(l, e)
+	}
+	return l, r.Err()
+}
+
+func (b *Broker) PurgeEvents() {
+	if b.EventRetention <= 0 {
+		return
+	}
+
+	r, err := b.exec(context.Background(), `DELETE FROM events WHERE at < $1`, time.Now().Add(-b.EventRetention))
+	if err != nil {
+		oops("failed to purge audit events older than %s: %s\n", b.EventRetention, err)
+		return
+	}
+	if n, _ := r.RowsAffected(); n > 0 {
+		info("purged %d audit events older than %s\n", n, b.EventRetention)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+var eventRowColumns = []string{"id", "at", "operation", "instance", "binding", "plan", "identity", "outcome", "error"}
+
+func TestEventsFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	broker := &Broker{db: db}
+	since := time.Now().Add(-time.Hour)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM events WHERE instance = $1 AND operation = $2 AND at >= $3 ORDER BY id LIMIT 10`)).
+		WithArgs("instance-1", "deprovision", since).
+		WillReturnRows(sqlmock.NewRows(eventRowColumns).
+			AddRow(1, time.Now(), "deprovision", "instance-1", "", "plan-1", "cloudfoundry:user-1", outcomeAccepted, "").
+			AddRow(2, time.Now(), "deprovision", "instance-1", "", "plan-1", "", outcomeSucceeded, ""))
+
+	l, err := broker.Events(EventFilter{
+		Instance:  "instance-1",
+		Operation: "deprovision",
+		Since:     since,
+		Limit:     10,
+	})
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if len(l) != 2 || l[0].Identity != "cloudfoundry:user-1" || l[1].Outcome != outcomeSucceeded {
+		t.Fatalf(`unexpected events: %v`, l)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	/* no retention policy means no purging */
+	broker := &Broker{db: db}
+	broker.PurgeEvents()
+
+	broker.EventRetention = 24 * time.Hour
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM events WHERE at < $1`)).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 42))
+	broker.PurgeEvents()
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminExportEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, &Broker{db: db})
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM events ORDER BY id`)).
+		WillReturnRows(sqlmock.NewRows(eventRowColumns).
+			AddRow(1, time.Now(), "provision", "instance-1", "", "plan-1", "", outcomeAccepted, "").
+			AddRow(2, time.Now(), "provision", "instance-1", "", "plan-1", "", outcomeFailed, "failed creating instance database: boom"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/events?format=jsonl", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusOK, w.Code)
+	}
+
+	var l []Event
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf(`unexpected error decoding '%s': %s`, scanner.Text(), err)
+		}
+		l = append(l, e)
+	}
+	if len(l) != 2 || l[1].Error != "failed creating instance database: boom" {
+		t.Fatalf(`unexpected events: %v`, l)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/events?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf(`expected status %d, got: %d`, http.StatusBadRequest, w.Code)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
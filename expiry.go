@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BindParameters are the parameters developers may pass when binding
+// (`cf bind-service -c ...` or `cf create-service-key -c ...`).
+// Anything else is kept with the binding, but otherwise ignored.
+type BindParameters struct {
+	TTL       string `json:"ttl"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+func parseBindParameters(raw json.RawMessage) (BindParameters, error) {
+	var params BindParameters
+	if len(raw) == 0 || string(raw) == "null" {
+		return params, nil
+	}
+	if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&params); err != nil {
+		return params, parameterError("invalid parameters: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return params, nil
+}
+
+func (p *Plan) validateTTL() error {
+	if p.MaxServiceKeyTTL == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(p.MaxServiceKeyTTL)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("plan '%s' has an invalid max_service_key_ttl '%s' (try i.e. 24h)", p.Name, p.MaxServiceKeyTTL)
+	}
+	p.maxKeyTTL = d
+	return nil
+}
+
+// expiry works out when a new binding's credentials stop working, if
+// ever.  Service keys (bindings without an app) on plans that limit
+// them last as long as the plan allows, unless they ask for less.
+func (p Plan) expiry(params BindParameters, app string, now time.Time) (*time.Time, error) {
+	var until time.Time
+	switch {
+	case params.TTL != "" && params.ExpiresAt != "":
+		return nil, parameterError("a binding can have a ttl or an expires_at, but not both")
+	case params.TTL != "":
+		d, err := time.ParseDuration(params.TTL)
+		if err != nil || d <= 0 {
+			return nil, parameterError("invalid ttl '%s' (try i.e. 4h)", params.TTL)
+		}
+		until = now.Add(d)
+	case params.ExpiresAt != "":
+		t, err := time.Parse(time.RFC3339, params.ExpiresAt)
+		if err != nil {
+			return nil, parameterError("invalid expires_at '%s' (try i.e. %s)", params.ExpiresAt, now.Add(24*time.Hour).UTC().Format(time.RFC3339))
+		}
+		if !t.After(now) {
+			return nil, parameterError("expires_at '%s' has already passed", params.ExpiresAt)
+		}
+		until = t
+	}
+
+	if app == "" && p.maxKeyTTL > 0 {
+		latest := now.Add(p.maxKeyTTL)
+		if until.IsZero() {
+			until = latest
+		} else if until.After(latest) {
+			return nil, parameterError("this plan's service keys can last at most %s", p.maxKeyTTL)
+		}
+	}
+	if until.IsZero() {
+		return nil, nil
+	}
+	until = until.Truncate(time.Second)
+	return &until, nil
+}
+
+// validUntil renders a binding's expiry as the tail of a CREATE USER
+// statement.
+func validUntil(expires *time.Time) string {
+	if expires == nil {
+		return ""
+	}
+	return " VALID UNTIL " + quoteLiteral(expires.UTC().Format(time.RFC3339))
+}
+
+// DropExpiredBindings drops the users of bindings whose credentials
+// have expired; the backend already refuses to let them log in, but
+// any sessions they have open are left alone until now.
+func (b *Broker) DropExpiredBindings() {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `
+SELECT creds.binding, dbs.instance, creds.name, creds.db, COALESCE(dbs.shared_db, '')
+  FROM creds INNER JOIN dbs ON creds.db = dbs.name
+ WHERE creds.state = 'done' AND creds.expires < now()`)
+	if err != nil {
+		oops("failed to check for expired bindings: %s\n", err)
+		return
+	}
+	var expired []Binding
+	for r.Next() {
+		var (
+			binding Binding
+			shared  string
+		)
+		if err := r.Scan(&binding.ID, &binding.Instance, &binding.Username, &binding.Database, &shared); err != nil {
+			oops("failed to check for expired bindings: %s\n", err)
+			r.Close()
+			return
+		}
+		binding.ID = strings.TrimSpace(binding.ID)
+		binding.Instance = strings.TrimSpace(binding.Instance)
+		binding.Username = strings.TrimSpace(binding.Username)
+		binding.Database = strings.TrimSpace(binding.Database)
+		if shared = strings.TrimSpace(shared); shared != "" {
+			binding.Database, binding.Schema = shared, binding.Database
+		}
+		expired = append(expired, binding)
+	}
+	r.Close()
+
+	for _, binding := range expired {
+		ctx, cancel := operation(b.DeprovisionTimeout)
+		err := b.dropExpired(ctx, binding)
+		cancel()
+		b.record(Event{
+			Operation: "expire",
+			Instance:  binding.Instance,
+			Binding:   binding.ID,
+			Identity:  "janitor",
+			Outcome:   outcome(err, outcomeSucceeded),
+			Error:     errorString(err),
+		})
+		if err != nil {
+			oops("failed to drop user %s of expired binding %s: %s\n", binding.Username, binding.ID, err)
+			continue
+		}
+		info("dropped user %s of expired binding %s\n", binding.Username, binding.ID)
+		b.notify("binding.expired", binding)
+	}
+}
+
+// dropExpired drops an expired binding's user the same way an unbind
+// would; the binding is only forgotten once its user is gone, so that
+// a failure leaves it to be tried again on the next pass.
+func (b *Broker) dropExpired(ctx context.Context, binding Binding) error {
+	if _, err := b.execBackend(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1`, binding.Username); err != nil {
+		return fmt.Errorf("failed terminating sessions: %w", err)
+	}
+	role := binding.Database
+	if binding.Schema != "" {
+		role = binding.Schema
+	}
+	if step, err := b.dropUser(ctx, role, binding.Database, binding.Username); err != nil {
+		return fmt.Errorf("failed %s: %w", step, err)
+	}
+	_, err := b.exec(ctx, `DELETE FROM creds WHERE binding = $1`, binding.ID)
+	return err
+}
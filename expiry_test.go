@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestBindingExpiry(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	limited := Plan{Name: "small", MaxServiceKeyTTL: "24h"}
+	if err := limited.validateTTL(); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	testCases := map[string]struct {
+		plan    Plan
+		params  BindParameters
+		app     string
+		expires string
+		fails   bool
+	}{
+		"forever":                {plan: Plan{}},
+		"ttl":                    {plan: Plan{}, params: BindParameters{TTL: "90m"}, expires: "2024-03-01T13:30:00Z"},
+		"expires_at":             {plan: Plan{}, params: BindParameters{ExpiresAt: "2024-03-02T00:00:00Z"}, expires: "2024-03-02T00:00:00Z"},
+		"both":                   {plan: Plan{}, params: BindParameters{TTL: "1h", ExpiresAt: "2024-03-02T00:00:00Z"}, fails: true},
+		"bad ttl":                {plan: Plan{}, params: BindParameters{TTL: "a while"}, fails: true},
+		"negative ttl":           {plan: Plan{}, params: BindParameters{TTL: "-1h"}, fails: true},
+		"past expires_at":        {plan: Plan{}, params: BindParameters{ExpiresAt: "2024-02-01T00:00:00Z"}, fails: true},
+		"service key default":    {plan: limited, expires: "2024-03-02T12:00:00Z"},
+		"service key within max": {plan: limited, params: BindParameters{TTL: "1h"}, expires: "2024-03-01T13:00:00Z"},
+		"service key past max":   {plan: limited, params: BindParameters{TTL: "48h"}, fails: true},
+		"app binding past max":   {plan: limited, app: "app-1", params: BindParameters{TTL: "48h"}, expires: "2024-03-03T12:00:00Z"},
+		"app binding has no max": {plan: limited, app: "app-1"},
+	}
+	for name, tc := range testCases {
+		expires, err := tc.plan.expiry(tc.params, tc.app, now)
+		if tc.fails {
+			if err == nil {
+				t.Errorf(`%s: expected an error`, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(`%s: unexpected error: %s`, name, err)
+			continue
+		}
+		got := ""
+		if expires != nil {
+			got = expires.UTC().Format(time.RFC3339)
+		}
+		if got != tc.expires {
+			t.Errorf(`%s: expected expiry '%s', got '%s'`, name, tc.expires, got)
+		}
+	}
+}
+
+func TestGrantExpiringBinding(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	expires := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "state", "populated", "shared_db"}).AddRow(mockDbName, "done", false, ""))
+	mock.ExpectExec(regexp.QuoteMeta(`NOREPLICATION PASSWORD '`) + `[0-9a-zA-Z]{64}` + regexp.QuoteMeta(`' VALID UNTIL '2024-03-02T00:00:00Z'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`GRANT ` + mockDbName + ` TO u[0-9a-z]{16}`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO creds`)).
+		WithArgs("binding-1", mockDbName, UsernameArg(), PasswordArg(), "", "", nil, expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if _, _, err := broker.Grant("instance-1", Binding{ID: "binding-1", Expires: &expires}); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDropExpiredBindings(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.binding, dbs.instance, creds.name, creds.db, COALESCE(dbs.shared_db, '')`)).
+		WillReturnRows(sqlmock.NewRows([]string{"binding", "instance", "name", "db", "shared_db"}).
+			AddRow("binding-1                           ", "instance-1                          ", "u0123456789abcdef", mockDbName+"                              ", ""))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1`)).
+		WithArgs("u0123456789abcdef").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ` + mockDbName + ` FROM u0123456789abcdef`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u0123456789abcdef NOLOGIN`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL PRIVILEGES ON DATABASE ` + mockDbName + ` FROM u0123456789abcdef`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP USER u0123456789abcdef`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM creds WHERE binding = $1`)).
+		WithArgs("binding-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).
+		WithArgs("expire", "instance-1", "binding-1", "", "janitor", outcomeSucceeded, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	broker.DropExpiredBindings()
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDropExpiredBindingsKeepsUndroppedUsers(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.binding, dbs.instance, creds.name, creds.db, COALESCE(dbs.shared_db, '')`)).
+		WillReturnRows(sqlmock.NewRows([]string{"binding", "instance", "name", "db", "shared_db"}).
+			AddRow("binding-1", "instance-1", "u1", "s1", mockDbName))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1`)).
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	/* on a shared database, the schema is the instance role */
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE s1 FROM u1`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u1 NOLOGIN`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL PRIVILEGES ON DATABASE ` + mockDbName + ` FROM u1`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP USER u1`)).
+		WillReturnError(&pq.Error{Code: "2BP01", Message: `role "u1" cannot be dropped because some objects depend on it`})
+	tenant.ExpectExec(regexp.QuoteMeta(`REASSIGN OWNED BY u1 TO s1`)).
+		WillReturnError(errors.New("connection reset"))
+	/* the creds row stays, so the next pass tries again */
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).
+		WithArgs("expire", "instance-1", "binding-1", "", "janitor", outcomeFailed, "failed dropping the database user: connection reset").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	broker.DropExpiredBindings()
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
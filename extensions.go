@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+// Extension is a PostgreSQL extension installed in an instance
+// database.
+type Extension struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+var validExtension = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+func (p Plan) validateExtensions() error {
+	for _, ext := range p.Extensions {
+		if !validExtension.MatchString(ext) {
+			return fmt.Errorf("plan '%s' allows invalid extension name '%s'", p.Name, ext)
+		}
+	}
+	return nil
+}
+
+// extensions checks that every extension a developer asked for is on
+// the plan's allowlist, dropping any duplicates.
+func (p Plan) extensions(requested []string) ([]string, error) {
+	allowed := make(map[string]bool)
+	for _, ext := range p.Extensions {
+		allowed[ext] = true
+	}
+
+	var l []string
+	seen := make(map[string]bool)
+	for _, ext := range requested {
+		if !allowed[ext] {
+			if len(p.Extensions) == 0 {
+				return nil, parameterError("this plan does not allow any extensions")
+			}
+			return nil, parameterError("this plan does not allow the '%s' extension", ext)
+		}
+		if !seen[ext] {
+			seen[ext] = true
+			l = append(l, ext)
+		}
+	}
+	return l, nil
+}
+
+// merge adds the extensions in more to those in l, keeping their order.
+func merge(l, more []string) []string {
+	seen := make(map[string]bool)
+	for _, s := range l {
+		seen[s] = true
+	}
+	for _, s := range more {
+		if !seen[s] {
+			seen[s] = true
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+// tenant connects to an instance database, as the broker.
+func (b *Broker) tenant(db string) (*sql.DB, error) {
+	if b.dial != nil {
+		return b.dial(db)
+	}
+	return b.openDbConnection(db)
+}
+
+// installExtensions creates any of the given extensions that aren't
+// already in the instance database; it returns the extension that it
+// couldn't install, if any.
+func (b *Broker) installExtensions(ctx context.Context, db string, extensions []string) (string, error) {
+	if len(extensions) == 0 {
+		return "", nil
+	}
+
+	conn, err := b.tenant(db)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	for _, ext := range extensions {
+		sctx, cancel := b.statement(ctx)
+		_, err := conn.ExecContext(sctx, `CREATE EXTENSION IF NOT EXISTS `+pq.QuoteIdentifier(ext))
+		cancel()
+		if err != nil {
+			return ext, err
+		}
+		info("installed extension %s in %s\n", ext, db)
+	}
+	return "", nil
+}
+
+// InstalledExtensions lists the extensions (and their versions) that
+// are actually installed in an instance database, including any that
+// the tenant installed on their own.
+func (b *Broker) InstalledExtensions(db string) ([]Extension, error) {
+	conn, err := b.tenant(db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := conn.QueryContext(ctx, `SELECT extname, extversion FROM pg_extension ORDER BY extname`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Extension, 0)
+	for r.Next() {
+		var ext Extension
+		if err := r.Scan(&ext.Name, &ext.Version); err != nil {
+			return nil, err
+		}
+		l = append(l, ext)
+	}
+	return l, r.Err()
+}
+
+// AddExtensions installs more of the plan's allowed extensions into an
+// existing instance, as asked for in an update.
+func (b *Broker) AddExtensions(inst Instance, extensions []string) error {
+	if _, err := b.installExtensions(context.Background(), inst.Database, extensions); err != nil {
+		return fmt.Errorf("unable to install extensions: %s", failureReason(err))
+	}
+
+	all, _ := json.Marshal(merge(inst.Extensions, extensions))
+	_, err := b.exec(context.Background(), `UPDATE dbs SET extensions = $2 WHERE instance = $1`, inst.ID, all)
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/pivotal-golang/lager"
+)
+
+var extensionsPlan = Plan{ID: "plan-id", Name: "shared", Extensions: []string{"pgcrypto", "uuid-ossp", "vector"}}
+
+var tenants int32
+
+// stubTenants points a broker's connections to instance databases at
+// a single stub database, which every connection shares.
+func stubTenants(t *testing.T, broker *Broker) sqlmock.Sqlmock {
+	dsn := fmt.Sprintf("tenant-%d", atomic.AddInt32(&tenants, 1))
+	_, mock, err := sqlmock.NewWithDSN(dsn)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	broker.dial = func(name string) (*sql.DB, error) {
+		if name != mockDbName {
+			t.Fatalf(`expected to connect to %s, not %s`, mockDbName, name)
+		}
+		return sql.Open("sqlmock", dsn)
+	}
+	return mock
+}
+
+// tenantBroker returns a broker whose instance databases are all the
+// same stub database.
+func tenantBroker(t *testing.T) (*Broker, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	broker := &Broker{db: db, Plans: []Plan{extensionsPlan}}
+	broker.Service.ID = "service-id"
+	return broker, mock, stubTenants(t, broker)
+}
+
+func TestPlanExtensions(t *testing.T) {
+	l, err := extensionsPlan.extensions([]string{"vector", "pgcrypto", "vector"})
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if strings.Join(l, ",") != "vector,pgcrypto" {
+		t.Fatalf(`unexpected extensions: %v`, l)
+	}
+
+	if _, err := extensionsPlan.extensions([]string{"postgis"}); err == nil {
+		t.Fatalf(`expected postgis to be refused`)
+	}
+	if _, err := (Plan{}).extensions([]string{"pgcrypto"}); err == nil {
+		t.Fatalf(`expected a plan without an allowlist to refuse all extensions`)
+	}
+}
+
+func TestSetupInstallsExtensions(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsolation(mock, tenant, mockDbName)
+	tenant.ExpectExec(regexp.QuoteMeta(`CREATE EXTENSION IF NOT EXISTS "pgcrypto"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectExec(regexp.QuoteMeta(`CREATE EXTENSION IF NOT EXISTS "vector"`)).
+		WillReturnError(&pq.Error{Code: "0A000", Message: `extension "vector" is not available`})
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'failed'::state`)).
+		WithArgs("instance-1", "provision", "installing extension vector", `extension "vector" is not available`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "provision", outcomeFailed)
+
+	broker.Setup(Instance{ID: "instance-1", Database: mockDbName, Extensions: []string{"pgcrypto", "vector"}})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIUpdateInstallsExtensions(t *testing.T) {
+	testCases := map[string]struct {
+		body     string
+		install  bool
+		expected int
+	}{
+		"more extensions":    {body: `{"parameters":{"extensions":["uuid-ossp"]}}`, install: true, expected: http.StatusOK},
+		"disallowed":         {body: `{"parameters":{"extensions":["postgis"]}}`, expected: http.StatusBadRequest},
+		"creation options":   {body: `{"parameters":{"encoding":"UTF8"}}`, expected: http.StatusBadRequest},
+		"unknown parameters": {body: `{"parameters":{"size":"10G"}}`, expected: http.StatusBadRequest},
+		"plan change":        {body: `{"plan_id":"other-plan-id"}`, expected: http.StatusUnprocessableEntity},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			broker, mock, tenant := tenantBroker(t)
+			defer broker.db.Close()
+
+			mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+				WithArgs("instance-1").
+				WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+					AddRow("instance-1", mockDbName, "done", "plan-id", "", "org-id", "space-id", "", time.Now(), "", "", "", "", "{}", `["pgcrypto"]`, "", "", "", nil, ""))
+			if test.install {
+				tenant.ExpectExec(regexp.QuoteMeta(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET extensions = $2 WHERE instance = $1`)).
+					WithArgs("instance-1", []byte(`["pgcrypto","uuid-ossp"]`)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO events`)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+			router := mux.NewRouter()
+			AttachRoutes(router, broker, lager.NewLogger("test"))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PATCH", "/v2/service_instances/instance-1", strings.NewReader(test.body)))
+			if w.Code != test.expected {
+				t.Fatalf(`expected status %d, got: %d (%s)`, test.expected, w.Code, w.Body.String())
+			}
+
+			// we make sure that all expectations were met
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if err := tenant.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestAdminInstalledExtensions(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, "done", "plan-id", "", "org-id", "space-id", "", time.Now(), "", "", "", "", "{}", `["pgcrypto"]`, "", "", "", nil, ""))
+	tenant.ExpectQuery(regexp.QuoteMeta(`SELECT extname, extversion FROM pg_extension`)).
+		WillReturnRows(sqlmock.NewRows([]string{"extname", "extversion"}).
+			AddRow("pgcrypto", "1.3").
+			AddRow("plpgsql", "1.0"))
+
+	router := mux.NewRouter()
+	AttachAdminRoutes(router, broker)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/instances/instance-1/extensions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusOK, w.Code, w.Body.String())
+	}
+	if strings.TrimSpace(w.Body.String()) != `[{"name":"pgcrypto","version":"1.3"},{"name":"plpgsql","version":"1.0"}]` {
+		t.Fatalf(`unexpected extensions: %s`, w.Body.String())
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -4,16 +4,17 @@ go 1.18
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/gorilla/mux v0.0.0-20160525140913-bd09be08ed43
 	github.com/jhunt/vcaptive v0.0.0-20180122155229-e4d395046137
 	github.com/lib/pq v0.0.0-20171126050459-83612a56d3dd
 	github.com/pivotal-cf/brokerapi v0.0.0-20160520210533-c0e4e272dc4e
 	github.com/pivotal-golang/lager v0.0.0-20160311180000-7639e31ce662
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
 
 require (
 	github.com/drewolson/testflight v1.0.0 // indirect
 	github.com/gorilla/context v0.0.0-20160525203319-aed02d124ae4 // indirect
-	github.com/gorilla/mux v0.0.0-20160525140913-bd09be08ed43 // indirect
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.19.0 // indirect
 	github.com/pborman/uuid v1.2.1 // indirect
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// isolate locks a new instance database down, so that only its own
+// role (which its bindings are members of) can use it; backends
+// otherwise let PUBLIC connect to it, create temporary tables in it,
+// and create objects in its public schema.  It returns the step that
+// failed, if any.
+func (b *Broker) isolate(ctx context.Context, db string) (string, error) {
+	_, err := b.execBackend(ctx, `CREATE ROLE `+db+` NOLOGIN`)
+	if isPqError(err, "42710") {
+		info("instance role %s already exists, continuing\n", db)
+		err = nil
+	}
+	if err != nil {
+		return "creating the instance role", err
+	}
+	if _, err := b.execBackend(ctx, `REVOKE ALL ON DATABASE `+db+` FROM PUBLIC`); err != nil {
+		return "revoking public access to the instance database", err
+	}
+	if _, err := b.execBackend(ctx, `GRANT ALL PRIVILEGES ON DATABASE `+db+` TO `+db); err != nil {
+		return "granting the instance role access to the instance database", err
+	}
+
+	conn, err := b.tenant(db)
+	if err != nil {
+		return "connecting to the instance database", err
+	}
+	defer conn.Close()
+
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+	if _, err := conn.ExecContext(sctx, `REVOKE ALL ON SCHEMA public FROM PUBLIC`); err != nil {
+		return "revoking public access to the public schema", err
+	}
+	if _, err := conn.ExecContext(sctx, `GRANT ALL ON SCHEMA public TO `+db); err != nil {
+		return "granting the instance role access to the public schema", err
+	}
+	return "", nil
+}
+
+// lockDown keeps tenants out of the broker's own database, which holds
+// every binding's password; like any other database, it is otherwise
+// open to PUBLIC.
+func (b *Broker) lockDown() error {
+	for _, q := range []string{
+		`REVOKE ALL ON DATABASE ` + brokerDatabaseName + ` FROM PUBLIC`,
+		`REVOKE ALL ON SCHEMA public FROM PUBLIC`,
+		`REVOKE ALL ON ALL TABLES IN SCHEMA public FROM PUBLIC`,
+		`REVOKE ALL ON ALL SEQUENCES IN SCHEMA public FROM PUBLIC`,
+	} {
+		_, err := b.db.Exec(q)
+		if isPqError(err, "42501") {
+			/* before PostgreSQL 15, the public schema belongs to the
+			   bootstrap superuser, not the database owner */
+			oops("unable to lock down the broker database (%s): %s\n", q, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to lock down the broker database: %w", err)
+		}
+	}
+	return nil
+}
+
+// Exposure is a tenant database that PUBLIC still has rights to.
+type Exposure struct {
+	Instance string `json:"instance"`
+	Database string `json:"database"`
+}
+
+// Exposures lists the tenant databases that any role on the backend
+// can connect to, or create temporary tables in, such as those made
+// before the broker started locking them down.
+func (b *Broker) Exposures() ([]Exposure, error) {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	/* the broker's metadata need not be on the backend, so this can't
+	   be a join */
+	r, err := b.db.QueryContext(ctx, `SELECT instance, COALESCE(shared_db, TRIM(name)) FROM dbs WHERE state = 'done' ORDER BY instance`)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		all   []Exposure
+		names []string
+	)
+	for r.Next() {
+		var e Exposure
+		if err := r.Scan(&e.Instance, &e.Database); err != nil {
+			r.Close()
+			return nil, err
+		}
+		e.Instance = strings.TrimSpace(e.Instance)
+		all = append(all, e)
+		names = append(names, e.Database)
+	}
+	r.Close()
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	r, err = b.backend().QueryContext(ctx, `
+SELECT datname FROM pg_database
+ WHERE datname = ANY($1)
+   AND (has_database_privilege('public', oid, 'CONNECT') OR has_database_privilege('public', oid, 'TEMP'))`, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	open := make(map[string]bool)
+	for r.Next() {
+		var name string
+		if err := r.Scan(&name); err != nil {
+			return nil, err
+		}
+		open[name] = true
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	l := make([]Exposure, 0)
+	for _, e := range all {
+		if open[e.Database] {
+			l = append(l, e)
+		}
+	}
+	return l, nil
+}
+
+// CheckIsolation flags tenant databases that are still open to PUBLIC,
+// once each, in the logs and to any webhooks.
+func (b *Broker) CheckIsolation() {
+	l, err := b.Exposures()
+	if err != nil {
+		oops("failed to check tenant databases for public access: %s\n", err)
+		return
+	}
+
+	if b.exposed == nil {
+		b.exposed = make(map[string]bool)
+	}
+	for _, e := range l {
+		if b.exposed[e.Instance] {
+			continue
+		}
+		b.exposed[e.Instance] = true
+		oops("database %s (instance %s) is open to PUBLIC; other tenants may be able to connect to it\n", e.Database, e.Instance)
+		b.notify("instance.exposed", e)
+	}
+}
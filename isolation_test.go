@@ -0,0 +1,105 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func expectIsolation(mock, tenant sqlmock.Sqlmock, db string) {
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE ROLE ` + db + ` NOLOGIN`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON DATABASE ` + db + ` FROM PUBLIC`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`GRANT ALL PRIVILEGES ON DATABASE ` + db + ` TO ` + db)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON SCHEMA public FROM PUBLIC`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectExec(regexp.QuoteMeta(`GRANT ALL ON SCHEMA public TO ` + db)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestCheckIsolationFlagsExposedDatabasesOnce(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	/* with the metadata on a service of its own */
+	server, backend, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer server.Close()
+	broker.server = server
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT instance, COALESCE(shared_db, TRIM(name)) FROM dbs`)).
+			WillReturnRows(sqlmock.NewRows([]string{"instance", "name"}).
+				AddRow("instance-1                          ", mockDbName).
+				AddRow("instance-2                          ", "otherDbName"))
+		backend.ExpectQuery(regexp.QuoteMeta(`SELECT datname FROM pg_database`)).
+			WithArgs(pq.Array([]string{mockDbName, "otherDbName"})).
+			WillReturnRows(sqlmock.NewRows([]string{"datname"}).AddRow(mockDbName))
+	}
+
+	broker.CheckIsolation()
+	broker.CheckIsolation()
+	if len(broker.exposed) != 1 || !broker.exposed["instance-1"] {
+		t.Fatalf(`expected instance-1 to be flagged, got: %v`, broker.exposed)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := backend.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations on the backend: %s", err)
+	}
+}
+
+func TestLockDownBrokerDatabase(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON DATABASE broker FROM PUBLIC`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON SCHEMA public FROM PUBLIC`)).
+		WillReturnError(&pq.Error{Code: "42501", Message: "must be owner of schema public"})
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON ALL TABLES IN SCHEMA public FROM PUBLIC`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON ALL SEQUENCES IN SCHEMA public FROM PUBLIC`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := broker.lockDown(); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGrantInstanceWithoutRole(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "state", "populated", "shared_db"}).AddRow(mockDbName, "done", false, ""))
+	mock.ExpectExec(`CREATE USER`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`GRANT ` + mockDbName + ` TO u[0-9a-z]{16}`).
+		WillReturnError(&pq.Error{Code: "42704", Message: "role does not exist"})
+	mock.ExpectExec(`GRANT ALL PRIVILEGES ON DATABASE ` + mockDbName + ` TO u[0-9a-z]{16}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO creds`)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if _, _, err := broker.Grant("instance-1", Binding{ID: "binding-1"}); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"time"
+)
+
+// Janitor periodically runs all of the broker's housekeeping tasks;
+// it never returns, so it should be run in its own goroutine.
+func (b *Broker) Janitor(interval time.Duration) {
+	info("janitor running every %s\n", interval)
+	for {
+		b.ExpireOperations()
+		b.ExpireBindings()
+		b.DropExpiredBindings()
+		b.ExpireTrials()
+		b.PurgeTombstones()
+		b.ScheduleBackups()
+		b.PruneDeletedBackups()
+		b.PurgeEvents()
+		b.PurgeDeliveries()
+		b.CheckIsolation()
+		b.Limits.Sweep(time.Now())
+		time.Sleep(interval)
+	}
+}
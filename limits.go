@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseProxies takes a comma-separated list of the addresses (or CIDR
+// ranges) of the proxies that are trusted to set X-Forwarded-For.
+func parseProxies(s string) ([]*net.IPNet, error) {
+	var l []*net.IPNet
+	for _, spec := range strings.Split(s, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address '%s'", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			l = append(l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address range '%s'", spec)
+		}
+		l = append(l, network)
+	}
+	return l, nil
+}
+
+func trusted(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	var forwarded []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(h, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+	// each trusted proxy appends the address it received the request
+	// from; the first address that isn't one of them is the client,
+	// and anything further left is client-supplied.
+	for len(forwarded) > 0 && trusted(proxies, ip) {
+		ip, forwarded = forwarded[len(forwarded)-1], forwarded[:len(forwarded)-1]
+	}
+	return ip
+}
+
+// client identifies who a request is from, for rate limiting: the
+// user it authenticated as, if any, or else the address it came from.
+func client(r *http.Request, proxies []*net.IPNet) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return "user " + username
+	}
+	return clientIP(r, proxies)
+}
+
+func endpoint(r *http.Request) string {
+	l := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(l) == 2 && l[0] == "v2" && l[1] == "catalog":
+		return "catalog"
+
+	case len(l) == 3 && l[0] == "v2" && l[1] == "service_instances":
+		switch r.Method {
+		case "PUT":
+			return "provision"
+		case "PATCH":
+			return "update"
+		case "DELETE":
+			return "deprovision"
+		}
+
+	case len(l) == 4 && l[0] == "v2" && l[1] == "service_instances" && l[3] == "last_operation":
+		return "last_operation"
+
+	case len(l) == 5 && l[0] == "v2" && l[1] == "service_instances" && l[3] == "service_bindings":
+		switch r.Method {
+		case "PUT":
+			return "bind"
+		case "DELETE":
+			return "unbind"
+		}
+	}
+	return "other"
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "{\"description\":%q}\n", msg)
+}
+
+type strike struct {
+	failures int
+	first    time.Time
+	until    time.Time
+}
+
+type Lockout struct {
+	MaxFailures int
+	Window      time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*strike
+}
+
+func NewLockout(max int, window time.Duration) *Lockout {
+	return &Lockout{
+		MaxFailures: max,
+		Window:      window,
+		clients:     make(map[string]*strike),
+	}
+}
+
+func (l *Lockout) Locked(who string, now time.Time) (time.Duration, bool) {
+	if l == nil || l.MaxFailures <= 0 {
+		return 0, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.clients[who]; ok && now.Before(s.until) {
+		return s.until.Sub(now), true
+	}
+	return 0, false
+}
+
+func (l *Lockout) Fail(who string, now time.Time) {
+	if l == nil || l.MaxFailures <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, s := range l.clients {
+		if now.Sub(s.first) > l.Window && now.After(s.until) {
+			delete(l.clients, k)
+		}
+	}
+
+	s, ok := l.clients[who]
+	if !ok {
+		s = &strike{first: now}
+		l.clients[who] = s
+	}
+	s.failures++
+	if s.failures >= l.MaxFailures {
+		oops("locking out %s for %s after %d failed authentication attempts\n", who, l.Window, s.failures)
+		s.until = now.Add(l.Window)
+		s.failures = 0
+		s.first = now
+	}
+}
+
+func (l *Lockout) Reset(who string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, who)
+}
+
+type bucket struct {
+	rate   float64 /* tokens per second */
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time) (time.Duration, bool) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+type RateLimits struct {
+	Proxies []*net.IPNet
+
+	mu      sync.Mutex
+	limits  map[string]bucket
+	buckets map[string]*bucket
+}
+
+// parseRateLimits takes a comma-separated list of `endpoint=N/period`
+// limits, i.e. `provision=10/m,bind=1/s`.  The endpoint `*` applies to
+// any endpoint not explicitly listed.
+func parseRateLimits(s string) (*RateLimits, error) {
+	limits := &RateLimits{limits: make(map[string]bucket), buckets: make(map[string]*bucket)}
+	for _, spec := range strings.Split(s, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		l := strings.SplitN(spec, "=", 2)
+		if len(l) != 2 {
+			return nil, fmt.Errorf("malformed rate limit '%s' (expected endpoint=N/period)", spec)
+		}
+		name := strings.TrimSpace(l[0])
+
+		l = strings.SplitN(strings.TrimSpace(l[1]), "/", 2)
+		n, err := strconv.Atoi(l[0])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid rate limit for '%s': '%s' is not a positive number", name, l[0])
+		}
+		period := time.Second
+		if len(l) == 2 {
+			switch l[1] {
+			case "s":
+			case "m":
+				period = time.Minute
+			case "h":
+				period = time.Hour
+			default:
+				return nil, fmt.Errorf("invalid rate limit period for '%s': '%s' (expected s, m, or h)", name, l[1])
+			}
+		}
+
+		limits.limits[name] = bucket{
+			rate:   float64(n) / period.Seconds(),
+			burst:  float64(n),
+			tokens: float64(n),
+		}
+	}
+	return limits, nil
+}
+
+// Allow takes a token from the bucket for a client's use of an
+// endpoint; every client gets its own bucket for every endpoint, so
+// that one busy (or abusive) client can't starve the others.
+func (rl *RateLimits) Allow(endpoint, client string, now time.Time) (time.Duration, bool) {
+	if rl == nil {
+		return 0, true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	key := endpoint + " " + client
+	b, ok := rl.buckets[key]
+	if !ok {
+		limit, ok := rl.limits[endpoint]
+		if !ok {
+			if limit, ok = rl.limits["*"]; !ok {
+				return 0, true
+			}
+		}
+		b = &limit
+		rl.buckets[key] = b
+	}
+	return b.take(now)
+}
+
+// Sweep forgets the buckets that have filled back up, since they are
+// as good as new; the janitor calls it, so that requests don't have to.
+func (rl *RateLimits) Sweep(now time.Time) {
+	if rl == nil {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for k, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+func (rl *RateLimits) Wrap(handler http.Handler) http.Handler {
+	if rl == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := rl.Allow(endpoint(r), client(r, rl.Proxies), time.Now()); !ok {
+			tooManyRequests(w, wait, "rate limit exceeded; please try again later")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	testCases := map[string]struct {
+		remote    string
+		forwarded string
+		proxies   string
+		expected  string
+	}{
+		"no proxies": {
+			remote:    "10.0.0.1",
+			forwarded: "192.0.2.1",
+			expected:  "10.0.0.1",
+		},
+		"behind the gorouter": {
+			remote:    "10.0.0.1",
+			forwarded: "192.0.2.1",
+			proxies:   "10.0.0.0/24",
+			expected:  "192.0.2.1",
+		},
+		"forwarded-for from an untrusted client": {
+			remote:    "198.51.100.7",
+			forwarded: "192.0.2.1",
+			proxies:   "10.0.0.0/24",
+			expected:  "198.51.100.7",
+		},
+		"spoofed forwarded-for": {
+			remote:    "10.0.0.1",
+			forwarded: "203.0.113.9, 192.0.2.1",
+			proxies:   "10.0.0.0/24",
+			expected:  "192.0.2.1",
+		},
+		"behind a load balancer and the gorouter": {
+			remote:    "10.0.0.1",
+			forwarded: "203.0.113.9, 192.0.2.1, 10.1.0.5",
+			proxies:   "10.0.0.0/24, 10.1.0.5",
+			expected:  "192.0.2.1",
+		},
+		"missing forwarded-for": {
+			remote:   "10.0.0.1",
+			proxies:  "10.0.0.0/24",
+			expected: "10.0.0.1",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			proxies, err := parseProxies(test.proxies)
+			if err != nil {
+				t.Fatalf(`unexpected error: %s`, err)
+			}
+			req := httptest.NewRequest("GET", "/v2/catalog", nil)
+			req.RemoteAddr = test.remote + ":5678"
+			if test.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			if ip := clientIP(req, proxies); ip != test.expected {
+				t.Fatalf(`expected clientIP = %q, got: %q`, test.expected, ip)
+			}
+		})
+	}
+}
+
+func TestParseProxiesMalformed(t *testing.T) {
+	for _, s := range []string{"gorouter", "10.0.0.0/33", "10.0.0"} {
+		if _, err := parseProxies(s); err == nil {
+			t.Fatalf(`expected parseProxies(%q) to fail`, s)
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	testCases := map[string]struct {
+		method   string
+		path     string
+		expected string
+	}{
+		"catalog":        {method: "GET", path: "/v2/catalog", expected: "catalog"},
+		"provision":      {method: "PUT", path: "/v2/service_instances/i1", expected: "provision"},
+		"update":         {method: "PATCH", path: "/v2/service_instances/i1", expected: "update"},
+		"deprovision":    {method: "DELETE", path: "/v2/service_instances/i1", expected: "deprovision"},
+		"last operation": {method: "GET", path: "/v2/service_instances/i1/last_operation", expected: "last_operation"},
+		"bind":           {method: "PUT", path: "/v2/service_instances/i1/service_bindings/b1", expected: "bind"},
+		"unbind":         {method: "DELETE", path: "/v2/service_instances/i1/service_bindings/b1", expected: "unbind"},
+		"unknown":        {method: "GET", path: "/", expected: "other"},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if e := endpoint(req); e != test.expected {
+				t.Fatalf(`expected endpoint = %q, got: %q`, test.expected, e)
+			}
+		})
+	}
+}
+
+func TestParseRateLimitsMalformed(t *testing.T) {
+	for _, s := range []string{"provision", "provision=x/m", "provision=0/m", "provision=10/d"} {
+		if _, err := parseRateLimits(s); err == nil {
+			t.Fatalf(`expected parseRateLimits(%q) to fail`, s)
+		}
+	}
+}
+
+func TestRateLimitsAllow(t *testing.T) {
+	limits, err := parseRateLimits("provision=2/m, *=1/s")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, ok := limits.Allow("provision", "user cf", now); !ok {
+			t.Fatalf(`expected provision #%d to be allowed`, i)
+		}
+	}
+	wait, ok := limits.Allow("provision", "user cf", now)
+	if ok {
+		t.Fatalf(`expected third provision to be rate-limited`)
+	}
+	if wait <= 0 || wait > 30*time.Second {
+		t.Fatalf(`expected to wait up to 30s, got: %s`, wait)
+	}
+	if _, ok := limits.Allow("provision", "user cf", now.Add(wait)); !ok {
+		t.Fatalf(`expected provision to be allowed after waiting %s`, wait)
+	}
+
+	/* the wildcard limit is tracked per-endpoint */
+	if _, ok := limits.Allow("bind", "user cf", now); !ok {
+		t.Fatalf(`expected bind to be allowed`)
+	}
+	if _, ok := limits.Allow("unbind", "user cf", now); !ok {
+		t.Fatalf(`expected unbind to be allowed`)
+	}
+	if _, ok := limits.Allow("bind", "user cf", now); ok {
+		t.Fatalf(`expected second bind to be rate-limited`)
+	}
+
+	/* and per-client */
+	if _, ok := limits.Allow("provision", "user other", now); !ok {
+		t.Fatalf(`expected another client's provision to be allowed`)
+	}
+	if _, ok := limits.Allow("bind", "192.0.2.1", now); !ok {
+		t.Fatalf(`expected another client's bind to be allowed`)
+	}
+}
+
+func TestRateLimitsSweep(t *testing.T) {
+	limits, err := parseRateLimits("provision=2/m")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	now := time.Now()
+	limits.Allow("provision", "user cf", now)
+	limits.Allow("provision", "user other", now)
+	limits.Allow("provision", "user other", now)
+
+	/* cf's bucket has refilled by now, but other's hasn't */
+	limits.Sweep(now.Add(45 * time.Second))
+	if _, ok := limits.buckets["provision user cf"]; ok {
+		t.Fatalf(`expected cf's full bucket to be swept`)
+	}
+	if _, ok := limits.buckets["provision user other"]; !ok {
+		t.Fatalf(`expected other's bucket to be kept`)
+	}
+}
+
+func TestRateLimitsWrap(t *testing.T) {
+	limits, err := parseRateLimits("catalog=1/h")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	handler := limits.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, test := range []struct {
+		username string
+		expected int
+	}{
+		{"cf-one", http.StatusOK},
+		{"cf-one", http.StatusTooManyRequests},
+		{"cf-two", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		req.SetBasicAuth(test.username, "sekrit")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Fatalf(`request #%d: expected status %d, got: %d`, i, test.expected, w.Code)
+		}
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/jhunt/vcaptive"
-	"github.com/pivotal-cf/brokerapi"
 	"github.com/pivotal-golang/lager"
 )
 
@@ -15,10 +16,38 @@ func main() {
 	broker := &Broker{}
 	broker.Service.ID = cfg("postgres-c504319a-61e7-459e-83ac-01243787689b", "SERVICE_ID")
 	broker.Service.Name = cfg("postgres", "SERVICE_NAME")
-	broker.Plan.ID = cfg("postgres-c504319a-61e7-459e-83ac-01243787689b", "PLAN_ID")
-	broker.Plan.Name = cfg("shared", "PLAN_NAME")
 	broker.Description = cfg("A shared PostgreSQL database", "DESCRIPTION")
 	broker.Tags = strings.Split(cfg("shared,postgres,postgresql,tinsmith", "TAGS"), ",")
+	broker.MaxJobs = cfgInt(8, "SB_MAX_JOBS")
+	broker.PgDump = cfg("pg_dump", "SB_PG_DUMP")
+	broker.Psql = cfg("psql", "SB_PSQL")
+	broker.EventRetention = cfgDuration(365*24*time.Hour, "SB_AUDIT_RETENTION")
+	broker.ProvisionTimeout = cfgDuration(15*time.Minute, "SB_PROVISION_TIMEOUT")
+	broker.DeprovisionTimeout = cfgDuration(15*time.Minute, "SB_DEPROVISION_TIMEOUT")
+	broker.StatementTimeout = cfgDuration(2*time.Minute, "SB_STATEMENT_TIMEOUT")
+	broker.BackupTimeout = cfgDuration(time.Hour, "SB_BACKUP_TIMEOUT")
+
+	plans, err := loadPlans(broker.Description)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	broker.Plans = plans
+
+	webhooks, err := loadWebhooks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	broker.Webhooks = webhooks
+	broker.WebhookAttempts = cfgInt(10, "SB_WEBHOOK_MAX_ATTEMPTS")
+
+	store, err := backupStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	broker.Store = store
 
 	app, err := vcaptive.ParseApplication(os.Getenv("VCAP_APPLICATION"))
 	if err != nil {
@@ -28,18 +57,70 @@ func main() {
 
 	fmt.Printf("running v%s of %s at http://%s\n", app.Version, app.Name, app.URIs[0])
 
+	creds, err := brokerCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	proxies, err := parseProxies(os.Getenv("SB_TRUSTED_PROXIES"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SB_TRUSTED_PROXIES: %s\n", err)
+		os.Exit(1)
+	}
+	if os.Getenv("SB_PROXY_HOPS") != "" {
+		oops("SB_PROXY_HOPS is no longer supported; set SB_TRUSTED_PROXIES to the addresses of your proxies instead\n")
+	}
+	if len(proxies) == 0 {
+		oops("WARNING: SB_TRUSTED_PROXIES is not set; if the broker is behind a router, every request will appear to come from it, and rate limits and lockouts will apply to all clients at once\n")
+	}
+	maxFailures := cfgInt(5, "SB_AUTH_MAX_FAILURES")
+	lockout := cfgDuration(15*time.Minute, "SB_AUTH_LOCKOUT")
+	auth := Auth{
+		Credentials: creds,
+		Lockout:     NewLockout(maxFailures, lockout),
+		Proxies:     proxies,
+	}
+
+	adminCreds, err := adminCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	limits, err := parseRateLimits(os.Getenv("SB_RATE_LIMITS"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SB_RATE_LIMITS: %s\n", err)
+		os.Exit(1)
+	}
+	limits.Proxies = proxies
+	broker.Limits = limits
+
 	if err := broker.Init(); err != nil {
 		panic(err)
 	}
+	if len(os.Args) > 1 && os.Args[1] == "isolation-test" {
+		os.Exit(isolationTest(broker, os.Args[2:]))
+	}
+	go broker.Janitor(cfgDuration(5*time.Minute, "SB_JANITOR_INTERVAL"))
+	if len(broker.Webhooks) > 0 {
+		go broker.Courier(cfgDuration(30*time.Second, "SB_WEBHOOK_INTERVAL"))
+	}
 
-	http.Handle("/", brokerapi.New(
-		broker,
-		lager.NewLogger("postgres-tinsmith"),
-		brokerapi.BrokerCredentials{
-			Username: cfg("b-postgres", "SB_BROKER_USERNAME"),
-			Password: cfg("postgres", "SB_BROKER_PASSWORD"),
-		},
-	))
+	router := mux.NewRouter()
+	AttachRoutes(router, broker, lager.NewLogger("postgres-tinsmith"))
+	http.Handle("/", auth.Wrap(limits.Wrap(router)))
+
+	if adminCreds != nil {
+		admin := mux.NewRouter()
+		AttachAdminRoutes(admin, broker)
+		http.Handle("/admin/", Auth{
+			Credentials: adminCreds,
+			Lockout:     NewLockout(maxFailures, lockout),
+			Proxies:     auth.Proxies,
+		}.Wrap(admin))
+	} else {
+		info("SB_ADMIN_CREDENTIALS not set; the admin API is disabled\n")
+	}
 	err = http.ListenAndServe(":"+cfg("3000", "PORT"), nil)
 	fmt.Fprintf(os.Stderr, "http server exited: %s\n", err)
 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Failure records why (and where) an asynchronous operation on a
+// service instance failed.
+type Failure struct {
+	Operation string `json:"operation"`
+	Step      string `json:"step"`
+	Reason    string `json:"reason"`
+}
+
+const maxDescription = 200
+
+var (
+	redactPasswords = regexp.MustCompile(`(?i)(password\s*)'[^']*'`)
+	redactDSNs      = regexp.MustCompile(`postgres(ql)?://[^\s]+`)
+	unreachable     = regexp.MustCompile(`dial tcp|connection refused|no such host|i/o timeout|connection reset`)
+)
+
+// sanitize turns a raw backend error into something that is safe to
+// show to a developer: no passwords, no connection strings and no
+// network details about the shared PostgreSQL backend.
+func sanitize(reason string) string {
+	if unreachable.MatchString(reason) {
+		return "the database server could not be reached"
+	}
+
+	reason = redactPasswords.ReplaceAllString(reason, `$1'...'`)
+	reason = redactDSNs.ReplaceAllString(reason, `postgres://...`)
+	reason = strings.TrimPrefix(reason, "pq: ")
+	reason = strings.Join(strings.Fields(reason), " ")
+	if len(reason) > maxDescription {
+		reason = reason[:maxDescription-3] + "..."
+	}
+	return reason
+}
+
+// isPqError checks if err is a PostgreSQL error with one of the given
+// SQLSTATE codes, i.e. 42P04 (duplicate_database).
+func isPqError(err error, codes ...string) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	for _, code := range codes {
+		if string(pqErr.Code) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// failureReason prefers the bare message of a PostgreSQL error, since
+// the rest of it (detail, hint, position) rarely helps a developer.
+func failureReason(err error) string {
+	if err == nil {
+		return "unknown error"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timed out"
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if pqErr.Code == "57014" {
+			/* query_canceled, which is what a context timeout looks like to postgres */
+			return "timed out"
+		}
+		return pqErr.Message
+	}
+	return err.Error()
+}
+
+func describe(state string, f Failure) string {
+	switch state {
+	case "setup":
+		return "Creating the database."
+	case "teardown":
+		return "Deleting the database."
+	case "restoring":
+		return "Restoring the database from a backup."
+	case "done":
+		return "The database is ready."
+	case "gone":
+		return "The database has been deleted."
+	case "suspended":
+		return "The database has been suspended.  Please contact your operator."
+	case "failed":
+		what := "The operation"
+		switch f.Operation {
+		case "provision":
+			what = "Creating the database"
+		case "deprovision":
+			what = "Deleting the database"
+		case "bind":
+			what = "Binding the database"
+		case "unbind":
+			what = "Unbinding the database"
+		case "restore":
+			what = "Restoring the database"
+		}
+		if f.Step == "" {
+			return what + " failed.  Please contact your operator."
+		}
+		return fmt.Sprintf("%s failed while %s: %s.  Please contact your operator.", what, f.Step, sanitize(f.Reason))
+	default:
+		return "Unable to determine the state of this database."
+	}
+}
+
+// operation starts the clock on an asynchronous provision or
+// deprovision; a zero timeout means it may take as long as it likes.
+func operation(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func deadline(ctx context.Context) sql.NullTime {
+	t, ok := ctx.Deadline()
+	return sql.NullTime{Time: t, Valid: ok}
+}
+
+func (b *Broker) statement(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.StatementTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.StatementTimeout)
+}
+
+func (b *Broker) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := b.statement(ctx)
+	defer cancel()
+	return b.db.ExecContext(ctx, query, args...)
+}
+
+// backend is the server that instance databases live on, which is the
+// broker's own unless its metadata lives elsewhere.
+func (b *Broker) backend() *sql.DB {
+	if b.server != nil {
+		return b.server
+	}
+	return b.db
+}
+
+// execBackend runs a statement on the backend, rather than against the
+// broker's metadata; e.g. to create or drop databases and roles.
+func (b *Broker) execBackend(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := b.statement(ctx)
+	defer cancel()
+	return b.backend().ExecContext(ctx, query, args...)
+}
+
+// scan runs a query that returns (at most) a single row, returning
+// sql.ErrNoRows if there isn't one.
+func (b *Broker) scan(ctx context.Context, query string, args []interface{}, dest ...interface{}) error {
+	ctx, cancel := b.statement(ctx)
+	defer cancel()
+	return b.db.QueryRowContext(ctx, query, args...).Scan(dest...)
+}
+
+// column runs a query that returns a single column of strings.
+func (b *Broker) column(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	ctx, cancel := b.statement(ctx)
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var l []string
+	for r.Next() {
+		var s string
+		if err := r.Scan(&s); err != nil {
+			return nil, err
+		}
+		l = append(l, strings.TrimSpace(s))
+	}
+	return l, r.Err()
+}
+
+// ExpireOperations fails every provision, deprovision or restore that
+// has run past its deadline, whether its goroutine hung, died, or went
+// away with a previous incarnation of the broker.
+func (b *Broker) ExpireOperations() {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `
+UPDATE dbs SET state = 'failed'::state,
+               failed_operation = CASE state WHEN 'setup' THEN 'provision' WHEN 'restoring' THEN 'restore' ELSE 'deprovision' END,
+               failed_step = 'waiting for the operation to finish',
+               failure = 'it did not finish before its deadline'
+ WHERE state IN ('setup', 'teardown', 'restoring') AND deadline < now()
+ RETURNING instance, failed_operation`)
+	if err != nil {
+		oops("failed to check for stuck operations: %s\n", err)
+		return
+	}
+	var expired []Event
+	for r.Next() {
+		var instance, op string
+		if err := r.Scan(&instance, &op); err != nil {
+			oops("failed to check for stuck operations: %s\n", err)
+			continue
+		}
+		expired = append(expired, Event{Operation: op, Instance: strings.TrimSpace(instance)})
+	}
+	r.Close()
+
+	for _, e := range expired {
+		oops("%s of instance [%s] did not finish before its deadline; marking it as failed\n", e.Operation, e.Instance)
+		e.Outcome = outcomeFailed
+		e.Error = "failed waiting for the operation to finish: it did not finish before its deadline"
+		b.record(e)
+	}
+}
+
+// Retry re-runs the provision, deprovision or restore that left an
+// instance failed, picking up wherever it left off.  It returns the operation
+// that is being retried.
+func (b *Broker) Retry(instance string) (string, error) {
+	inst, err := b.GetInstance(instance)
+	if err != nil {
+		return "", err
+	}
+	if inst == nil {
+		return "", brokerapi.ErrInstanceDoesNotExist
+	}
+	if inst.State != "failed" || inst.Failure == nil {
+		return "", ErrNothingToRetry
+	}
+
+	var (
+		run     func()
+		state   string
+		timeout time.Duration
+	)
+	switch inst.Failure.Operation {
+	case "provision":
+		run, state, timeout = func() { b.Setup(*inst) }, "setup", b.ProvisionTimeout
+	case "deprovision":
+		run, state, timeout = func() { b.Teardown(instance) }, "teardown", b.DeprovisionTimeout
+	case "restore":
+		/* a restore runs its own job, and starts over from the backup */
+		var backup string
+		if err := b.scan(context.Background(), `SELECT COALESCE(restoring, '') FROM dbs WHERE instance = $1`, []interface{}{instance}, &backup); err != nil {
+			return "", err
+		}
+		if backup == "" {
+			return "", ErrNothingToRetry
+		}
+		_, err := b.RestoreBackup(backup, instance, "")
+		return "restore", err
+	default:
+		return "", ErrNothingToRetry
+	}
+
+	if !b.startJob() {
+		return "", ErrTooManyJobs
+	}
+	/* only one retry gets to take the instance out of its failed state;
+	   anyone else (or a retry of what was already retried) is refused */
+	ctx, cancel := operation(timeout)
+	r, err := b.exec(ctx, `UPDATE dbs SET state = $2::state, started = now(), deadline = $3, failed_operation = NULL, failed_step = NULL, failure = NULL
+ WHERE instance = $1 AND state = 'failed' AND failed_operation = $4`, instance, state, deadline(ctx), inst.Failure.Operation)
+	cancel()
+	if err != nil {
+		b.finishJob()
+		return "", err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		b.finishJob()
+		return "", ErrNothingToRetry
+	}
+	info("retrying failed %s of instance %s\n", inst.Failure.Operation, instance)
+	go func() {
+		defer b.finishJob()
+		run()
+	}()
+	return inst.Failure.Operation, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// DatabaseOptions are the settings an instance database is created
+// with; anything left empty gets the backend's default.
+type DatabaseOptions struct {
+	Encoding          string `json:"encoding,omitempty"`
+	Locale            string `json:"locale,omitempty"`
+	CollationProvider string `json:"collation_provider,omitempty"`
+	Template          string `json:"template,omitempty"`
+}
+
+// Choice is a plan's default for a database option, along with the
+// other values developers may ask for instead.
+type Choice struct {
+	Default string   `json:"default"`
+	Allowed []string `json:"allowed"`
+}
+
+// ProvisionParameters are the parameters developers may pass when
+// creating a service instance (`cf create-service -c ...`).
+type ProvisionParameters struct {
+	Encoding          string `json:"encoding"`
+	Locale            string `json:"locale"`
+	CollationProvider string `json:"collation_provider"`
+	Template          string `json:"template"`
+
+	Extensions []string `json:"extensions"`
+	CloneFrom  string   `json:"clone_from"`
+
+	/* a backup ID, or an instance ID to restore the latest backup of */
+	RestoreFrom string `json:"restore_from"`
+}
+
+// ParameterError is returned when a developer asks for something the
+// plan doesn't allow, or that we don't understand.
+type ParameterError struct {
+	msg string
+}
+
+func (e *ParameterError) Error() string {
+	return e.msg
+}
+
+func parameterError(f string, args ...interface{}) error {
+	return &ParameterError{msg: fmt.Sprintf(f, args...)}
+}
+
+func parseProvisionParameters(raw json.RawMessage) (ProvisionParameters, error) {
+	var params ProvisionParameters
+	if len(raw) == 0 || string(raw) == "null" {
+		return params, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&params); err != nil {
+		return params, parameterError("invalid parameters: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return params, nil
+}
+
+func (c Choice) allows(v string) bool {
+	if v == c.Default {
+		return true
+	}
+	for _, ok := range c.Allowed {
+		if v == ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Choice) choose(name, requested string) (string, error) {
+	if requested == "" {
+		return c.Default, nil
+	}
+	if !c.allows(requested) {
+		if len(c.Allowed) == 0 {
+			return "", parameterError("this plan does not let you choose the %s", name)
+		}
+		return "", parameterError("this plan does not allow %s '%s' (try one of: %s)", name, requested, strings.Join(c.Allowed, ", "))
+	}
+	return requested, nil
+}
+
+// databaseOptions works out what a new instance database should be
+// created with, from the plan's defaults and what the developer asked
+// for.
+func (p Plan) databaseOptions(params ProvisionParameters) (DatabaseOptions, error) {
+	var (
+		opts DatabaseOptions
+		err  error
+	)
+	if opts.Encoding, err = p.Encoding.choose("encoding", params.Encoding); err != nil {
+		return opts, err
+	}
+	if opts.Locale, err = p.Locale.choose("locale", params.Locale); err != nil {
+		return opts, err
+	}
+	if opts.CollationProvider, err = p.CollationProvider.choose("collation provider", params.CollationProvider); err != nil {
+		return opts, err
+	}
+	/* a seed template is the whole point of such a plan */
+	if p.Seed.Template != "" {
+		if params.Template != "" {
+			return opts, parameterError("this plan seeds new databases from its own template, '%s', so a template cannot be chosen", p.Seed.Template)
+		}
+		opts.Template = p.Seed.Template
+	} else if opts.Template, err = p.Template.choose("template", params.Template); err != nil {
+		return opts, err
+	}
+
+	/* template1 usually has the backend's encoding and locale baked in,
+	   so anything else has to start from the pristine template0 */
+	if opts.Template == "" && (opts.Encoding != "" || opts.Locale != "" || opts.CollationProvider != "") {
+		opts.Template = "template0"
+	}
+	return opts, nil
+}
+
+func (p Plan) validateOptions() error {
+	for _, provider := range append([]string{p.CollationProvider.Default}, p.CollationProvider.Allowed...) {
+		if provider != "" && provider != "libc" && provider != "icu" {
+			return fmt.Errorf("plan '%s' allows unknown collation provider '%s' (only libc and icu are supported)", p.Name, provider)
+		}
+	}
+	return nil
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// clause renders the options as the tail of a CREATE DATABASE
+// statement.
+func (o DatabaseOptions) clause() string {
+	var l []string
+	if o.Template != "" {
+		l = append(l, "TEMPLATE "+pq.QuoteIdentifier(o.Template))
+	}
+	if o.Encoding != "" {
+		l = append(l, "ENCODING "+quoteLiteral(o.Encoding))
+	}
+	if o.CollationProvider != "" {
+		l = append(l, "LOCALE_PROVIDER "+o.CollationProvider)
+	}
+	if o.Locale != "" {
+		if o.CollationProvider == "icu" {
+			l = append(l, "ICU_LOCALE "+quoteLiteral(o.Locale))
+		} else {
+			l = append(l, "LC_COLLATE "+quoteLiteral(o.Locale), "LC_CTYPE "+quoteLiteral(o.Locale))
+		}
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	return " " + strings.Join(l, " ")
+}
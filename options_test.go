@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-golang/lager"
+)
+
+var optionsPlan = Plan{
+	ID:                "plan-id",
+	Name:              "shared",
+	Encoding:          Choice{Default: "UTF8"},
+	Locale:            Choice{Default: "en_US.UTF-8", Allowed: []string{"de_DE.UTF-8", "de-DE"}},
+	CollationProvider: Choice{Allowed: []string{"icu"}},
+}
+
+func TestDatabaseOptions(t *testing.T) {
+	testCases := map[string]struct {
+		params   string
+		expected DatabaseOptions
+		clause   string
+	}{
+		"plan defaults": {
+			params:   ``,
+			expected: DatabaseOptions{Encoding: "UTF8", Locale: "en_US.UTF-8", Template: "template0"},
+			clause:   ` TEMPLATE "template0" ENCODING 'UTF8' LC_COLLATE 'en_US.UTF-8' LC_CTYPE 'en_US.UTF-8'`,
+		},
+		"allowed locale": {
+			params:   `{"locale": "de_DE.UTF-8"}`,
+			expected: DatabaseOptions{Encoding: "UTF8", Locale: "de_DE.UTF-8", Template: "template0"},
+			clause:   ` TEMPLATE "template0" ENCODING 'UTF8' LC_COLLATE 'de_DE.UTF-8' LC_CTYPE 'de_DE.UTF-8'`,
+		},
+		"icu collation": {
+			params:   `{"locale": "de-DE", "collation_provider": "icu"}`,
+			expected: DatabaseOptions{Encoding: "UTF8", Locale: "de-DE", CollationProvider: "icu", Template: "template0"},
+			clause:   ` TEMPLATE "template0" ENCODING 'UTF8' LOCALE_PROVIDER icu ICU_LOCALE 'de-DE'`,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			params, err := parseProvisionParameters(json.RawMessage(test.params))
+			if err != nil {
+				t.Fatalf(`unexpected error: %s`, err)
+			}
+			opts, err := optionsPlan.databaseOptions(params)
+			if err != nil {
+				t.Fatalf(`unexpected error: %s`, err)
+			}
+			if opts != test.expected {
+				t.Fatalf(`expected options %+v, got: %+v`, test.expected, opts)
+			}
+			if opts.clause() != test.clause {
+				t.Fatalf(`expected clause %q, got: %q`, test.clause, opts.clause())
+			}
+		})
+	}
+
+	if (DatabaseOptions{}).clause() != "" {
+		t.Fatalf(`expected no clause for default options, got: %q`, (DatabaseOptions{}).clause())
+	}
+}
+
+func TestDatabaseOptionsInvalid(t *testing.T) {
+	for _, s := range []string{
+		`{"encoding": "LATIN1"}`,
+		`{"locale": "fr_FR.UTF-8"}`,
+		`{"template": "template1"}`,
+		`{"colation_provider": "icu"}`,
+		`["icu"]`,
+	} {
+		params, err := parseProvisionParameters(json.RawMessage(s))
+		if err == nil {
+			_, err = optionsPlan.databaseOptions(params)
+		}
+		if _, ok := err.(*ParameterError); !ok {
+			t.Fatalf(`expected parameters %s to be rejected, got: %v`, s, err)
+		}
+	}
+}
+
+func TestAPIProvisionRejectsInvalidParameters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	broker := &Broker{db: db, Plans: []Plan{optionsPlan}}
+	broker.Service.ID = "service-id"
+	expectEvent(mock, "provision", outcomeFailed)
+
+	router := mux.NewRouter()
+	AttachRoutes(router, broker, lager.NewLogger("test"))
+
+	req := httptest.NewRequest("PUT", "/v2/service_instances/instance-1?accepts_incomplete=true",
+		strings.NewReader(`{"service_id":"service-id","plan_id":"plan-id","parameters":{"encoding":"LATIN1"}}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf(`expected status %d, got: %d (%s)`, http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "does not let you choose the encoding") {
+		t.Fatalf(`expected an explanation, got: %s`, w.Body.String())
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
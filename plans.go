@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Plan struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	/* nominal size of each instance, in megabytes, for quota purposes */
+	Size int64 `json:"size"`
+
+	/* what instance databases are created with, unless the developer
+	   asks for something else the plan allows */
+	Encoding          Choice `json:"encoding"`
+	Locale            Choice `json:"locale"`
+	CollationProvider Choice `json:"collation_provider"`
+	Template          Choice `json:"template"`
+
+	/* extensions developers may have installed (by the broker) */
+	Extensions []string `json:"extensions"`
+
+	Seed Seed `json:"seed"`
+
+	/* "database" (the default) gives each instance a database of its
+	   own; "schema" gives it a schema in the plan's shared database */
+	Mode           string `json:"mode"`
+	SharedDatabase string `json:"shared_database"`
+
+	/* how long service keys may last, i.e. 24h; empty means forever */
+	MaxServiceKeyTTL string `json:"max_service_key_ttl"`
+	maxKeyTTL        time.Duration
+
+	/* how long each instance lasts, i.e. 720h, before it is suspended;
+	   how long after that it is deleted; and how long before it expires
+	   the developer is warned.  An empty lifetime means forever. */
+	Lifetime    string `json:"lifetime"`
+	GracePeriod string `json:"grace_period"`
+	WarnBefore  string `json:"warn_before"`
+	lifetime    time.Duration
+	grace       time.Duration
+	warn        time.Duration
+
+	/* how long the databases of deleted instances are kept, i.e. 168h,
+	   so that they can be restored; empty means they are dropped */
+	Retention string `json:"retention"`
+	retention time.Duration
+
+	/* how often instances are backed up, i.e. 24h (empty means only on
+	   demand), and how many of their backups are kept */
+	Backups BackupPolicy `json:"backups"`
+}
+
+// loadPlans reads the plans this broker offers from the PLANS
+// environment variable (a JSON list), falling back to the single plan
+// described by PLAN_ID / PLAN_NAME / PLAN_SIZE.
+func loadPlans(description string) ([]Plan, error) {
+	var plans []Plan
+
+	if s := os.Getenv("PLANS"); s != "" {
+		if err := json.Unmarshal([]byte(s), &plans); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if len(plans) == 0 {
+			return nil, fmt.Errorf("PLANS: no plans defined")
+		}
+
+	} else {
+		size, err := strconv.ParseInt(cfg("0", "PLAN_SIZE"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("PLAN_SIZE: '%s' is not a number", os.Getenv("PLAN_SIZE"))
+		}
+		plans = []Plan{{
+			ID:   cfg("postgres-c504319a-61e7-459e-83ac-01243787689b", "PLAN_ID"),
+			Name: cfg("shared", "PLAN_NAME"),
+			Size: size,
+		}}
+	}
+
+	seen := make(map[string]bool)
+	for i := range plans {
+		if plans[i].ID == "" || plans[i].Name == "" {
+			return nil, fmt.Errorf("PLANS: plan #%d is missing its id or name", i+1)
+		}
+		if seen[plans[i].ID] || seen[plans[i].Name] {
+			return nil, fmt.Errorf("PLANS: plan '%s' (%s) is defined more than once", plans[i].Name, plans[i].ID)
+		}
+		seen[plans[i].ID] = true
+		seen[plans[i].Name] = true
+
+		if plans[i].Size < 0 {
+			return nil, fmt.Errorf("PLANS: plan '%s' has a negative size", plans[i].Name)
+		}
+		if err := plans[i].validateOptions(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if err := plans[i].validateExtensions(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if err := plans[i].loadSeed(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if err := plans[i].validateMode(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if err := plans[i].validateTTL(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if err := plans[i].validateLifetime(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if err := plans[i].validateRetention(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if err := plans[i].validateBackups(); err != nil {
+			return nil, fmt.Errorf("PLANS: %w", err)
+		}
+		if plans[i].Description == "" {
+			plans[i].Description = description
+		}
+	}
+
+	return plans, nil
+}
+
+func (b *Broker) plan(id string) (Plan, bool) {
+	for _, p := range b.Plans {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadPlansDefault(t *testing.T) {
+	os.Unsetenv("PLANS")
+	os.Setenv("PLAN_NAME", "tiny")
+	os.Setenv("PLAN_SIZE", "512")
+	defer os.Unsetenv("PLAN_NAME")
+	defer os.Unsetenv("PLAN_SIZE")
+
+	plans, err := loadPlans("A shared PostgreSQL database")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if len(plans) != 1 || plans[0].Name != "tiny" || plans[0].Size != 512 || plans[0].Description != "A shared PostgreSQL database" {
+		t.Fatalf(`unexpected plans: %v`, plans)
+	}
+}
+
+func TestLoadPlansFromJSON(t *testing.T) {
+	os.Setenv("PLANS", `[
+	  {"id": "small-id", "name": "small", "size": 1024},
+	  {"id": "large-id", "name": "large", "size": 10240, "description": "A large database"}
+	]`)
+	defer os.Unsetenv("PLANS")
+
+	plans, err := loadPlans("A shared PostgreSQL database")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if len(plans) != 2 {
+		t.Fatalf(`expected 2 plans, got: %d`, len(plans))
+	}
+	if plans[0].Description != "A shared PostgreSQL database" || plans[1].Description != "A large database" {
+		t.Fatalf(`unexpected plan descriptions: %v`, plans)
+	}
+
+	broker := &Broker{Plans: plans}
+	if p, ok := broker.plan("large-id"); !ok || p.Size != 10240 {
+		t.Fatalf(`expected to find plan large-id, got: %v`, p)
+	}
+	if _, ok := broker.plan("medium-id"); ok {
+		t.Fatalf(`did not expect to find plan medium-id`)
+	}
+}
+
+func TestLoadPlansInvalid(t *testing.T) {
+	defer os.Unsetenv("PLANS")
+
+	for _, s := range []string{
+		`[]`,
+		`{"id": "small-id"}`,
+		`[{"id": "small-id"}]`,
+		`[{"id": "small-id", "name": "small"}, {"id": "small-id", "name": "other"}]`,
+		`[{"id": "small-id", "name": "small", "size": -1}]`,
+		`[{"id": "small-id", "name": "small", "collation_provider": {"allowed": ["builtin"]}}]`,
+		`[{"id": "small-id", "name": "small", "extensions": ["pg_trgm; DROP DATABASE x"]}]`,
+		`[{"id": "small-id", "name": "small", "seed": {"template": "starter"}}]`,
+		`[{"id": "small-id", "name": "small", "seed": {"version": "1", "template": "starter", "file": "seed.sql"}}]`,
+		`[{"id": "small-id", "name": "small", "seed": {"version": "1", "file": "/nonexistent/seed.sql"}}]`,
+		`[{"id": "small-id", "name": "small", "seed": {"version": "1", "template": "starter"}, "template": {"allowed": ["postgis"]}}]`,
+		`[{"id": "small-id", "name": "small", "mode": "cluster"}]`,
+		`[{"id": "small-id", "name": "small", "shared_database": "tenants"}]`,
+		`[{"id": "small-id", "name": "small", "mode": "schema", "shared_database": "Tenants; DROP"}]`,
+		`[{"id": "small-id", "name": "small", "mode": "schema", "extensions": ["pgcrypto"]}]`,
+		`[{"id": "small-id", "name": "small", "max_service_key_ttl": "7d"}]`,
+		`[{"id": "small-id", "name": "small", "max_service_key_ttl": "-1h"}]`,
+		`[{"id": "small-id", "name": "small", "lifetime": "30d"}]`,
+		`[{"id": "small-id", "name": "small", "lifetime": "720h", "grace_period": "-1h"}]`,
+		`[{"id": "small-id", "name": "small", "grace_period": "168h"}]`,
+		`[{"id": "small-id", "name": "small", "retention": "1w"}]`,
+		`[{"id": "small-id", "name": "small", "mode": "schema", "retention": "168h"}]`,
+		`[{"id": "small-id", "name": "small", "backups": {"every": "1d"}}]`,
+		`[{"id": "small-id", "name": "small", "backups": {"keep": -1}}]`,
+		`[{"id": "small-id", "name": "small", "mode": "schema", "shared_database": "tenants", "backups": {"every": "24h"}}]`,
+	} {
+		os.Setenv("PLANS", s)
+		if _, err := loadPlans(""); err == nil {
+			t.Fatalf(`expected PLANS=%s to fail`, s)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Quota limits how many instances (and how many megabytes worth of
+// plan sizes) a single organization or space may have.  A quota with
+// an empty GUID is the default for its scope; nil limits are unlimited.
+type Quota struct {
+	Scope     string `json:"scope"`
+	GUID      string `json:"guid"`
+	Instances *int64 `json:"instances"`
+	Size      *int64 `json:"size"`
+}
+
+type QuotaError struct {
+	Scope string
+	GUID  string
+	msg   string
+}
+
+func (e *QuotaError) Error() string {
+	return e.msg
+}
+
+func validQuotaScope(scope string) bool {
+	return scope == "org" || scope == "space"
+}
+
+func scopeName(scope string) string {
+	if scope == "org" {
+		return "organization"
+	}
+	return scope
+}
+
+func (b *Broker) createQuotaSchemas() {
+	b.db.Exec(`
+CREATE TABLE IF NOT EXISTS
+quotas (
+  scope     TEXT NOT NULL,
+  guid      TEXT NOT NULL DEFAULT '',
+  instances BIGINT,
+  size      BIGINT,
+  UNIQUE (scope, guid)
+)`)
+}
+
+func (b *Broker) Quotas() ([]Quota, error) {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+	r, err := b.db.QueryContext(ctx, `SELECT scope, guid, instances, size FROM quotas ORDER BY scope, guid`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Quota, 0)
+	for r.Next() {
+		var (
+			q               Quota
+			instances, size sql.NullInt64
+		)
+		if err := r.Scan(&q.Scope, &q.GUID, &instances, &size); err != nil {
+			return nil, err
+		}
+		if instances.Valid {
+			q.Instances = &instances.Int64
+		}
+		if size.Valid {
+			q.Size = &size.Int64
+		}
+		l = append(l, q)
+	}
+	return l, r.Err()
+}
+
+func (b *Broker) SetQuota(q Quota) error {
+	if !validQuotaScope(q.Scope) {
+		return fmt.Errorf("invalid quota scope '%s' (must be 'org' or 'space')", q.Scope)
+	}
+	if (q.Instances != nil && *q.Instances < 0) || (q.Size != nil && *q.Size < 0) {
+		return fmt.Errorf("quota limits cannot be negative")
+	}
+
+	_, err := b.exec(context.Background(), `
+INSERT INTO quotas (scope, guid, instances, size) VALUES ($1, $2, $3, $4)
+  ON CONFLICT (scope, guid) DO UPDATE SET instances = $3, size = $4`,
+		q.Scope, q.GUID, q.Instances, q.Size)
+	if err != nil {
+		return err
+	}
+
+	b.notify("quota.updated", q)
+	return nil
+}
+
+func (b *Broker) DeleteQuota(scope, guid string) (bool, error) {
+	r, err := b.exec(context.Background(), `DELETE FROM quotas WHERE scope = $1 AND guid = $2`, scope, guid)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if n > 0 {
+		b.notify("quota.deleted", Quota{Scope: scope, GUID: guid})
+	}
+	return n > 0, err
+}
+
+// querier is either the broker's database, or a transaction on it.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// quotaFor finds the quota that applies to an organization or space,
+// preferring an explicit override to the default for that scope.  In
+// a transaction, the quota stays locked until it commits, so that
+// concurrent provisions can't both squeeze into the last slot.
+func quotaFor(db querier, scope, guid string) (*Quota, error) {
+	var instances, size sql.NullInt64
+	r, err := db.Query(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '') ORDER BY guid DESC LIMIT 1 FOR UPDATE`, scope, guid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if !r.Next() {
+		return nil, r.Err()
+	}
+	if err := r.Scan(&instances, &size); err != nil {
+		return nil, err
+	}
+
+	q := &Quota{Scope: scope, GUID: guid}
+	if instances.Valid {
+		q.Instances = &instances.Int64
+	}
+	if size.Valid {
+		q.Size = &size.Int64
+	}
+	return q, nil
+}
+
+// usage counts the instances (and plan sizes) of an organization or
+// space, other than the instance being provisioned.
+func (b *Broker) usage(db querier, scope, guid, instance string) (int64, int64, error) {
+	r, err := db.Query(`SELECT COALESCE(plan, ''), COUNT(*) FROM dbs WHERE `+scope+` = $1 AND state <> 'gone' AND instance <> $2 GROUP BY plan`, guid, instance)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	var instances, size int64
+	for r.Next() {
+		var (
+			plan string
+			n    int64
+		)
+		if err := r.Scan(&plan, &n); err != nil {
+			return 0, 0, err
+		}
+		instances += n
+		if p, ok := b.plan(plan); ok {
+			size += n * p.Size
+		}
+	}
+	return instances, size, r.Err()
+}
+
+// CheckQuotas checks that an instance fits in its organization's and
+// space's quotas, alongside all their other instances.
+func (b *Broker) CheckQuotas(db querier, inst Instance) error {
+	plan, _ := b.plan(inst.Plan)
+
+	for _, scope := range []string{"org", "space"} {
+		guid := inst.Organization
+		if scope == "space" {
+			guid = inst.Space
+		}
+		if guid == "" {
+			continue
+		}
+
+		quota, err := quotaFor(db, scope, guid)
+		if err != nil {
+			return fmt.Errorf("unable to check %s quota: %w", scopeName(scope), err)
+		}
+		if quota == nil || (quota.Instances == nil && quota.Size == nil) {
+			continue
+		}
+
+		instances, size, err := b.usage(db, scope, guid, inst.ID)
+		if err != nil {
+			return fmt.Errorf("unable to check %s quota: %w", scopeName(scope), err)
+		}
+
+		if quota.Instances != nil && instances+1 > *quota.Instances {
+			return &QuotaError{
+				Scope: scope,
+				GUID:  guid,
+				msg: fmt.Sprintf("Quota exceeded: this %s already has %d of the %d %s instances it is allowed.  Please delete unused instances, or ask your operator to raise the quota.",
+					scopeName(scope), instances, *quota.Instances, b.Service.Name),
+			}
+		}
+		if quota.Size != nil && size+plan.Size > *quota.Size {
+			return &QuotaError{
+				Scope: scope,
+				GUID:  guid,
+				msg: fmt.Sprintf("Quota exceeded: a new '%s' instance (%d MB) would bring this %s to %d MB of %s, but it is only allowed %d MB.  Please delete unused instances, choose a smaller plan, or ask your operator to raise the quota.",
+					plan.Name, plan.Size, scopeName(scope), size+plan.Size, b.Service.Name, *quota.Size),
+			}
+		}
+	}
+
+	return nil
+}
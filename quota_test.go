@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func quotaBroker(t *testing.T) (*Broker, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	broker := &Broker{
+		db: db,
+		Plans: []Plan{
+			{ID: "small-id", Name: "small", Size: 1024},
+			{ID: "large-id", Name: "large", Size: 10240},
+		},
+	}
+	broker.Service.ID = "service-id"
+	broker.Service.Name = "postgres"
+	return broker, mock
+}
+
+func TestCheckQuotasNoQuotas(t *testing.T) {
+	broker, mock := quotaBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '')`)).
+		WithArgs("org", "org-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '')`)).
+		WithArgs("space", "space-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}))
+
+	if err := broker.CheckQuotas(broker.db, Instance{Plan: "small-id", Organization: "org-1", Space: "space-1"}); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCheckQuotasInstanceLimit(t *testing.T) {
+	broker, mock := quotaBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '')`)).
+		WithArgs("org", "org-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}).AddRow(3, nil))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(plan, ''), COUNT(*) FROM dbs WHERE org = $1 AND state <> 'gone' AND instance <> $2 GROUP BY plan`)).
+		WithArgs("org-1", "").
+		WillReturnRows(sqlmock.NewRows([]string{"plan", "count"}).AddRow("small-id", 2).AddRow("large-id", 1))
+
+	err := broker.CheckQuotas(broker.db, Instance{Plan: "small-id", Organization: "org-1", Space: "space-1"})
+	var quota *QuotaError
+	if !errors.As(err, &quota) {
+		t.Fatalf(`expected a quota error, got: %v`, err)
+	}
+	if quota.Scope != "org" || !strings.Contains(err.Error(), "3 of the 3 postgres instances") {
+		t.Fatalf(`unexpected quota error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCheckQuotasSizeLimit(t *testing.T) {
+	broker, mock := quotaBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '')`)).
+		WithArgs("org", "org-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '')`)).
+		WithArgs("space", "space-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}).AddRow(nil, 12288))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(plan, ''), COUNT(*) FROM dbs WHERE space = $1 AND state <> 'gone' AND instance <> $2 GROUP BY plan`)).
+		WithArgs("space-1", "").
+		WillReturnRows(sqlmock.NewRows([]string{"plan", "count"}).AddRow("small-id", 2))
+
+	/* 2x small + 1x large would be 12 GiB, which fits... */
+	if err := broker.CheckQuotas(broker.db, Instance{Plan: "large-id", Organization: "org-1", Space: "space-1"}); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '')`)).
+		WithArgs("org", "org-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '')`)).
+		WithArgs("space", "space-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}).AddRow(nil, 12288))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(plan, ''), COUNT(*) FROM dbs WHERE space = $1 AND state <> 'gone' AND instance <> $2 GROUP BY plan`)).
+		WithArgs("space-1", "").
+		WillReturnRows(sqlmock.NewRows([]string{"plan", "count"}).AddRow("small-id", 2).AddRow("large-id", 1))
+
+	/* ... but another small one would not */
+	err := broker.CheckQuotas(broker.db, Instance{Plan: "small-id", Organization: "org-1", Space: "space-1"})
+	var quota *QuotaError
+	if !errors.As(err, &quota) || quota.Scope != "space" {
+		t.Fatalf(`expected a space quota error, got: %v`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestProvisionQuotaExceeded(t *testing.T) {
+	broker, mock := quotaBroker(t)
+	defer broker.db.Close()
+
+	/* the quota is checked once the new instance is in, and takes it back out */
+	expectNoInstance(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM dbs WHERE instance = $1 AND state = 'gone'`)).
+		WithArgs("instance-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`) + `.* ON CONFLICT \(instance\) DO NOTHING`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instances, size FROM quotas WHERE scope = $1 AND guid IN ($2, '') ORDER BY guid DESC LIMIT 1 FOR UPDATE`)).
+		WithArgs("org", "org-1").
+		WillReturnRows(sqlmock.NewRows([]string{"instances", "size"}).AddRow(0, nil))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(plan, ''), COUNT(*) FROM dbs WHERE org = $1 AND state <> 'gone' AND instance <> $2`)).
+		WithArgs("org-1", "instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"plan", "count"}))
+	mock.ExpectRollback()
+	expectEvent(mock, "provision", outcomeFailed)
+
+	_, err := broker.Provision("instance-1", brokerapi.ProvisionDetails{
+		ServiceID:        "service-id",
+		PlanID:           "small-id",
+		OrganizationGUID: "org-1",
+		SpaceGUID:        "space-1",
+	}, true)
+	var quota *QuotaError
+	if !errors.As(err, &quota) {
+		t.Fatalf(`expected a quota error, got: %v`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
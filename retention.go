@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var ErrNoTombstone = errors.New("no deleted database is being kept for this instance")
+
+// Tombstone is the database of a deleted instance, kept (renamed, and
+// shut off) for the plan's retention period in case it was deleted by
+// mistake.
+type Tombstone struct {
+	Name         string          `json:"name"`
+	Database     string          `json:"database"`
+	Instance     string          `json:"instance"`
+	Plan         string          `json:"plan"`
+	InstanceName string          `json:"instance_name,omitempty"`
+	Organization string          `json:"organization"`
+	Space        string          `json:"space"`
+	Options      DatabaseOptions `json:"options"`
+	Extensions   []string        `json:"extensions,omitempty"`
+	Seed         string          `json:"seed,omitempty"`
+	Deleted      time.Time       `json:"deleted"`
+	Purge        time.Time       `json:"purge_after"`
+}
+
+func (p *Plan) validateRetention() error {
+	if p.Retention == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(p.Retention)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("plan '%s' has an invalid retention '%s' (try i.e. 168h)", p.Name, p.Retention)
+	}
+	if p.Mode == "schema" {
+		return fmt.Errorf("plan '%s' gives each instance a schema, so it cannot keep deleted instances", p.Name)
+	}
+	p.retention = d
+	return nil
+}
+
+func (b *Broker) createTombstoneSchemas() {
+	b.db.Exec(`
+CREATE TABLE IF NOT EXISTS
+tombstones (
+  name          TEXT NOT NULL PRIMARY KEY,
+  db            TEXT NOT NULL,
+  instance      TEXT NOT NULL,
+  plan          TEXT,
+  org           TEXT,
+  space         TEXT,
+  instance_name TEXT,
+  options       TEXT,
+  extensions    TEXT,
+  seed          TEXT,
+  deleted       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  purge         TIMESTAMP WITH TIME ZONE NOT NULL
+)`)
+	b.db.Exec(`CREATE INDEX IF NOT EXISTS tombstones_instance_idx ON tombstones (instance)`)
+}
+
+// tombstoneName is what an instance database is renamed to when it is
+// deleted; it is still a valid identifier, and always the same, so that
+// a failed deprovision can be retried.
+func tombstoneName(db string) string {
+	return "deleted_" + db
+}
+
+// entomb takes the place of dropping an instance's database on plans
+// that keep deleted instances: the users go, as usual, but the database
+// is only shut and renamed.  It returns the step that failed, if any.
+func (b *Broker) entomb(ctx context.Context, inst Instance, users []string, retention time.Duration) (string, error) {
+	db := inst.Database
+	tomb := tombstoneName(db)
+
+	/* recorded first, so that a database renamed by an attempt that
+	   failed halfway is never lost track of */
+	options, _ := json.Marshal(inst.Options)
+	extensions, _ := json.Marshal(inst.Extensions)
+	if _, err := b.exec(ctx, `INSERT INTO tombstones (name, db, instance, plan, org, space, instance_name, options, extensions, seed, purge)
+     VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+  ON CONFLICT (name) DO UPDATE SET purge = $11`,
+		tomb, db, inst.ID, inst.Plan, inst.Organization, inst.Space, inst.Name, options, extensions, inst.Seed, time.Now().Add(retention)); err != nil {
+		return "recording the deleted database", err
+	}
+
+	for _, user := range users {
+		if err := b.dropOwner(ctx, db, db, user); err != nil {
+			return "dropping user " + user, err
+		}
+	}
+
+	_, err := b.execBackend(ctx, `ALTER DATABASE `+db+` ALLOW_CONNECTIONS false`)
+	if isPqError(err, "3D000") {
+		info("instance database %s has already been renamed to %s, continuing\n", db, tomb)
+		return "", nil
+	}
+	if err != nil {
+		return "closing the instance database", err
+	}
+	if _, err := b.execBackend(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()`, db); err != nil {
+		return "terminating sessions to the instance database", err
+	}
+	if _, err := b.execBackend(ctx, `ALTER DATABASE `+db+` RENAME TO `+tomb); err != nil {
+		return "renaming the instance database", err
+	}
+	info("kept instance database %s as %s, for %s\n", db, tomb, retention)
+	return "", nil
+}
+
+// dropOwner drops a binding's user; anything the user still owns in db
+// is handed to the instance role first.
+func (b *Broker) dropOwner(ctx context.Context, db, role, user string) error {
+	_, err := b.execBackend(ctx, `DROP USER `+user)
+	if !isPqError(err, "2BP01") {
+		if isPqError(err, "42704") {
+			return nil
+		}
+		return err
+	}
+
+	conn, err := b.tenant(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	sctx, cancel := b.statement(ctx)
+	_, err = conn.ExecContext(sctx, `REASSIGN OWNED BY `+user+` TO `+role)
+	cancel()
+	if err != nil {
+		return err
+	}
+	_, err = b.execBackend(ctx, `DROP USER `+user)
+	return err
+}
+
+const tombstoneColumns string = `
+name, db, instance, COALESCE(plan, ''), COALESCE(instance_name, ''), COALESCE(org, ''), COALESCE(space, ''),
+COALESCE(options, '{}'), COALESCE(extensions, 'null'), COALESCE(seed, ''), deleted, purge`
+
+func scanTombstone(r *sql.Rows) (Tombstone, error) {
+	var (
+		t          Tombstone
+		options    string
+		extensions string
+	)
+	err := r.Scan(&t.Name, &t.Database, &t.Instance, &t.Plan, &t.InstanceName, &t.Organization, &t.Space,
+		&options, &extensions, &t.Seed, &t.Deleted, &t.Purge)
+	if err != nil {
+		return t, err
+	}
+	t.Instance = strings.TrimSpace(t.Instance)
+	json.Unmarshal([]byte(options), &t.Options)
+	json.Unmarshal([]byte(extensions), &t.Extensions)
+	return t, nil
+}
+
+// Tombstones lists the deleted databases being kept, most recently
+// deleted first, optionally only those of one instance.
+func (b *Broker) Tombstones(instance string) ([]Tombstone, error) {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `SELECT `+tombstoneColumns+` FROM tombstones
+ WHERE $1 = '' OR instance = $1 ORDER BY deleted DESC`, instance)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Tombstone, 0)
+	for r.Next() {
+		t, err := scanTombstone(r)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, t)
+	}
+	return l, r.Err()
+}
+
+// Restore brings back the most recently deleted database of an
+// instance, as the instance `as` (or under its original ID, if that is
+// empty), which must not already exist.
+func (b *Broker) Restore(instance, as string) (*Instance, error) {
+	ctx, cancel := operation(b.ProvisionTimeout)
+	defer cancel()
+
+	l, err := b.Tombstones(instance)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) == 0 {
+		return nil, ErrNoTombstone
+	}
+	t := l[0]
+	if as == "" {
+		as = instance
+	}
+
+	existing, err := b.GetInstance(as)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.State != "gone" {
+		return nil, brokerapi.ErrInstanceAlreadyExists
+	}
+
+	/* a restore that failed halfway may have renamed it back already */
+	if _, err := b.execBackend(ctx, `ALTER DATABASE `+t.Name+` RENAME TO `+t.Database); err != nil && !isPqError(err, "3D000") {
+		return nil, fmt.Errorf("unable to rename %s back to %s: %w", t.Name, t.Database, err)
+	}
+	if _, err := b.execBackend(ctx, `ALTER DATABASE `+t.Database+` ALLOW_CONNECTIONS true`); err != nil {
+		return nil, fmt.Errorf("unable to allow connections to %s: %w", t.Database, err)
+	}
+
+	options, _ := json.Marshal(t.Options)
+	extensions, _ := json.Marshal(t.Extensions)
+	if _, err := b.exec(ctx, `DELETE FROM dbs WHERE state = 'gone' AND (TRIM(name) = $1 OR instance = $2)`, t.Database, as); err != nil {
+		return nil, err
+	}
+	if _, err := b.exec(ctx, `INSERT INTO dbs (instance, name, state, expires, plan, org, space, instance_name, started, options, extensions, seed)
+     VALUES ($1, $2, 'done', $3, $4, $5, $6, $7, now(), $8, $9, NULLIF($10, ''))`,
+		as, t.Database, b.trialExpiry(t.Plan), t.Plan, t.Organization, t.Space, t.InstanceName, options, extensions, t.Seed); err != nil {
+		return nil, err
+	}
+	if _, err := b.exec(ctx, `DELETE FROM tombstones WHERE name = $1`, t.Name); err != nil {
+		return nil, err
+	}
+
+	inst, err := b.GetInstance(as)
+	if err != nil || inst == nil {
+		return nil, fmt.Errorf("restored %s as instance %s, but unable to look it up: %v", t.Database, as, err)
+	}
+	info("restored instance %s (deleted at %s) as %s\n", instance, t.Deleted.UTC().Format(time.RFC3339), as)
+	b.notify("instance.restored", inst)
+	return inst, nil
+}
+
+// PurgeTombstones drops the deleted databases whose retention period
+// is over, along with their instance roles.
+func (b *Broker) PurgeTombstones() {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+	r, err := b.db.QueryContext(ctx, `SELECT name, db, instance FROM tombstones WHERE purge < now()`)
+	if err != nil {
+		oops("failed to check for deleted databases to purge: %s\n", err)
+		return
+	}
+	var purge []Tombstone
+	for r.Next() {
+		var t Tombstone
+		if err := r.Scan(&t.Name, &t.Database, &t.Instance); err != nil {
+			oops("failed to check for deleted databases to purge: %s\n", err)
+			r.Close()
+			return
+		}
+		t.Instance = strings.TrimSpace(t.Instance)
+		purge = append(purge, t)
+	}
+	r.Close()
+
+	for _, t := range purge {
+		ctx, cancel := operation(b.DeprovisionTimeout)
+		err := b.purgeTombstone(ctx, t)
+		cancel()
+		b.record(Event{
+			Operation: "purge",
+			Instance:  t.Instance,
+			Identity:  "janitor",
+			Outcome:   outcome(err, outcomeSucceeded),
+			Error:     errorString(err),
+		})
+		if err != nil {
+			oops("failed to purge deleted database %s: %s\n", t.Name, err)
+			continue
+		}
+		info("purged deleted database %s of instance %s\n", t.Name, t.Instance)
+	}
+}
+
+func (b *Broker) purgeTombstone(ctx context.Context, t Tombstone) error {
+	if _, err := b.execBackend(ctx, `DROP DATABASE `+t.Name); err != nil && !isPqError(err, "3D000") {
+		return err
+	}
+	if _, err := b.execBackend(ctx, `DROP ROLE IF EXISTS `+t.Database); err != nil {
+		return err
+	}
+	_, err := b.exec(ctx, `DELETE FROM tombstones WHERE name = $1`, t.Name)
+	return err
+}
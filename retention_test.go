@@ -0,0 +1,157 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var tombstoneRowColumns = []string{"name", "db", "instance", "plan", "instance_name", "org", "space",
+	"options", "extensions", "seed", "deleted", "purge"}
+
+func retentionBroker(t *testing.T) (*Broker, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	broker, mock, tenant := tenantBroker(t)
+	broker.Plans = []Plan{{ID: "plan-id", Name: "kept", Retention: "168h", retention: 168 * time.Hour}}
+	return broker, mock, tenant
+}
+
+func TestTeardownKeepsDatabase(t *testing.T) {
+	broker, mock, tenant := retentionBroker(t)
+	defer broker.db.Close()
+
+	expectInstance(mock, "done", "")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'teardown'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.name FROM creds`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("u1"))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO tombstones`)).
+		WithArgs(tombstoneName(mockDbName), mockDbName, "instance-1", "plan-id", "org-id", "space-id", "", sqlmock.AnyArg(), sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP USER u1`)).
+		WillReturnError(&pq.Error{Code: "2BP01", Message: "role cannot be dropped because some objects depend on it"})
+	tenant.ExpectExec(regexp.QuoteMeta(`REASSIGN OWNED BY u1 TO ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP USER u1`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` ALLOW_CONNECTIONS false`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity`)).
+		WithArgs(mockDbName).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` RENAME TO ` + tombstoneName(mockDbName))).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM creds WHERE db = $1`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'gone'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "deprovision", outcomeSucceeded)
+
+	broker.Teardown("instance-1")
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func expectTombstone(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM tombstones`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(tombstoneRowColumns).
+			AddRow(tombstoneName(mockDbName), mockDbName, "instance-1", "plan-id", "my-db", "org-id", "space-id",
+				"{}", "[]", "", time.Now().Add(-time.Hour), time.Now().Add(167*time.Hour)))
+}
+
+func TestRestoreAsNewInstance(t *testing.T) {
+	broker, mock, _ := retentionBroker(t)
+	defer broker.db.Close()
+
+	expectTombstone(mock)
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WithArgs("instance-2").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + tombstoneName(mockDbName) + ` RENAME TO ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` ALLOW_CONNECTIONS true`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM dbs WHERE state = 'gone'`)).
+		WithArgs(mockDbName, "instance-2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WithArgs("instance-2", mockDbName, int64(0), "plan-id", "org-id", "space-id", "my-db", []byte(`{}`), []byte(`[]`), "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM tombstones WHERE name = $1`)).
+		WithArgs(tombstoneName(mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WithArgs("instance-2").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-2", mockDbName, "done", "plan-id", "my-db", "org-id", "space-id", "", time.Now(), "", "", "", "", "{}", "[]", "", "", "", nil, ""))
+
+	inst, err := broker.Restore("instance-1", "instance-2")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if inst.ID != "instance-2" || inst.State != "done" {
+		t.Fatalf(`expected instance-2 to be restored, got: %+v`, inst)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestoreRefusesExistingInstance(t *testing.T) {
+	broker, mock, _ := retentionBroker(t)
+	defer broker.db.Close()
+
+	expectTombstone(mock)
+	expectInstance(mock, "done", "")
+	if _, err := broker.Restore("instance-1", ""); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Fatalf(`expected ErrInstanceAlreadyExists, got: %v`, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM tombstones`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(tombstoneRowColumns))
+	if _, err := broker.Restore("instance-1", ""); err != ErrNoTombstone {
+		t.Fatalf(`expected ErrNoTombstone, got: %v`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	broker, mock, _ := retentionBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, db, instance FROM tombstones WHERE purge < now()`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "db", "instance"}).
+			AddRow(tombstoneName(mockDbName), mockDbName, "instance-1"))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE ` + tombstoneName(mockDbName))).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP ROLE IF EXISTS ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM tombstones WHERE name = $1`)).
+		WithArgs(tombstoneName(mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock, "purge", outcomeSucceeded)
+
+	broker.PurgeTombstones()
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 wants every part of a multipart upload but the last to be at
+// least 5MiB, and allows at most 10,000 of them.
+const defaultPartSize = 16 * 1024 * 1024
+
+/* the SHA-256 of nothing at all, for requests without a body */
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// ObjectStore is an S3-compatible bucket (AWS, MinIO, Ceph, ...) that
+// backups are kept in.  Requests are signed with AWS Signature Version
+// 4, and use path-style URLs, which every implementation understands.
+type ObjectStore struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+
+	PartSize int
+	client   *http.Client
+}
+
+// backupStore configures where backups go from the environment; with
+// no SB_BACKUP_ENDPOINT, backups are disabled.
+func backupStore() (*ObjectStore, error) {
+	endpoint := os.Getenv("SB_BACKUP_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("SB_BACKUP_ENDPOINT: '%s' is not an http(s) URL", endpoint)
+	}
+
+	s := &ObjectStore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    cfg("us-east-1", "SB_BACKUP_REGION"),
+		Bucket:    os.Getenv("SB_BACKUP_BUCKET"),
+		Prefix:    strings.Trim(os.Getenv("SB_BACKUP_PREFIX"), "/"),
+		AccessKey: os.Getenv("SB_BACKUP_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("SB_BACKUP_SECRET_ACCESS_KEY"),
+	}
+	if s.Bucket == "" {
+		return nil, fmt.Errorf("SB_BACKUP_BUCKET: no bucket given for backups")
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("SB_BACKUP_ACCESS_KEY_ID / SB_BACKUP_SECRET_ACCESS_KEY: no credentials given for backups")
+	}
+	return s, nil
+}
+
+// key is where an object lives in the bucket, under the prefix.
+func (s *ObjectStore) key(name string) string {
+	if s.Prefix == "" {
+		return name
+	}
+	return s.Prefix + "/" + name
+}
+
+func (s *ObjectStore) url(key string, query url.Values) string {
+	u := s.Endpoint + "/" + s.Bucket + "/" + escapePath(s.key(key))
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	return u
+}
+
+// escapePath URI-encodes an object key the way SigV4 wants it, which
+// is stricter than net/url: everything but unreserved characters (and
+// the slashes between segments) is escaped.
+func escapePath(key string) string {
+	return uriEncode(key, true)
+}
+
+func uriEncode(s string, slashes bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && slashes) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var l []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			l = append(l, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+	return strings.Join(l, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to a
+// request, covering the host and every header already set on it.
+func (s *ObjectStore) sign(req *http.Request, payload string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(escapePath(req.URL.Path) + "\n")
+	canonical.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + payload)
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hashSHA256([]byte(canonical.String()))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, signature))
+}
+
+// do sends a signed request, and turns anything but a 2xx response into
+// an error (S3 explains itself in an XML body).
+func (s *ObjectStore) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	var r io.Reader
+	payload := emptySHA256
+	if body != nil {
+		r = bytes.NewReader(body)
+		payload = hashSHA256(body)
+	}
+	req, err := http.NewRequest(method, s.url(key, query), r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	s.sign(req, payload, time.Now())
+
+	client := s.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+		if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("%s %s: %s (%s)", method, s.key(key), e.Message, e.Code)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, s.key(key), res.Status)
+	}
+	return res, nil
+}
+
+// Put uploads everything read from r, returning how much there was.
+// Anything that fits in a single part is uploaded in one go; anything
+// bigger is streamed up a part at a time, so that a backup never has
+// to be kept whole in memory (or on disk).
+func (s *ObjectStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	size := s.PartSize
+	if size <= 0 {
+		size = defaultPartSize
+	}
+
+	part := make([]byte, size)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		res, err := s.do(ctx, "PUT", key, nil, part[:n])
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&upload)
+	res.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("unable to start a multipart upload of %s: %w", s.key(key), err)
+	}
+
+	total, err := s.upload(ctx, key, upload.UploadID, r, part, n)
+	if err != nil {
+		/* so that the parts already uploaded aren't kept (and paid for) */
+		if res, aerr := s.do(context.Background(), "DELETE", key, url.Values{"uploadId": {upload.UploadID}}, nil); aerr == nil {
+			res.Body.Close()
+		}
+		return 0, err
+	}
+	return total, nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *ObjectStore) upload(ctx context.Context, key, id string, r io.Reader, part []byte, n int) (int64, error) {
+	var parts []completedPart
+	var total int64
+	for number := 1; n > 0; number++ {
+		res, err := s.do(ctx, "PUT", key, url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {id}}, part[:n])
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: res.Header.Get("ETag")})
+		total += int64(n)
+
+		n, err = io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	res, err := s.do(ctx, "POST", key, url.Values{"uploadId": {id}}, body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	/* a failed completion can still come back as a 200 */
+	var e struct {
+		XMLName xml.Name
+		Message string `xml:"Message"`
+	}
+	if xml.NewDecoder(res.Body).Decode(&e) == nil && e.XMLName.Local == "Error" {
+		return 0, fmt.Errorf("unable to complete the multipart upload of %s: %s", s.key(key), e.Message)
+	}
+	return total, nil
+}
+
+// Get downloads an object; the caller has to close it.
+func (s *ObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Delete removes an object; deleting one that is already gone is fine.
+func (s *ObjectStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, "DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
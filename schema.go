@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+var validIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+func (c Choice) empty() bool {
+	return c.Default == "" && len(c.Allowed) == 0
+}
+
+// validateMode checks that a plan's instances are either databases of
+// their own (the default) or schemas in a shared database, and that
+// schema plans don't ask for anything only a database can have.
+func (p *Plan) validateMode() error {
+	switch p.Mode {
+	case "", "database":
+		if p.SharedDatabase != "" {
+			return fmt.Errorf("plan '%s' has a shared database, but is not a schema plan", p.Name)
+		}
+		return nil
+	case "schema":
+	default:
+		return fmt.Errorf("plan '%s' has unknown mode '%s' (only database and schema are supported)", p.Name, p.Mode)
+	}
+
+	if p.SharedDatabase == "" {
+		p.SharedDatabase = "tenants"
+	}
+	if !validIdentifier.MatchString(p.SharedDatabase) || p.SharedDatabase == brokerDatabaseName {
+		return fmt.Errorf("plan '%s' has an invalid shared database name '%s'", p.Name, p.SharedDatabase)
+	}
+	if !p.Encoding.empty() || !p.Locale.empty() || !p.CollationProvider.empty() || !p.Template.empty() ||
+		len(p.Extensions) > 0 || p.Seed != (Seed{}) {
+		return fmt.Errorf("plan '%s' gives each instance a schema, so it cannot set database options, extensions or a seed", p.Name)
+	}
+	return nil
+}
+
+// createSchema sets up a schema instance: a role that owns a schema of
+// the same name in the plan's shared database, which is itself created
+// on first use.  It returns the step that failed, if any.
+func (b *Broker) createSchema(ctx context.Context, inst Instance) (string, error) {
+	shared := inst.SharedDatabase
+	if _, err := b.exec(ctx, `UPDATE dbs SET shared_db = $2 WHERE instance = $1`, inst.ID, shared); err != nil {
+		return "recording the shared database", err
+	}
+
+	/* two instances can race to create the shared database */
+	_, err := b.execBackend(ctx, `CREATE DATABASE `+shared)
+	if err != nil && !isPqError(err, "42P04") && !isPqError(err, "23505") {
+		return "creating the shared database", err
+	}
+	if _, err := b.execBackend(ctx, `REVOKE ALL ON DATABASE `+shared+` FROM PUBLIC`); err != nil {
+		return "revoking public access to the shared database", err
+	}
+
+	_, err = b.execBackend(ctx, `CREATE ROLE `+inst.Database+` NOLOGIN`)
+	if isPqError(err, "42710") {
+		info("instance role %s already exists, continuing\n", inst.Database)
+		err = nil
+	}
+	if err != nil {
+		return "creating the instance role", err
+	}
+
+	conn, err := b.tenant(shared)
+	if err != nil {
+		return "connecting to the shared database", err
+	}
+	defer conn.Close()
+
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+	if _, err := conn.ExecContext(sctx, `REVOKE ALL ON SCHEMA public FROM PUBLIC`); err != nil {
+		return "revoking public access to the public schema", err
+	}
+	if _, err := conn.ExecContext(sctx, `CREATE SCHEMA IF NOT EXISTS `+inst.Database+` AUTHORIZATION `+inst.Database); err != nil {
+		return "creating the instance schema", err
+	}
+	return "", nil
+}
+
+// grantSchema lets a binding's user into its instance's schema, and no
+// further: it can connect to the shared database, and logs in as (and
+// with the search path of) the role that owns the schema, so that
+// everything it creates belongs to the instance, not the binding.
+func (b *Broker) grantSchema(ctx context.Context, t bindTarget, user string) error {
+	for _, q := range []string{
+		`GRANT CONNECT ON DATABASE ` + t.Database + ` TO ` + user,
+		`GRANT ` + t.Schema + ` TO ` + user,
+		`ALTER ROLE ` + user + ` SET role = ` + t.Schema,
+		`ALTER ROLE ` + user + ` SET search_path = ` + t.Schema,
+	} {
+		if _, err := b.execBackend(ctx, q); err != nil {
+			b.execBackend(ctx, `REVOKE ALL PRIVILEGES ON DATABASE `+t.Database+` FROM `+user)
+			b.execBackend(ctx, `DROP USER `+user)
+			return fmt.Errorf("failed to grant schema access to user: %w", err)
+		}
+	}
+	return nil
+}
+
+// dropSchema tears down a schema instance, along with its bindings'
+// users and its role.  It returns the step that failed, if any.
+func (b *Broker) dropSchema(ctx context.Context, inst Instance, users []string) (string, error) {
+	conn, err := b.tenant(inst.SharedDatabase)
+	if err != nil {
+		return "connecting to the shared database", err
+	}
+	defer conn.Close()
+
+	sctx, cancel := b.statement(ctx)
+	_, err = conn.ExecContext(sctx, `DROP SCHEMA IF EXISTS `+inst.Database+` CASCADE`)
+	cancel()
+	if err != nil {
+		return "dropping instance schema", err
+	}
+
+	for _, user := range users {
+		/* users can't be dropped while they can still connect */
+		_, err := b.execBackend(ctx, `REVOKE ALL PRIVILEGES ON DATABASE `+inst.SharedDatabase+` FROM `+user)
+		if err == nil || isPqError(err, "42704") {
+			_, err = b.execBackend(ctx, `DROP USER `+user)
+		}
+		if err != nil && !isPqError(err, "42704") {
+			return "dropping user " + user, err
+		}
+	}
+
+	if _, err := b.execBackend(ctx, `DROP ROLE IF EXISTS `+inst.Database); err != nil {
+		return "dropping instance role", err
+	}
+	return "", nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadPlansSchemaMode(t *testing.T) {
+	os.Setenv("PLANS", `[{"id": "dev-id", "name": "dev", "mode": "schema"}]`)
+	defer os.Unsetenv("PLANS")
+
+	plans, err := loadPlans("")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if plans[0].SharedDatabase != "tenants" {
+		t.Fatalf(`expected the default shared database, got: %s`, plans[0].SharedDatabase)
+	}
+}
+
+func TestSetupCreatesSchema(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET shared_db = $2 WHERE instance = $1`)).
+		WithArgs("instance-1", mockDbName).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON DATABASE ` + mockDbName + ` FROM PUBLIC`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE ROLE dbschema NOLOGIN`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectExec(regexp.QuoteMeta(`REVOKE ALL ON SCHEMA public FROM PUBLIC`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectExec(regexp.QuoteMeta(`CREATE SCHEMA IF NOT EXISTS dbschema AUTHORIZATION dbschema`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'setup'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "provision", outcomeSucceeded)
+
+	broker.Setup(Instance{ID: "instance-1", Database: "dbschema", Plan: "plan-id", SharedDatabase: mockDbName})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGrantSchemaInstance(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "state", "populated", "shared_db"}).AddRow("dbschema", "done", false, "tenants"))
+	mock.ExpectExec(`CREATE USER`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`GRANT CONNECT ON DATABASE tenants TO u[0-9a-z]{16}`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`GRANT dbschema TO u[0-9a-z]{16}`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`ALTER ROLE u[0-9a-z]{16} SET role = dbschema`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`ALTER ROLE u[0-9a-z]{16} SET search_path = dbschema`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO creds`)).
+		WithArgs("binding-1", "dbschema", sqlmock.AnyArg(), sqlmock.AnyArg(), "", "", nil, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	binding, _, err := broker.Grant("instance-1", Binding{ID: "binding-1"})
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if binding.Database != "tenants" || binding.Schema != "dbschema" {
+		t.Fatalf(`expected a binding to schema dbschema in tenants, got: %+v`, binding)
+	}
+	creds := broker.credentials(binding.Username, "secret", binding.Database, binding.Schema)
+	if creds["schema"] != "dbschema" {
+		t.Fatalf(`expected the credentials to name the schema, got: %v`, creds)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTeardownDropsSchema(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", "dbschema", "done", "plan-id", "", "org-1", "space-1", "", time.Now(), "", "", "", "", "{}", "null", "", "", mockDbName, nil, ""))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'teardown'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.name FROM creds`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("u0123456789abcdef"))
+	tenant.ExpectExec(regexp.QuoteMeta(`DROP SCHEMA IF EXISTS dbschema CASCADE`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`REVOKE ALL PRIVILEGES ON DATABASE ` + mockDbName + ` FROM u0123456789abcdef`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP USER u0123456789abcdef`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP ROLE IF EXISTS dbschema`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM creds WHERE db = $1`)).
+		WithArgs("dbschema").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'gone'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "deprovision", outcomeSucceeded)
+
+	broker.Teardown("instance-1")
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+)
+
+// Seed is what a plan's new instance databases start out with: either
+// a copy of a template database, or whatever a SQL script creates.
+type Seed struct {
+	Version  string `json:"version"`
+	Template string `json:"template"`
+	File     string `json:"file"`
+
+	/* the contents of File, read when the plans are loaded */
+	SQL string `json:"-"`
+}
+
+func (p *Plan) loadSeed() error {
+	s := &p.Seed
+	if s.Template == "" && s.File == "" {
+		if s.Version != "" {
+			return fmt.Errorf("plan '%s' has a seed version, but no seed template or file", p.Name)
+		}
+		return nil
+	}
+	if s.Template != "" && s.File != "" {
+		return fmt.Errorf("plan '%s' has both a seed template and a seed file", p.Name)
+	}
+	if s.Version == "" {
+		return fmt.Errorf("plan '%s' has a seed, but no seed version", p.Name)
+	}
+	if s.Template != "" && (p.Template.Default != "" || len(p.Template.Allowed) > 0) {
+		return fmt.Errorf("plan '%s' has a seed template, so it cannot offer other templates", p.Name)
+	}
+
+	if s.File != "" {
+		b, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return fmt.Errorf("plan '%s' seed file: %w", p.Name, err)
+		}
+		s.SQL = string(b)
+	}
+	return nil
+}
+
+// runSeed runs a plan's seed script in a new instance database, all
+// or nothing.  The database is marked as seeded in the same
+// transaction, so that a provision that fails after the script has run
+// (but before the broker has recorded it) doesn't run it again.
+func (b *Broker) runSeed(ctx context.Context, db string, seed Seed) error {
+	conn, err := b.tenant(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+	marker := "seeded with version " + seed.Version + " of its plan's seed"
+	var seeded string
+	if err := tx.QueryRowContext(sctx, `SELECT COALESCE(shobj_description(oid, 'pg_database'), '') FROM pg_database WHERE datname = current_database()`).Scan(&seeded); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if seeded == marker {
+		info("%s was already seeded with version %s, continuing\n", db, seed.Version)
+		return tx.Rollback()
+	}
+	if _, err := tx.ExecContext(sctx, seed.SQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var comment string
+	if err := tx.QueryRowContext(sctx, `SELECT format('COMMENT ON DATABASE %I IS %L', current_database(), $1::text)`, marker).Scan(&comment); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(sctx, comment); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// seed brings a new instance database up to its plan's seed, unless
+// an earlier attempt already did; it returns the step that failed.
+func (b *Broker) seed(ctx context.Context, inst Instance) (string, error) {
+	plan, ok := b.plan(inst.Plan)
+	if !ok || plan.Seed.Version == "" || inst.Source != "" || inst.Backup != "" {
+		return "", nil
+	}
+
+	/* whatever the caller thinks, a retry picks up from what was recorded */
+	var seeded string
+	err := b.scan(ctx, `SELECT COALESCE(seed, '') FROM dbs WHERE instance = $1`, []interface{}{inst.ID}, &seeded)
+	if err != nil && err != sql.ErrNoRows {
+		return "checking for an earlier seed", err
+	}
+	if seeded == plan.Seed.Version {
+		info("%s was already seeded with version %s, skipping\n", inst.Database, plan.Seed.Version)
+		return "", nil
+	}
+
+	if plan.Seed.SQL != "" {
+		info("seeding %s with version %s of its plan's seed\n", inst.Database, plan.Seed.Version)
+		if err := b.runSeed(ctx, inst.Database, plan.Seed); err != nil {
+			return "running seed script " + plan.Seed.File, err
+		}
+	}
+	/* seed templates were copied by CREATE DATABASE */
+
+	if _, err := b.exec(ctx, `UPDATE dbs SET seed = $2 WHERE instance = $1`, inst.ID, plan.Seed.Version); err != nil {
+		return "recording seed version", err
+	}
+	return "", nil
+}
+
+// grantExisting gives a new binding's user the run of everything that
+// was in the instance database before any binding was, from a seed or
+// a clone, which the broker (or a template's owner) otherwise owns.
+func (b *Broker) grantExisting(ctx context.Context, db, user string) error {
+	conn, err := b.tenant(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+	_, err = conn.ExecContext(sctx, `DO $$
+DECLARE s name;
+BEGIN
+	FOR s IN SELECT nspname FROM pg_namespace WHERE nspname !~ '^pg_' AND nspname <> 'information_schema' LOOP
+		EXECUTE format('GRANT ALL ON SCHEMA %I TO `+user+`', s);
+		EXECUTE format('GRANT ALL ON ALL TABLES IN SCHEMA %I TO `+user+`', s);
+		EXECUTE format('GRANT ALL ON ALL SEQUENCES IN SCHEMA %I TO `+user+`', s);
+		EXECUTE format('GRANT ALL ON ALL FUNCTIONS IN SCHEMA %I TO `+user+`', s);
+	END LOOP;
+END $$`)
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadPlansSeedFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "seed")
+	if err != nil {
+		t.Fatalf(`unable to create a seed file: %s`, err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("CREATE TABLE widgets (id SERIAL PRIMARY KEY)")
+	f.Close()
+
+	os.Setenv("PLANS", `[{"id": "small-id", "name": "small", "seed": {"version": "2024-01", "file": "`+f.Name()+`"}}]`)
+	defer os.Unsetenv("PLANS")
+
+	plans, err := loadPlans("")
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if plans[0].Seed.SQL != "CREATE TABLE widgets (id SERIAL PRIMARY KEY)" {
+		t.Fatalf(`unexpected seed script: %q`, plans[0].Seed.SQL)
+	}
+}
+
+func TestSeedTemplateOverridesTemplate(t *testing.T) {
+	plan := Plan{Encoding: Choice{Default: "UTF8"}, Seed: Seed{Version: "1", Template: "starter"}}
+	opts, err := plan.databaseOptions(ProvisionParameters{})
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if opts.Template != "starter" {
+		t.Fatalf(`expected the seed template, got: %s`, opts.Template)
+	}
+
+	_, err = plan.databaseOptions(ProvisionParameters{Template: "template1"})
+	if err == nil || !strings.Contains(err.Error(), "seeds new databases from its own template, 'starter'") {
+		t.Fatalf(`expected asking for another template to be refused, got: %v`, err)
+	}
+	if _, ok := err.(*ParameterError); !ok {
+		t.Fatalf(`expected a parameter error, got: %T`, err)
+	}
+}
+
+func expectSeedVersion(mock sqlmock.Sqlmock, version string) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(seed, '') FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"seed"}).AddRow(version))
+}
+
+func expectSeedMarker(tenant sqlmock.Sqlmock, marker string) {
+	tenant.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(shobj_description(oid, 'pg_database'), '') FROM pg_database WHERE datname = current_database()`)).
+		WillReturnRows(sqlmock.NewRows([]string{"comment"}).AddRow(marker))
+}
+
+func TestSetupRunsSeedScript(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+	broker.Plans = []Plan{{ID: "plan-id", Name: "seeded", Seed: Seed{Version: "3", File: "seed.sql", SQL: "CREATE TABLE widgets (id SERIAL PRIMARY KEY)"}}}
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO dbs`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsolation(mock, tenant, mockDbName)
+	expectSeedVersion(mock, "")
+	tenant.ExpectBegin()
+	expectSeedMarker(tenant, "")
+	tenant.ExpectExec(regexp.QuoteMeta(`CREATE TABLE widgets`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectQuery(regexp.QuoteMeta(`SELECT format('COMMENT ON DATABASE %I IS %L', current_database(), $1::text)`)).
+		WithArgs("seeded with version 3 of its plan's seed").
+		WillReturnRows(sqlmock.NewRows([]string{"format"}).AddRow(`COMMENT ON DATABASE ` + mockDbName + ` IS 'seeded with version 3 of its plan''s seed'`))
+	tenant.ExpectExec(regexp.QuoteMeta(`COMMENT ON DATABASE ` + mockDbName + ` IS 'seeded with version 3 of its plan''s seed'`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	tenant.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET seed = $2 WHERE instance = $1`)).
+		WithArgs("instance-1", "3").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'setup'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "provision", outcomeSucceeded)
+
+	broker.Setup(Instance{ID: "instance-1", Database: mockDbName, Plan: "plan-id"})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSeedSkipsFinishedSeeds(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+	broker.Plans = []Plan{{ID: "plan-id", Name: "seeded", Seed: Seed{Version: "3", File: "seed.sql", SQL: "CREATE TABLE widgets (id SERIAL PRIMARY KEY)"}}}
+	inst := Instance{ID: "instance-1", Database: mockDbName, Plan: "plan-id"}
+
+	/* recorded as seeded */
+	expectSeedVersion(mock, "3")
+	if step, err := broker.seed(context.Background(), inst); err != nil {
+		t.Fatalf(`unexpected error %s: %s`, step, err)
+	}
+
+	/* seeded, but the broker didn't get to record it */
+	expectSeedVersion(mock, "")
+	tenant.ExpectBegin()
+	expectSeedMarker(tenant, "seeded with version 3 of its plan's seed")
+	tenant.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET seed = $2 WHERE instance = $1`)).
+		WithArgs("instance-1", "3").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if step, err := broker.seed(context.Background(), inst); err != nil {
+		t.Fatalf(`unexpected error %s: %s`, step, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGrantSeededInstance(t *testing.T) {
+	broker, mock, tenant := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state, seed IS NOT NULL OR source IS NOT NULL OR backup IS NOT NULL, COALESCE(shared_db, '') FROM dbs WHERE instance = $1`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "state", "populated", "shared_db"}).AddRow(mockDbName, "done", true, ""))
+	mock.ExpectExec(`CREATE USER`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`GRANT ` + mockDbName + ` TO`).WillReturnResult(sqlmock.NewResult(1, 1))
+	tenant.ExpectExec(`GRANT ALL ON ALL TABLES IN SCHEMA %I TO u[0-9a-z]{16}`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO creds`)).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if _, _, err := broker.Grant("instance-1", Binding{ID: "binding-1"}); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := tenant.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
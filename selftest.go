@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* how many other tenants' databases each binding tries to get into */
+const isolationTargets = 3
+
+/* what a binding tries (and should fail) to create */
+const isolationProbe = "tinsmith_isolation_probe"
+
+// IsolationCheck is the outcome of one thing a binding tried to do
+// that it should not be able to.
+type IsolationCheck struct {
+	Check  string `json:"check"`
+	Target string `json:"target,omitempty"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// BindingIsolation is everything the isolation test tried with one
+// binding's credentials.
+type BindingIsolation struct {
+	Instance string           `json:"instance"`
+	Binding  string           `json:"binding"`
+	Username string           `json:"username"`
+	Database string           `json:"database"`
+	Passed   bool             `json:"passed"`
+	Checks   []IsolationCheck `json:"checks"`
+}
+
+// IsolationReport is the result of an isolation test, for auditors.
+// Instances without any bindings have nothing to test with, and are
+// listed as untested.
+type IsolationReport struct {
+	Started   time.Time          `json:"started"`
+	Finished  time.Time          `json:"finished"`
+	Instances int                `json:"instances"`
+	Passed    bool               `json:"passed"`
+	Failed    int                `json:"failed"`
+	Untested  []string           `json:"untested"`
+	Bindings  []BindingIsolation `json:"bindings"`
+}
+
+type isolationTenant struct {
+	Instance string
+	Database string
+	Schema   string
+}
+
+func (b *Broker) loginAs(user, pass, db string) (*sql.DB, error) {
+	if b.login != nil {
+		return b.login(user, pass, db)
+	}
+	if db == brokerDatabaseName && b.Metadata != nil {
+		return Backend{Host: b.Metadata.Host, Port: b.Metadata.Port, Username: user, Password: pass}.open(db)
+	}
+	return b.connect(user, pass, db)
+}
+
+// TestIsolation connects with the credentials of every binding of a
+// random sample of instances (or of all of them, if sample is zero),
+// and checks that each is confined to its own instance.
+func (b *Broker) TestIsolation(sample int) (IsolationReport, error) {
+	report := IsolationReport{Started: time.Now(), Passed: true, Untested: make([]string, 0), Bindings: make([]BindingIsolation, 0)}
+	ctx := context.Background()
+
+	tenants, err := b.isolationTenants(ctx)
+	if err != nil {
+		return report, err
+	}
+	chosen := tenants
+	if sample > 0 && sample < len(tenants) {
+		chosen = make([]isolationTenant, len(tenants))
+		copy(chosen, tenants)
+		rand.Shuffle(len(chosen), func(i, j int) { chosen[i], chosen[j] = chosen[j], chosen[i] })
+		chosen = chosen[:sample]
+		sort.Slice(chosen, func(i, j int) bool { return chosen[i].Instance < chosen[j].Instance })
+	}
+	report.Instances = len(chosen)
+
+	for _, t := range chosen {
+		bindings, err := b.isolationBindings(ctx, t)
+		if err != nil {
+			return report, err
+		}
+		if len(bindings) == 0 {
+			report.Untested = append(report.Untested, t.Instance)
+			continue
+		}
+
+		targets := otherDatabases(tenants, t)
+		for _, bi := range bindings {
+			b.testBinding(ctx, t, &bi.result, bi.pass, targets)
+			if !bi.result.Passed {
+				report.Passed = false
+				report.Failed++
+			}
+			report.Bindings = append(report.Bindings, bi.result)
+		}
+	}
+
+	report.Finished = time.Now()
+	return report, nil
+}
+
+func (b *Broker) isolationTenants(ctx context.Context) ([]isolationTenant, error) {
+	ctx, cancel := b.statement(ctx)
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `SELECT instance, TRIM(name), COALESCE(shared_db, '') FROM dbs WHERE state = 'done' ORDER BY instance`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var l []isolationTenant
+	for r.Next() {
+		var t isolationTenant
+		var shared string
+		if err := r.Scan(&t.Instance, &t.Database, &shared); err != nil {
+			return nil, err
+		}
+		t.Instance = strings.TrimSpace(t.Instance)
+		if shared != "" {
+			t.Schema, t.Database = t.Database, shared
+		}
+		l = append(l, t)
+	}
+	return l, r.Err()
+}
+
+type isolationBinding struct {
+	result BindingIsolation
+	pass   string
+}
+
+func (b *Broker) isolationBindings(ctx context.Context, t isolationTenant) ([]isolationBinding, error) {
+	ctx, cancel := b.statement(ctx)
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `SELECT creds.binding, TRIM(creds.name), TRIM(creds.pass)
+  FROM creds INNER JOIN dbs ON creds.db = dbs.name
+ WHERE dbs.instance = $1 AND creds.state = 'done'
+ ORDER BY creds.binding`, t.Instance)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var l []isolationBinding
+	for r.Next() {
+		bi := isolationBinding{result: BindingIsolation{Instance: t.Instance, Database: t.Database}}
+		if err := r.Scan(&bi.result.Binding, &bi.result.Username, &bi.pass); err != nil {
+			return nil, err
+		}
+		bi.result.Binding = strings.TrimSpace(bi.result.Binding)
+		l = append(l, bi)
+	}
+	return l, r.Err()
+}
+
+// otherDatabases picks a few databases belonging to other tenants for
+// an instance's bindings to try; schema instances sharing a database
+// with this one are covered by checking which schemas it can use.
+func otherDatabases(tenants []isolationTenant, self isolationTenant) []string {
+	seen := map[string]bool{self.Database: true}
+	var l []string
+	for _, t := range tenants {
+		if !seen[t.Database] {
+			seen[t.Database] = true
+			l = append(l, t.Database)
+		}
+	}
+	rand.Shuffle(len(l), func(i, j int) { l[i], l[j] = l[j], l[i] })
+	if len(l) > isolationTargets {
+		l = l[:isolationTargets]
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (b *Broker) testBinding(ctx context.Context, t isolationTenant, result *BindingIsolation, pass string, targets []string) {
+	check := func(c IsolationCheck) {
+		result.Checks = append(result.Checks, c)
+	}
+	defer func() {
+		result.Passed = true
+		for _, c := range result.Checks {
+			result.Passed = result.Passed && c.Passed
+		}
+	}()
+
+	conn, err := b.loginAs(result.Username, pass, t.Database)
+	if err == nil {
+		err = b.ping(ctx, conn)
+	}
+	if err != nil {
+		/* without a session of its own, nothing else can be shown */
+		check(IsolationCheck{Check: "own-database", Target: t.Database, Detail: "unable to connect: " + err.Error()})
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	defer conn.Close()
+	check(IsolationCheck{Check: "own-database", Target: t.Database, Passed: true})
+
+	for _, db := range targets {
+		check(b.denied(ctx, "other-database", db, result.Username, pass, ""))
+	}
+	check(b.denied(ctx, "broker-database", brokerDatabaseName, result.Username, pass, `SELECT 1 FROM creds LIMIT 1`))
+
+	check(b.refused(ctx, conn, "create-role", `CREATE ROLE `+isolationProbe, `DROP ROLE IF EXISTS `+isolationProbe))
+	check(b.refused(ctx, conn, "create-database", `CREATE DATABASE `+isolationProbe, `DROP DATABASE IF EXISTS `+isolationProbe))
+	check(b.refused(ctx, conn, "read-role-passwords", `SELECT count(*) FROM pg_authid`, ""))
+	check(b.none(ctx, conn, "other-sessions", `SELECT string_agg(DISTINCT usename, ', ') FROM pg_stat_activity
+ WHERE usename <> session_user AND query IS NOT NULL AND query <> '<insufficient privilege>'`))
+	if t.Schema != "" {
+		check(b.none(ctx, conn, "other-schemas", `SELECT string_agg(nspname, ', ' ORDER BY nspname) FROM pg_namespace
+ WHERE nspname <> `+quoteLiteral(t.Schema)+` AND nspname NOT IN ('pg_catalog', 'information_schema') AND nspname NOT LIKE 'pg\_%'
+   AND has_schema_privilege(oid, 'USAGE')`))
+	}
+}
+
+func (b *Broker) ping(ctx context.Context, conn *sql.DB) error {
+	ctx, cancel := b.statement(ctx)
+	defer cancel()
+	return conn.PingContext(ctx)
+}
+
+// denied checks that a binding's user cannot connect to a database or,
+// if it can, that the given query is refused there.
+func (b *Broker) denied(ctx context.Context, name, db, user, pass, query string) IsolationCheck {
+	c := IsolationCheck{Check: name, Target: db}
+	conn, err := b.loginAs(user, pass, db)
+	if err != nil {
+		c.Detail = "unable to tell: " + err.Error()
+		return c
+	}
+	defer conn.Close()
+
+	/* pg_hba.conf turning the user away, or (on a separate metadata
+	   service) not knowing them at all, is just as good */
+	err = b.ping(ctx, conn)
+	switch {
+	case isPqError(err, "42501", "28000", "28P01"):
+		c.Passed = true
+		return c
+	case err != nil:
+		c.Detail = "unable to tell: " + err.Error()
+		return c
+	case query == "":
+		c.Detail = "connected"
+		return c
+	}
+
+	c = b.refused(ctx, conn, name, query, "")
+	c.Target = db
+	if c.Passed {
+		c.Detail = "connected, but could not read anything"
+	}
+	return c
+}
+
+// refused checks that a statement fails for lack of privileges, undoing
+// it with cleanup if it doesn't.
+func (b *Broker) refused(ctx context.Context, conn *sql.DB, name, query, cleanup string) IsolationCheck {
+	c := IsolationCheck{Check: name}
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+
+	_, err := conn.ExecContext(sctx, query)
+	switch {
+	case isPqError(err, "42501"):
+		c.Passed = true
+	case err != nil:
+		c.Detail = "unable to tell: " + err.Error()
+	default:
+		c.Detail = "allowed"
+		if cleanup != "" {
+			if _, err := conn.ExecContext(sctx, cleanup); err != nil {
+				oops("isolation test failed to clean up after itself (%s): %s\n", cleanup, err)
+			}
+		}
+	}
+	return c
+}
+
+// none checks that a query, listing things the binding should not be
+// able to see, comes back empty.
+func (b *Broker) none(ctx context.Context, conn *sql.DB, name, query string) IsolationCheck {
+	c := IsolationCheck{Check: name}
+	sctx, cancel := b.statement(ctx)
+	defer cancel()
+
+	var seen sql.NullString
+	if err := conn.QueryRowContext(sctx, query).Scan(&seen); err != nil {
+		c.Detail = "unable to tell: " + err.Error()
+		return c
+	}
+	if seen.Valid && seen.String != "" {
+		c.Detail = "can see " + seen.String
+		return c
+	}
+	c.Passed = true
+	return c
+}
+
+// isolationTest runs the isolation test from the command line, as in
+// `cf run-task ... "cf-postgres-tinsmith isolation-test [SAMPLE]"`,
+// and returns the exit status.
+func isolationTest(b *Broker, args []string) int {
+	sample := 0
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "usage: %s isolation-test [SAMPLE]\n", os.Args[0])
+			return 2
+		}
+		sample = n
+	}
+
+	report, err := b.TestIsolation(sample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "isolation test failed: %s\n", err)
+		return 2
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(report)
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
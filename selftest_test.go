@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+var denied = &pq.Error{Code: "42501", Message: "permission denied"}
+
+// loginBroker returns a broker whose bindings' logins go to a stub
+// database per database name.
+func loginBroker(t *testing.T, dbs ...string) (*Broker, sqlmock.Sqlmock, map[string]sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	broker := &Broker{db: db}
+
+	dsns := make(map[string]string)
+	mocks := make(map[string]sqlmock.Sqlmock)
+	for _, name := range dbs {
+		dsn := fmt.Sprintf("tenant-%d", atomic.AddInt32(&tenants, 1))
+		if _, mocks[name], err = sqlmock.NewWithDSN(dsn, sqlmock.MonitorPingsOption(true)); err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		dsns[name] = dsn
+	}
+	broker.login = func(user, pass, name string) (*sql.DB, error) {
+		if user != "u1" || pass != "secret" {
+			t.Fatalf(`expected to log in as u1, not %s`, user)
+		}
+		if _, ok := dsns[name]; !ok {
+			t.Fatalf(`unexpected login to %s`, name)
+		}
+		return sql.Open("sqlmock", dsns[name])
+	}
+	return broker, mock, mocks
+}
+
+func expectIsolationTest(mock sqlmock.Sqlmock, mocks map[string]sqlmock.Sqlmock, createRole error) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instance, TRIM(name), COALESCE(shared_db, '') FROM dbs`)).
+		WillReturnRows(sqlmock.NewRows([]string{"instance", "name", "shared_db"}).
+			AddRow("instance-1                          ", "db1", "").
+			AddRow("instance-2                          ", "db2", ""))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.binding, TRIM(creds.name), TRIM(creds.pass)`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"binding", "name", "pass"}).AddRow("binding-1", "u1", "secret"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.binding, TRIM(creds.name), TRIM(creds.pass)`)).
+		WithArgs("instance-2").
+		WillReturnRows(sqlmock.NewRows([]string{"binding", "name", "pass"}))
+
+	mocks["db1"].ExpectPing()
+	mocks["db2"].ExpectPing().WillReturnError(denied)
+	mocks[brokerDatabaseName].ExpectPing()
+	mocks[brokerDatabaseName].ExpectExec(regexp.QuoteMeta(`SELECT 1 FROM creds`)).WillReturnError(denied)
+
+	if createRole == nil {
+		mocks["db1"].ExpectExec(regexp.QuoteMeta(`CREATE ROLE ` + isolationProbe)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mocks["db1"].ExpectExec(regexp.QuoteMeta(`DROP ROLE IF EXISTS ` + isolationProbe)).WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mocks["db1"].ExpectExec(regexp.QuoteMeta(`CREATE ROLE ` + isolationProbe)).WillReturnError(createRole)
+	}
+	mocks["db1"].ExpectExec(regexp.QuoteMeta(`CREATE DATABASE ` + isolationProbe)).WillReturnError(denied)
+	mocks["db1"].ExpectExec(regexp.QuoteMeta(`SELECT count(*) FROM pg_authid`)).WillReturnError(denied)
+	mocks["db1"].ExpectQuery(regexp.QuoteMeta(`FROM pg_stat_activity`)).
+		WillReturnRows(sqlmock.NewRows([]string{"string_agg"}).AddRow(nil))
+}
+
+func TestIsolationTestPasses(t *testing.T) {
+	broker, mock, mocks := loginBroker(t, "db1", "db2", brokerDatabaseName)
+	defer broker.db.Close()
+	expectIsolationTest(mock, mocks, denied)
+
+	report, err := broker.TestIsolation(0)
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if !report.Passed || report.Failed != 0 || report.Instances != 2 {
+		t.Fatalf(`expected the isolation test to pass, got: %+v`, report)
+	}
+	if len(report.Untested) != 1 || report.Untested[0] != "instance-2" {
+		t.Fatalf(`expected instance-2 to be untested, got: %v`, report.Untested)
+	}
+	if len(report.Bindings) != 1 || len(report.Bindings[0].Checks) != 7 {
+		t.Fatalf(`expected seven checks of binding-1, got: %+v`, report.Bindings)
+	}
+	for _, c := range report.Bindings[0].Checks {
+		if c.Check == "broker-database" && c.Detail != "connected, but could not read anything" {
+			t.Fatalf(`expected the broker database check to note the connection, got: %+v`, c)
+		}
+	}
+
+	// we make sure that all expectations were met
+	for name, m := range mocks {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations on %s: %s", name, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestIsolationTestFailsWhenBindingCanCreateRoles(t *testing.T) {
+	broker, mock, mocks := loginBroker(t, "db1", "db2", brokerDatabaseName)
+	defer broker.db.Close()
+	expectIsolationTest(mock, mocks, nil)
+
+	report, err := broker.TestIsolation(0)
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if report.Passed || report.Failed != 1 || report.Bindings[0].Passed {
+		t.Fatalf(`expected the isolation test to fail, got: %+v`, report)
+	}
+	for _, c := range report.Bindings[0].Checks {
+		if c.Passed != (c.Check != "create-role") {
+			t.Fatalf(`expected only the create-role check to fail, got: %+v`, report.Bindings[0].Checks)
+		}
+	}
+
+	// we make sure that all expectations were met
+	for name, m := range mocks {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations on %s: %s", name, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var ErrSuspended = errors.New("this service instance has been suspended; please contact your operator")
+var ErrNotSuspended = errors.New("only suspended instances can be resumed")
+var ErrNotSuspendable = errors.New("only ready instances can be suspended")
+
+// Suspend cuts a tenant off, without losing anything: its bindings'
+// users can no longer log in, its database no longer takes
+// connections, and anyone still connected is thrown out.  Suspending
+// an instance again re-applies all of that.
+func (b *Broker) Suspend(instance string) error {
+	ctx, cancel := operation(b.DeprovisionTimeout)
+	defer cancel()
+
+	inst, err := b.GetInstance(instance)
+	if err != nil {
+		return err
+	}
+	if inst == nil || inst.State == "gone" {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	/* first, so that no new bindings sneak in */
+	r, err := b.exec(ctx, `UPDATE dbs SET state = 'suspended' WHERE instance = $1 AND state IN ('done', 'suspended')`, instance)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ErrNotSuspendable
+	}
+
+	users, err := b.column(ctx, `SELECT creds.name FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1`, instance)
+	if err != nil {
+		return fmt.Errorf("unable to look up the instance's users: %w", err)
+	}
+	for _, user := range users {
+		if _, err := b.execBackend(ctx, `ALTER ROLE `+user+` NOLOGIN`); err != nil && !isPqError(err, "42704") {
+			return fmt.Errorf("unable to stop %s from logging in: %w", user, err)
+		}
+	}
+
+	/* a shared database has other tenants in it, so only the users
+	   are shut out of it */
+	db := ""
+	if inst.SharedDatabase == "" {
+		db = inst.Database
+		if _, err := b.execBackend(ctx, `ALTER DATABASE `+db+` ALLOW_CONNECTIONS false`); err != nil {
+			return fmt.Errorf("unable to stop connections to the instance database: %w", err)
+		}
+	}
+
+	if _, err := b.execBackend(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+ WHERE (datname = $1 OR usename = ANY($2)) AND pid <> pg_backend_pid()`, db, pq.Array(users)); err != nil {
+		return fmt.Errorf("unable to terminate the instance's sessions: %w", err)
+	}
+
+	inst.State = "suspended"
+	b.notify("instance.suspended", inst)
+	return nil
+}
+
+// Resume undoes Suspend.
+func (b *Broker) Resume(instance string) error {
+	ctx, cancel := operation(b.ProvisionTimeout)
+	defer cancel()
+
+	inst, err := b.GetInstance(instance)
+	if err != nil {
+		return err
+	}
+	if inst == nil || inst.State == "gone" {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	if inst.State != "suspended" {
+		return ErrNotSuspended
+	}
+
+	if inst.SharedDatabase == "" {
+		if _, err := b.execBackend(ctx, `ALTER DATABASE `+inst.Database+` ALLOW_CONNECTIONS true`); err != nil {
+			return fmt.Errorf("unable to allow connections to the instance database: %w", err)
+		}
+	}
+
+	/* only finished bindings had their users switched off by Suspend;
+	   one being dropped (or that failed) has to stay shut out */
+	users, err := b.column(ctx, `SELECT creds.name FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1 AND creds.state = 'done'`, instance)
+	if err != nil {
+		return fmt.Errorf("unable to look up the instance's users: %w", err)
+	}
+	for _, user := range users {
+		if _, err := b.execBackend(ctx, `ALTER ROLE `+user+` LOGIN`); err != nil && !isPqError(err, "42704") {
+			return fmt.Errorf("unable to let %s log in again: %w", user, err)
+		}
+	}
+
+	if _, err := b.exec(ctx, `UPDATE dbs SET state = 'done' WHERE instance = $1 AND state = 'suspended'`, instance); err != nil {
+		return err
+	}
+
+	inst.State = "done"
+	b.notify("instance.resumed", inst)
+	return nil
+}
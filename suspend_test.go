@@ -0,0 +1,147 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func expectInstance(mock sqlmock.Sqlmock, state, shared string) {
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, state, "plan-id", "", "org-id", "space-id", "", time.Now(), "", "", "", "", "{}", "[]", "", "", shared, nil, ""))
+}
+
+func expectUsers(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.name FROM creds`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("u1").AddRow("u2"))
+}
+
+func TestSuspendInstance(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	expectInstance(mock, "done", "")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'suspended'`)).
+		WithArgs("instance-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUsers(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u1 NOLOGIN`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u2 NOLOGIN`)).
+		WillReturnError(&pq.Error{Code: "42704", Message: "role does not exist"})
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` ALLOW_CONNECTIONS false`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity`)).
+		WithArgs(mockDbName, pq.Array([]string{"u1", "u2"})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := broker.Suspend("instance-1"); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSuspendSchemaInstanceLeavesSharedDatabaseOpen(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	expectInstance(mock, "done", "tenants")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'suspended'`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUsers(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u1 NOLOGIN`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u2 NOLOGIN`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity`)).
+		WithArgs("", pq.Array([]string{"u1", "u2"})).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := broker.Suspend("instance-1"); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSuspendBusyInstance(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	expectInstance(mock, "setup", "")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'suspended'`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := broker.Suspend("instance-1"); err != ErrNotSuspendable {
+		t.Fatalf(`expected ErrNotSuspendable, got: %v`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestResumeInstance(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	expectInstance(mock, "suspended", "")
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` ALLOW_CONNECTIONS true`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	/* u2's binding was being torn down, so it stays shut out */
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.name FROM creds INNER JOIN dbs ON creds.db = dbs.name WHERE dbs.instance = $1 AND creds.state = 'done'`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("u1"))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u1 LOGIN`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done'`)).
+		WithArgs("instance-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := broker.Resume("instance-1"); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSuspendedInstance(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT name, state`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "state", "populated", "shared_db"}).AddRow(mockDbName, "suspended", false, ""))
+	if _, _, err := broker.Grant("instance-1", Binding{ID: "binding-1"}); err != ErrSuspended {
+		t.Fatalf(`expected binding a suspended instance to fail with ErrSuspended, got: %v`, err)
+	}
+
+	expectInstance(mock, "done", "")
+	if err := broker.Resume("instance-1"); err != ErrNotSuspended {
+		t.Fatalf(`expected ErrNotSuspended, got: %v`, err)
+	}
+
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns))
+	if err := broker.Suspend("instance-1"); err != brokerapi.ErrInstanceDoesNotExist {
+		t.Fatalf(`expected ErrInstanceDoesNotExist, got: %v`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var ErrNotATrial = errors.New("only trial instances can be extended")
+var ErrExtensionPassed = errors.New("a trial can only be extended into the future")
+var ErrExtensionTooLong = errors.New("a trial can only be extended up to its plan's lifetime from now")
+
+const (
+	defaultGracePeriod = 7 * 24 * time.Hour
+	defaultWarnBefore  = 3 * 24 * time.Hour
+)
+
+func (p *Plan) validateLifetime() error {
+	if p.Lifetime == "" {
+		if p.GracePeriod != "" || p.WarnBefore != "" {
+			return fmt.Errorf("plan '%s' has a grace_period or warn_before, but no lifetime", p.Name)
+		}
+		return nil
+	}
+
+	d, err := time.ParseDuration(p.Lifetime)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("plan '%s' has an invalid lifetime '%s' (try i.e. 720h)", p.Name, p.Lifetime)
+	}
+	p.lifetime = d
+
+	p.grace = defaultGracePeriod
+	if p.GracePeriod != "" {
+		d, err := time.ParseDuration(p.GracePeriod)
+		if err != nil || d < 0 {
+			return fmt.Errorf("plan '%s' has an invalid grace_period '%s' (try i.e. 168h)", p.Name, p.GracePeriod)
+		}
+		p.grace = d
+	}
+
+	p.warn = defaultWarnBefore
+	if p.WarnBefore != "" {
+		d, err := time.ParseDuration(p.WarnBefore)
+		if err != nil || d < 0 {
+			return fmt.Errorf("plan '%s' has an invalid warn_before '%s' (try i.e. 72h)", p.Name, p.WarnBefore)
+		}
+		p.warn = d
+	}
+	if p.warn > p.lifetime {
+		p.warn = p.lifetime
+	}
+	return nil
+}
+
+// trialExpiry is when a new instance of a plan expires, as the epoch
+// seconds kept in `dbs.expires`, or zero if the plan isn't a trial.
+func (b *Broker) trialExpiry(plan string) int64 {
+	p, ok := b.plan(plan)
+	if !ok || p.lifetime == 0 {
+		return 0
+	}
+	return time.Now().Add(p.lifetime).Unix()
+}
+
+// roughly renders how long until something happens, for people.
+func roughly(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	case d >= 2*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return "less than two hours"
+	}
+}
+
+// describeTrial adds the expiry of a trial instance to its description,
+// so that developers polling it (or looking at their dashboard) are
+// reminded before it goes.
+func describeTrial(state string, expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	left := time.Until(expires)
+	when := expires.UTC().Format(time.RFC3339)
+	switch {
+	case left > 0:
+		return fmt.Sprintf("  This is a trial database; it expires at %s (in %s).", when, roughly(left))
+	case state == "suspended":
+		return fmt.Sprintf("  This trial database expired at %s, and will be deleted soon.", when)
+	default:
+		return fmt.Sprintf("  This trial database expired at %s.", when)
+	}
+}
+
+type trial struct {
+	Instance string
+	Plan     string
+	State    string
+	Expires  time.Time
+	Trial    string
+}
+
+// ExpireTrials moves trial instances along as their time runs out: it
+// warns about instances that are about to expire, suspends them when
+// they do, and deletes them once the plan's grace period is over too.
+func (b *Broker) ExpireTrials() {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `
+SELECT instance, COALESCE(plan, ''), state, expires, COALESCE(trial_state, '')
+  FROM dbs
+ WHERE expires > 0 AND state IN ('done', 'suspended')`)
+	if err != nil {
+		oops("failed to check for expiring trials: %s\n", err)
+		return
+	}
+	var trials []trial
+	for r.Next() {
+		var t trial
+		var expires int64
+		if err := r.Scan(&t.Instance, &t.Plan, &t.State, &expires, &t.Trial); err != nil {
+			oops("failed to check for expiring trials: %s\n", err)
+			r.Close()
+			return
+		}
+		t.Instance = strings.TrimSpace(t.Instance)
+		t.Expires = time.Unix(expires, 0)
+		trials = append(trials, t)
+	}
+	r.Close()
+
+	now := time.Now()
+	for _, t := range trials {
+		/* plans that have since been dropped (or are no longer trials)
+		   still see their trials out */
+		grace, warn := defaultGracePeriod, defaultWarnBefore
+		if p, ok := b.plan(t.Plan); ok && p.lifetime > 0 {
+			grace, warn = p.grace, p.warn
+		}
+
+		switch {
+		case now.After(t.Expires.Add(grace)):
+			b.deleteTrial(t)
+		case now.After(t.Expires) && t.State == "done":
+			b.suspendTrial(t)
+		case now.After(t.Expires.Add(-warn)) && t.Trial == "":
+			b.warnTrial(t)
+		}
+	}
+}
+
+func (b *Broker) deleteTrial(t trial) {
+	/* like any other deprovision, this runs in the background, in a
+	   job slot; if there are none, it'll happen on a later run */
+	if !b.startJob() {
+		info("not deleting expired trial instance %s yet: %d jobs already running\n", t.Instance, b.MaxJobs)
+		return
+	}
+
+	info("deleting trial instance %s, which expired at %s\n", t.Instance, t.Expires.UTC().Format(time.RFC3339))
+	b.record(Event{Operation: "expire", Instance: t.Instance, Plan: t.Plan, Identity: "janitor", Outcome: outcomeAccepted})
+	go func() {
+		defer b.finishJob()
+		b.Teardown(t.Instance)
+	}()
+}
+
+func (b *Broker) suspendTrial(t trial) {
+	err := b.Suspend(t.Instance)
+	if err == nil {
+		_, err = b.exec(context.Background(), `UPDATE dbs SET trial_state = 'suspended' WHERE instance = $1`, t.Instance)
+	}
+	b.record(Event{
+		Operation: "suspend",
+		Instance:  t.Instance,
+		Plan:      t.Plan,
+		Identity:  "janitor",
+		Outcome:   outcome(err, outcomeSucceeded),
+		Error:     errorString(err),
+	})
+	if err != nil {
+		oops("failed to suspend expired trial instance %s: %s\n", t.Instance, err)
+		return
+	}
+	info("suspended trial instance %s, which expired at %s\n", t.Instance, t.Expires.UTC().Format(time.RFC3339))
+}
+
+func (b *Broker) warnTrial(t trial) {
+	inst, err := b.GetInstance(t.Instance)
+	if err != nil || inst == nil {
+		oops("failed to look up expiring trial instance %s: %v\n", t.Instance, err)
+		return
+	}
+	/* warned (or not) just the once */
+	if _, err := b.exec(context.Background(), `UPDATE dbs SET trial_state = 'warned' WHERE instance = $1 AND trial_state IS NULL`, t.Instance); err != nil {
+		oops("failed to note the warning about trial instance %s: %s\n", t.Instance, err)
+		return
+	}
+	info("trial instance %s expires at %s\n", t.Instance, t.Expires.UTC().Format(time.RFC3339))
+	b.notify("instance.expiring", inst)
+}
+
+// Extend pushes a trial instance's expiry back to until, bringing it
+// back if it had already been suspended for expiring.  Whether it will
+// be warned about again depends on how far off until is.
+func (b *Broker) Extend(instance string, until time.Time) error {
+	ctx, cancel := operation(b.ProvisionTimeout)
+	defer cancel()
+
+	inst, err := b.GetInstance(instance)
+	if err != nil {
+		return err
+	}
+	if inst == nil || inst.State == "gone" {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	if inst.Expires == nil {
+		return ErrNotATrial
+	}
+	if !until.After(time.Now()) {
+		return ErrExtensionPassed
+	}
+	/* no further out than a new instance of the plan would get */
+	p, ok := b.plan(inst.Plan)
+	if !ok || p.lifetime == 0 {
+		return ErrNotATrial
+	}
+	if until.After(time.Now().Add(p.lifetime)) {
+		return ErrExtensionTooLong
+	}
+
+	var was string
+	if err := b.scan(ctx, `SELECT COALESCE(trial_state, '') FROM dbs WHERE instance = $1`, []interface{}{instance}, &was); err != nil {
+		return err
+	}
+	if _, err := b.exec(ctx, `UPDATE dbs SET expires = $2, trial_state = NULL WHERE instance = $1`, instance, until.Unix()); err != nil {
+		return err
+	}
+
+	/* an instance suspended by an admin stays that way */
+	if was == "suspended" && inst.State == "suspended" {
+		return b.Resume(instance)
+	}
+	return nil
+}
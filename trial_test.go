@@ -0,0 +1,214 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var trialColumns = []string{"instance", "plan", "state", "expires", "trial_state"}
+
+func TestTrialPlanLifetime(t *testing.T) {
+	p := Plan{ID: "sandbox-id", Name: "sandbox", Lifetime: "48h"}
+	if err := p.validateLifetime(); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if p.grace != defaultGracePeriod || p.warn != 48*time.Hour {
+		t.Fatalf(`expected the default grace period and a warning as long as the lifetime, got %s and %s`, p.grace, p.warn)
+	}
+
+	b := &Broker{Plans: []Plan{p, extensionsPlan}}
+	if until := b.trialExpiry("sandbox-id"); until < time.Now().Add(47*time.Hour).Unix() || until > time.Now().Add(48*time.Hour).Unix() {
+		t.Fatalf(`expected trial instances to expire in 48h, not at %d`, until)
+	}
+	if until := b.trialExpiry("plan-id"); until != 0 {
+		t.Fatalf(`expected instances of other plans never to expire, not at %d`, until)
+	}
+}
+
+func TestDescribeTrial(t *testing.T) {
+	if s := describeTrial("done", time.Time{}); s != "" {
+		t.Fatalf(`expected nothing for an instance that never expires, got: %s`, s)
+	}
+	if s := describeTrial("done", time.Now().Add(73*time.Hour)); !strings.Contains(s, "(in 3 days)") {
+		t.Fatalf(`expected the description to count down, got: %s`, s)
+	}
+	if s := describeTrial("suspended", time.Now().Add(-time.Hour)); !strings.Contains(s, "will be deleted") {
+		t.Fatalf(`expected the description to warn about the deletion, got: %s`, s)
+	}
+}
+
+func TestExpireTrials(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instance, COALESCE(plan, ''), state, expires, COALESCE(trial_state, '')`)).
+		WillReturnRows(sqlmock.NewRows(trialColumns).
+			AddRow("instance-1                          ", "plan-id", "done", time.Now().Add(-time.Hour).Unix(), "warned").
+			AddRow("instance-2                          ", "plan-id", "done", time.Now().Add(time.Hour).Unix(), "").
+			AddRow("instance-3                          ", "plan-id", "done", time.Now().Add(time.Hour).Unix(), "warned").
+			AddRow("instance-4                          ", "plan-id", "suspended", time.Now().Add(-time.Hour).Unix(), "suspended"))
+
+	/* instance-1 has expired */
+	expectInstance(mock, "done", "")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'suspended'`)).
+		WithArgs("instance-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.name FROM creds`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` ALLOW_CONNECTIONS false`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET trial_state = 'suspended'`)).
+		WithArgs("instance-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock, "suspend", outcomeSucceeded)
+
+	/* instance-2 is about to, and hasn't been warned yet */
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WithArgs("instance-2").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-2", mockDbName, "done", "plan-id", "", "org-id", "space-id", "", time.Now(), "", "", "", "", "{}", "[]", "", "", "", time.Now().Add(time.Hour), ""))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET trial_state = 'warned'`)).
+		WithArgs("instance-2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	/* instance-3 has been warned, and instance-4 is within its grace period */
+
+	broker.ExpireTrials()
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExpireTrialsDeletesAfterGracePeriod(t *testing.T) {
+	broker, mock, _ := tenantBroker(t)
+	defer broker.db.Close()
+	broker.jobs = make(chan struct{}, 1)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT instance, COALESCE(plan, ''), state, expires, COALESCE(trial_state, '')`)).
+		WillReturnRows(sqlmock.NewRows(trialColumns).
+			AddRow("instance-1                          ", "plan-id", "suspended", time.Now().Add(-defaultGracePeriod-time.Hour).Unix(), "suspended"))
+
+	expectEvent(mock, "expire", outcomeAccepted)
+	expectInstance(mock, "suspended", "")
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'teardown'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT creds.name FROM creds`)).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP DATABASE ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP ROLE IF EXISTS ` + mockDbName)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM creds WHERE db = $1`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'gone'`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "deprovision", outcomeSucceeded)
+
+	broker.ExpireTrials()
+	waitForJobs(t, broker)
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+/* trialBroker's plan gives instances 30 days */
+func trialBroker(t *testing.T) (*Broker, sqlmock.Sqlmock) {
+	broker, mock, _ := tenantBroker(t)
+	broker.Plans[0].lifetime = 30 * 24 * time.Hour
+	return broker, mock
+}
+
+func expectTrial(mock sqlmock.Sqlmock, state string, expires interface{}) {
+	mock.ExpectQuery(`SELECT .* FROM dbs WHERE instance = \$1`).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows(instanceRowColumns).
+			AddRow("instance-1", mockDbName, state, "plan-id", "", "org-id", "space-id", "", time.Now(), "", "", "", "", "{}", "[]", "", "", "", expires, ""))
+}
+
+func TestExtendTrial(t *testing.T) {
+	broker, mock := trialBroker(t)
+	defer broker.db.Close()
+
+	until := time.Now().Add(72 * time.Hour)
+	expectTrial(mock, "suspended", time.Now().Add(-time.Hour))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(trial_state, '') FROM dbs`)).
+		WithArgs("instance-1").
+		WillReturnRows(sqlmock.NewRows([]string{"trial_state"}).AddRow("suspended"))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET expires = $2, trial_state = NULL`)).
+		WithArgs("instance-1", until.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	/* it expired, so it is brought back */
+	expectInstance(mock, "suspended", "")
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER DATABASE ` + mockDbName + ` ALLOW_CONNECTIONS true`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectUsers(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u1 LOGIN`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER ROLE u2 LOGIN`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET state = 'done'`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := broker.Extend("instance-1", until); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExtendAdminSuspendedTrial(t *testing.T) {
+	broker, mock := trialBroker(t)
+	defer broker.db.Close()
+
+	expectTrial(mock, "suspended", time.Now().Add(time.Hour))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COALESCE(trial_state, '') FROM dbs`)).
+		WillReturnRows(sqlmock.NewRows([]string{"trial_state"}).AddRow("warned"))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE dbs SET expires = $2, trial_state = NULL`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := broker.Extend("instance-1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExtendInvalid(t *testing.T) {
+	broker, mock := trialBroker(t)
+	defer broker.db.Close()
+
+	expectTrial(mock, "done", nil)
+	if err := broker.Extend("instance-1", time.Now().Add(time.Hour)); err != ErrNotATrial {
+		t.Fatalf(`expected ErrNotATrial, got: %v`, err)
+	}
+
+	expectTrial(mock, "done", time.Now().Add(time.Hour))
+	if err := broker.Extend("instance-1", time.Now().Add(-time.Hour)); err != ErrExtensionPassed {
+		t.Fatalf(`expected ErrExtensionPassed, got: %v`, err)
+	}
+
+	expectTrial(mock, "done", time.Now().Add(time.Hour))
+	if err := broker.Extend("instance-1", time.Now().Add(31*24*time.Hour)); err != ErrExtensionTooLong {
+		t.Fatalf(`expected ErrExtensionTooLong, got: %v`, err)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
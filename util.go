@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"strconv"
+	"time"
 )
 
 func cfg(deflt, env string) string {
@@ -15,6 +17,32 @@ func cfg(deflt, env string) string {
 	return deflt
 }
 
+func cfgInt(deflt int, env string) int {
+	s := os.Getenv(env)
+	if s == "" {
+		return deflt
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: '%s' is not a number\n", env, s)
+		os.Exit(1)
+	}
+	return n
+}
+
+func cfgDuration(deflt time.Duration, env string) time.Duration {
+	s := os.Getenv(env)
+	if s == "" {
+		return deflt
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: '%s' is not a duration (i.e. 30s, 15m, 2h)\n", env, s)
+		os.Exit(1)
+	}
+	return d
+}
+
 func info(m string, args ...interface{}) {
 	fmt.Printf(m, args...)
 }
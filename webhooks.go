@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	deliveryPending   string = "pending"
+	deliveryDelivered string = "delivered"
+	deliveryFailed    string = "failed"
+)
+
+/* how long a courier may hold on to a delivery before another can retry it */
+const webhookLease = 5 * time.Minute
+
+var webhookTypes = []string{
+	"instance.created",
+	"instance.deleted",
+	"instance.exposed",
+	"instance.suspended",
+	"instance.resumed",
+	"instance.expiring",
+	"instance.restored",
+	"binding.created",
+	"binding.deleted",
+	"binding.expired",
+	"quota.updated",
+	"quota.deleted",
+	"quota.exceeded",
+	"backup.created",
+	"backup.failed",
+	"backup.restored",
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook is an external endpoint that wants to be told about the
+// lifecycle of service instances, bindings and quotas.  An empty
+// list of Events means every event.
+type Webhook struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Format string   `json:"format"`
+	Events []string `json:"events,omitempty"`
+}
+
+// Delivery is a single event, queued in the outbox for one webhook.
+type Delivery struct {
+	ID          int64           `json:"id"`
+	Hook        string          `json:"webhook"`
+	Type        string          `json:"type"`
+	Data        json.RawMessage `json:"data"`
+	Created     time.Time       `json:"created"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt *time.Time      `json:"next_attempt,omitempty"`
+	Delivered   *time.Time      `json:"delivered,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+type DeliveryFilter struct {
+	Hook   string
+	Status string
+	Limit  int
+}
+
+func validWebhookType(kind string) bool {
+	for _, t := range webhookTypes {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// loadWebhooks reads the webhooks to notify from the SB_WEBHOOKS
+// environment variable, a JSON list.
+func loadWebhooks() ([]Webhook, error) {
+	s := os.Getenv("SB_WEBHOOKS")
+	if s == "" {
+		return nil, nil
+	}
+
+	var hooks []Webhook
+	if err := json.Unmarshal([]byte(s), &hooks); err != nil {
+		return nil, fmt.Errorf("SB_WEBHOOKS: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range hooks {
+		h := &hooks[i]
+		if h.Name == "" || h.URL == "" {
+			return nil, fmt.Errorf("SB_WEBHOOKS: webhook #%d is missing its name or url", i+1)
+		}
+		if seen[h.Name] {
+			return nil, fmt.Errorf("SB_WEBHOOKS: webhook '%s' is defined more than once", h.Name)
+		}
+		seen[h.Name] = true
+
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("SB_WEBHOOKS: webhook '%s' has an invalid url '%s'", h.Name, h.URL)
+		}
+		if h.Format == "" {
+			h.Format = "json"
+		}
+		if h.Format != "json" && h.Format != "cloudevents" {
+			return nil, fmt.Errorf("SB_WEBHOOKS: webhook '%s' has an invalid format '%s' (must be 'json' or 'cloudevents')", h.Name, h.Format)
+		}
+		for _, kind := range h.Events {
+			if !validWebhookType(kind) {
+				return nil, fmt.Errorf("SB_WEBHOOKS: webhook '%s' wants unknown event '%s'", h.Name, kind)
+			}
+		}
+	}
+
+	return hooks, nil
+}
+
+func (h Webhook) wants(kind string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Broker) webhook(name string) (Webhook, bool) {
+	for _, h := range b.Webhooks {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return Webhook{}, false
+}
+
+func (b *Broker) createWebhookSchemas() {
+	b.db.Exec(`
+CREATE TABLE IF NOT EXISTS
+outbox (
+  id           BIGSERIAL PRIMARY KEY,
+  hook         TEXT NOT NULL,
+  type         TEXT NOT NULL,
+  data         TEXT NOT NULL,
+  created      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  attempts     INTEGER NOT NULL DEFAULT 0,
+  next_attempt TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  delivered    TIMESTAMP WITH TIME ZONE,
+  last_error   TEXT
+)`)
+	b.db.Exec(`CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (next_attempt) WHERE delivered IS NULL`)
+}
+
+// notify queues an event for every webhook that wants it; delivery
+// happens later, from the outbox, so that a slow or unreachable
+// endpoint never holds up the broker (and nothing is lost on restart).
+func (b *Broker) notify(kind string, data interface{}) {
+	if len(b.Webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		oops("failed to encode %s webhook event: %s\n", kind, err)
+		return
+	}
+
+	queued := false
+	for _, h := range b.Webhooks {
+		if !h.wants(kind) {
+			continue
+		}
+		if _, err := b.exec(context.Background(), `INSERT INTO outbox (hook, type, data) VALUES ($1, $2, $3)`, h.Name, kind, string(body)); err != nil {
+			oops("failed to queue %s event for webhook '%s': %s\n", kind, h.Name, err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		b.wakeCourier()
+	}
+}
+
+func (b *Broker) wakeCourier() {
+	if b.outbox == nil {
+		return
+	}
+	/* wake up the courier, unless it is already awake */
+	select {
+	case b.outbox <- struct{}{}:
+	default:
+	}
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (b *Broker) webhookPayload(h Webhook, d Delivery) ([]byte, string, error) {
+	id := strconv.FormatInt(d.ID, 10)
+	if h.Format == "cloudevents" {
+		body, err := json.Marshal(struct {
+			SpecVersion     string          `json:"specversion"`
+			ID              string          `json:"id"`
+			Source          string          `json:"source"`
+			Type            string          `json:"type"`
+			Time            time.Time       `json:"time"`
+			DataContentType string          `json:"datacontenttype"`
+			Data            json.RawMessage `json:"data"`
+		}{"1.0", id, "/tinsmith/" + b.Service.ID, "tinsmith." + d.Type, d.Created, "application/json", d.Data})
+		return body, "application/cloudevents+json", err
+	}
+
+	body, err := json.Marshal(struct {
+		ID      string          `json:"id"`
+		Type    string          `json:"type"`
+		Time    time.Time       `json:"time"`
+		Service string          `json:"service"`
+		Data    json.RawMessage `json:"data"`
+	}{id, d.Type, d.Created, b.Service.Name, d.Data})
+	return body, "application/json", err
+}
+
+func (b *Broker) post(h Webhook, d Delivery) error {
+	body, contentType, err := b.webhookPayload(h, d)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Tinsmith-Event", d.Type)
+	req.Header.Set("X-Tinsmith-Delivery", strconv.FormatInt(d.ID, 10))
+	if h.Secret != "" {
+		req.Header.Set("X-Tinsmith-Signature", sign(h.Secret, body))
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", h.URL, res.Status)
+	}
+	return nil
+}
+
+// backoff doubles the wait between attempts, from 30s up to an hour.
+func backoff(attempts int) time.Duration {
+	wait := 30 * time.Second
+	for i := 1; i < attempts && wait < time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+	return wait
+}
+
+// DeliverWebhooks tries to deliver everything in the outbox that is
+// due.  Deliveries are leased before they are attempted, so that more
+// than one broker instance can share the same outbox.
+func (b *Broker) DeliverWebhooks() {
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+
+	r, err := b.db.QueryContext(ctx, `
+UPDATE outbox SET next_attempt = $2
+ WHERE id IN (SELECT id FROM outbox
+               WHERE delivered IS NULL AND attempts < $1 AND next_attempt <= now()
+               ORDER BY id LIMIT 100 FOR UPDATE SKIP LOCKED)
+ RETURNING id, hook, type, data, created, attempts`, b.WebhookAttempts, time.Now().Add(webhookLease))
+	if err != nil {
+		oops("failed to check webhook outbox: %s\n", err)
+		return
+	}
+
+	var due []Delivery
+	for r.Next() {
+		var (
+			d    Delivery
+			data string
+		)
+		if err := r.Scan(&d.ID, &d.Hook, &d.Type, &data, &d.Created, &d.Attempts); err != nil {
+			oops("failed to check webhook outbox: %s\n", err)
+			continue
+		}
+		d.Data = json.RawMessage(data)
+		due = append(due, d)
+	}
+	r.Close()
+
+	for _, d := range due {
+		h, ok := b.webhook(d.Hook)
+		if !ok {
+			b.exec(context.Background(), `UPDATE outbox SET attempts = $2, last_error = $3 WHERE id = $1`,
+				d.ID, b.WebhookAttempts, fmt.Sprintf("webhook '%s' is no longer configured", d.Hook))
+			continue
+		}
+
+		d.Attempts++
+		if err := b.post(h, d); err != nil {
+			wait := backoff(d.Attempts)
+			oops("failed to deliver %s event #%d to webhook '%s' (attempt %d of %d, retrying in %s): %s\n",
+				d.Type, d.ID, h.Name, d.Attempts, b.WebhookAttempts, wait, err)
+			b.exec(context.Background(), `UPDATE outbox SET attempts = $2, next_attempt = $3, last_error = $4 WHERE id = $1`,
+				d.ID, d.Attempts, time.Now().Add(wait), err.Error())
+			continue
+		}
+
+		info("delivered %s event #%d to webhook '%s'\n", d.Type, d.ID, h.Name)
+		b.exec(context.Background(), `UPDATE outbox SET attempts = $2, delivered = now(), last_error = NULL WHERE id = $1`, d.ID, d.Attempts)
+	}
+}
+
+// Courier delivers webhooks as they are queued, and retries failed
+// deliveries at least once every interval; it never returns.
+func (b *Broker) Courier(interval time.Duration) {
+	info("delivering to %d webhook(s), retrying every %s\n", len(b.Webhooks), interval)
+	for {
+		b.DeliverWebhooks()
+		select {
+		case <-b.outbox:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (b *Broker) Deliveries(filter DeliveryFilter) ([]Delivery, error) {
+	var (
+		where []string
+		args  = []interface{}{b.WebhookAttempts}
+	)
+
+	if filter.Hook != "" {
+		args = append(args, filter.Hook)
+		where = append(where, fmt.Sprintf(`hook = $%d`, len(args)))
+	}
+	switch filter.Status {
+	case "":
+	case deliveryDelivered:
+		where = append(where, `delivered IS NOT NULL`)
+	case deliveryPending:
+		where = append(where, `delivered IS NULL AND attempts < $1`)
+	case deliveryFailed:
+		where = append(where, `delivered IS NULL AND attempts >= $1`)
+	default:
+		return nil, fmt.Errorf("invalid delivery status '%s' (must be 'pending', 'delivered' or 'failed')", filter.Status)
+	}
+
+	query := `SELECT id, hook, type, data, created, attempts, next_attempt, delivered, COALESCE(last_error, ''),
+       CASE WHEN delivered IS NOT NULL THEN 'delivered' WHEN attempts >= $1 THEN 'failed' ELSE 'pending' END
+  FROM outbox`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, filter.Limit)
+	}
+
+	ctx, cancel := b.statement(context.Background())
+	defer cancel()
+	r, err := b.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	l := make([]Delivery, 0)
+	for r.Next() {
+		var (
+			d         Delivery
+			data      string
+			next      time.Time
+			delivered sql.NullTime
+		)
+		if err := r.Scan(&d.ID, &d.Hook, &d.Type, &data, &d.Created, &d.Attempts, &next, &delivered,
+			&d.LastError, &d.Status); err != nil {
+			return nil, err
+		}
+		d.Data = json.RawMessage(data)
+		if delivered.Valid {
+			d.Delivered = &delivered.Time
+		} else if d.Status == deliveryPending {
+			d.NextAttempt = &next
+		}
+		l = append(l, d)
+	}
+	return l, r.Err()
+}
+
+// RetryDelivery puts an undelivered (usually failed) delivery back
+// at the front of the queue, with a fresh set of attempts.
+func (b *Broker) RetryDelivery(id int64) (bool, error) {
+	r, err := b.exec(context.Background(), `UPDATE outbox SET attempts = 0, next_attempt = now() WHERE id = $1 AND delivered IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if n > 0 {
+		b.wakeCourier()
+	}
+	return n > 0, err
+}
+
+func (b *Broker) PurgeDeliveries() {
+	if b.EventRetention <= 0 {
+		return
+	}
+
+	r, err := b.exec(context.Background(), `DELETE FROM outbox WHERE delivered < $1`, time.Now().Add(-b.EventRetention))
+	if err != nil {
+		oops("failed to purge webhook deliveries older than %s: %s\n", b.EventRetention, err)
+		return
+	}
+	if n, _ := r.RowsAffected(); n > 0 {
+		info("purged %d webhook deliveries older than %s\n", n, b.EventRetention)
+	}
+}
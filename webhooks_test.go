@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var outboxRowColumns = []string{"id", "hook", "type", "data", "created", "attempts"}
+
+func TestLoadWebhooks(t *testing.T) {
+	os.Setenv("SB_WEBHOOKS", `[
+	  {"name": "cmdb", "url": "https://cmdb.example.com/hooks/postgres", "secret": "s3cr3t"},
+	  {"name": "chat", "url": "https://chat.example.com/hook", "format": "cloudevents", "events": ["instance.created", "instance.deleted"]}
+	]`)
+	defer os.Unsetenv("SB_WEBHOOKS")
+
+	hooks, err := loadWebhooks()
+	if err != nil {
+		t.Fatalf(`unexpected error: %s`, err)
+	}
+	if len(hooks) != 2 || hooks[0].Format != "json" || hooks[1].Format != "cloudevents" {
+		t.Fatalf(`unexpected webhooks: %v`, hooks)
+	}
+	if !hooks[0].wants("quota.exceeded") || hooks[1].wants("binding.created") || !hooks[1].wants("instance.deleted") {
+		t.Fatalf(`unexpected webhook event subscriptions: %v`, hooks)
+	}
+}
+
+func TestLoadWebhooksInvalid(t *testing.T) {
+	defer os.Unsetenv("SB_WEBHOOKS")
+
+	for _, s := range []string{
+		`{"name": "cmdb"}`,
+		`[{"name": "cmdb"}]`,
+		`[{"name": "cmdb", "url": "cmdb.example.com"}]`,
+		`[{"name": "cmdb", "url": "https://cmdb.example.com"}, {"name": "cmdb", "url": "https://other.example.com"}]`,
+		`[{"name": "cmdb", "url": "https://cmdb.example.com", "format": "xml"}]`,
+		`[{"name": "cmdb", "url": "https://cmdb.example.com", "events": ["instance.exploded"]}]`,
+	} {
+		os.Setenv("SB_WEBHOOKS", s)
+		if _, err := loadWebhooks(); err == nil {
+			t.Fatalf(`expected SB_WEBHOOKS=%s to fail`, s)
+		}
+	}
+}
+
+func TestNotifyQueuesInterestedWebhooks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	broker := &Broker{
+		db: db,
+		Webhooks: []Webhook{
+			{Name: "cmdb", URL: "https://cmdb.example.com"},
+			{Name: "chat", URL: "https://chat.example.com", Events: []string{"instance.created"}},
+		},
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO outbox (hook, type, data) VALUES ($1, $2, $3)`)).
+		WithArgs("cmdb", "binding.deleted", `{"binding":"binding-1","instance":"instance-1","username":"u1","database":"db1","created":"0001-01-01T00:00:00Z"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	broker.notify("binding.deleted", Binding{ID: "binding-1", Instance: "instance-1", Username: "u1", Database: "db1"})
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	var (
+		body      []byte
+		signature string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		signature = r.Header.Get("X-Tinsmith-Signature")
+		if r.Header.Get("Content-Type") != "application/cloudevents+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	broker := &Broker{
+		db:              db,
+		WebhookAttempts: 5,
+		Webhooks:        []Webhook{{Name: "cmdb", URL: server.URL, Secret: "s3cr3t", Format: "cloudevents"}},
+	}
+	broker.Service.ID = "service-1"
+
+	mock.ExpectQuery(`UPDATE outbox SET next_attempt = \$2 WHERE id IN`).
+		WithArgs(5, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(outboxRowColumns).
+			AddRow(7, "cmdb", "instance.created", `{"instance":"instance-1"}`, time.Now(), 0).
+			AddRow(8, "removed", "instance.created", `{"instance":"instance-1"}`, time.Now(), 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox SET attempts = $2, delivered = now(), last_error = NULL WHERE id = $1`)).
+		WithArgs(7, 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox SET attempts = $2, last_error = $3 WHERE id = $1`)).
+		WithArgs(8, 5, "webhook 'removed' is no longer configured").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	broker.DeliverWebhooks()
+
+	if signature != sign("s3cr3t", body) {
+		t.Fatalf(`expected signature %s, got: %s`, sign("s3cr3t", body), signature)
+	}
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Instance string `json:"instance"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf(`unexpected error decoding '%s': %s`, body, err)
+	}
+	if event.ID != "7" || event.Type != "tinsmith.instance.created" || event.Data.Instance != "instance-1" {
+		t.Fatalf(`unexpected webhook payload: %s`, body)
+	}
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeliverWebhooksBacksOff(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	broker := &Broker{
+		db:              db,
+		WebhookAttempts: 5,
+		Webhooks:        []Webhook{{Name: "cmdb", URL: server.URL, Format: "json"}},
+	}
+
+	mock.ExpectQuery(`UPDATE outbox SET next_attempt = \$2 WHERE id IN`).
+		WithArgs(5, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(outboxRowColumns).
+			AddRow(7, "cmdb", "instance.deleted", `{}`, time.Now(), 2))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE outbox SET attempts = $2, next_attempt = $3, last_error = $4 WHERE id = $1`)).
+		WithArgs(7, 3, sqlmock.AnyArg(), server.URL+" responded 503 Service Unavailable").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	broker.DeliverWebhooks()
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	for attempts, expected := range map[int]time.Duration{
+		1:  30 * time.Second,
+		3:  2 * time.Minute,
+		8:  time.Hour,
+		20: time.Hour,
+	} {
+		if wait := backoff(attempts); wait != expected {
+			t.Fatalf(`expected backoff(%d) to be %s, got: %s`, attempts, expected, wait)
+		}
+	}
+}